@@ -0,0 +1,28 @@
+package main
+
+import (
+	"elearning-5/internal/app"
+	grpc "elearning-5/internal/grpc"
+	"elearning-5/internal/signalr"
+	"elearning-5/internal/websocket"
+	"log/slog"
+)
+
+// chat-server runs the gRPC, WebSocket and SignalR servers in one process so
+// that they share a single broker and every room spans all three protocols.
+func main() {
+	a := app.Load("chat-server")
+	cfg := a.Config
+
+	grpcServer := grpc.NewServer(a.Broker, a.Store, a.GRPCOptions())
+	wsServer := websocket.NewServer(a.Broker, a.Store, a.WebSocketOptions())
+	signalrServer := signalr.NewSignalRServer(a.Broker, a.Store, a.SignalROptions())
+
+	slog.Info("Starting chat server",
+		"grpc_port", cfg.GRPCPort, "websocket_port", cfg.WebSocketPort, "signalr_port", cfg.SignalRPort)
+	a.Run(
+		app.Server{Name: "gRPC", Start: func() error { return grpcServer.Start(cfg.GRPCPort) }, Shutdown: grpcServer.Shutdown},
+		app.Server{Name: "WebSocket", Start: func() error { return wsServer.Start(cfg.WebSocketPort) }, Shutdown: wsServer.Shutdown},
+		app.Server{Name: "SignalR", Start: func() error { return signalrServer.Start(cfg.SignalRPort) }, Shutdown: signalrServer.Shutdown},
+	)
+}
@@ -1,14 +1,34 @@
 package main
 
 import (
+	"elearning-5/internal/app"
 	grpc "elearning-5/internal/grpc"
-	"log"
+	"errors"
+	"log/slog"
+	"net/http"
 )
 
 func main() {
-	server := grpc.NewServer()
-	log.Println("Starting gRPC server on :50051...")
-	if err := server.Start("50051"); err != nil {
-		log.Fatalf("Failed to start gRPC server: %v", err)
+	a := app.Load("grpc-server")
+	cfg := a.Config
+
+	server := grpc.NewServer(a.Broker, a.Store, a.GRPCOptions())
+	slog.Info("Starting gRPC server", "port", cfg.GRPCPort)
+
+	// The gRPC port only speaks gRPC, so metrics get their own
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", a.Metrics.Handler())
+	metricsServer := &http.Server{Addr: ":" + cfg.MetricsPort, Handler: mux}
+	serveMetrics := func() error {
+		slog.Info("Metrics server starting", "url", "http://localhost:"+cfg.MetricsPort+"/metrics")
+		if err := metricsServer.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
 	}
+
+	a.Run(
+		app.Server{Name: "gRPC", Start: func() error { return server.Start(cfg.GRPCPort) }, Shutdown: server.Shutdown},
+		app.Server{Name: "metrics", Start: serveMetrics, Shutdown: metricsServer.Shutdown},
+	)
 }
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"elearning-5/internal/app"
 	"elearning-5/internal/signalr"
-	"log"
+	"log/slog"
 )
 
 func main() {
-	server := signalr.NewSignalRServer()
-	log.Println("Starting SignalR-like server on :8081...")
-	if err := server.Start("8081"); err != nil {
-		log.Fatalf("Failed to start SignalR server: %v", err)
-	}
+	a := app.Load("signalr-server")
+	port := a.Config.SignalRPort
+
+	server := signalr.NewSignalRServer(a.Broker, a.Store, a.SignalROptions())
+	slog.Info("Starting SignalR server", "port", port)
+	a.Run(app.Server{Name: "SignalR", Start: func() error { return server.Start(port) }, Shutdown: server.Shutdown})
 }
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"elearning-5/internal/app"
 	"elearning-5/internal/websocket"
-	"log"
+	"log/slog"
 )
 
 func main() {
-	server := websocket.NewServer()
-	log.Println("Starting WebSocket server on :8080...")
-	if err := server.Start("8080"); err != nil {
-		log.Fatalf("Failed to start WebSocket server: %v", err)
-	}
+	a := app.Load("websocket-server")
+	port := a.Config.WebSocketPort
+
+	server := websocket.NewServer(a.Broker, a.Store, a.WebSocketOptions())
+	slog.Info("Starting WebSocket server", "port", port)
+	a.Run(app.Server{Name: "WebSocket", Start: func() error { return server.Start(port) }, Shutdown: server.Shutdown})
 }
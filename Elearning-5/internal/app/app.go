@@ -0,0 +1,260 @@
+// Package app sets up what every server command shares: logging, tracing,
+// the broker, the message store, authentication, the room policy, limits,
+// presence, metrics and TLS certificates. The commands only choose the
+// protocols they serve.
+package app
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"elearning-5/internal/auth"
+	"elearning-5/internal/broker"
+	"elearning-5/internal/certs"
+	"elearning-5/internal/config"
+	"elearning-5/internal/connlimit"
+	"elearning-5/internal/grpc"
+	"elearning-5/internal/metrics"
+	"elearning-5/internal/origin"
+	"elearning-5/internal/policy"
+	"elearning-5/internal/presence"
+	"elearning-5/internal/ratelimit"
+	"elearning-5/internal/signalr"
+	"elearning-5/internal/store"
+	"elearning-5/internal/tracing"
+	"elearning-5/internal/websocket"
+	"elearning-5/pkg/logger"
+)
+
+// App holds the parts of a server process that its protocol servers share,
+// so that every room spans all of them.
+type App struct {
+	Config      *config.Config
+	Broker      broker.Broker
+	Store       store.MessageStore
+	Auth        *auth.Verifier
+	Policy      *policy.Policy
+	Limiter     *ratelimit.Limiter
+	Connections *connlimit.Limiter
+	Metrics     *metrics.Metrics
+	Presence    *presence.Tracker
+	TLS         *certs.Reloader // nil serves plaintext
+
+	origins         *origin.Allowlist // loaded by the first HTTP protocol
+	shutdownTracing func(context.Context) error
+}
+
+// Server is a protocol server run by App.Run. Start blocks while it serves.
+type Server struct {
+	Name     string
+	Start    func() error
+	Shutdown func(ctx context.Context) error
+}
+
+// Load reads the configuration and sets up the shared parts of service, the
+// name its traces carry. Invalid configuration ends the process.
+func Load(service string) *App {
+	cfg := config.Load()
+	if err := logger.Setup(logger.Options{
+		Format: cfg.LogFormat,
+		Level:  cfg.LogLevel,
+		Bodies: cfg.LogMessageBodies,
+	}); err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		Exporter:    cfg.TracingExporter,
+		ServiceName: service,
+	})
+	if err != nil {
+		logger.Fatal("Invalid TRACING_EXPORTER", "err", err)
+	}
+
+	st, err := store.Open(cfg.HistoryStore, cfg.HistoryDir, cfg.HistorySize)
+	if err != nil {
+		logger.Fatal("Failed to open message store", "err", err)
+	}
+
+	verifier, err := auth.NewVerifier(auth.Config{
+		Secret:        cfg.JWTSecret,
+		PublicKeyFile: cfg.JWTPublicKeyFile,
+		JWKSFile:      cfg.JWTJWKSFile,
+		Issuer:        cfg.JWTIssuer,
+		Audience:      cfg.JWTAudience,
+	})
+	if err != nil {
+		logger.Fatal("Invalid JWT configuration", "err", err)
+	}
+	if !verifier.Enabled() {
+		slog.Warn("JWT authentication is disabled, clients choose their own user names")
+	}
+
+	rooms, err := policy.Load(cfg.RoomsFile)
+	if err != nil {
+		logger.Fatal("Invalid ROOMS_FILE", "err", err)
+	}
+
+	var tlsCerts *certs.Reloader
+	if cfg.EnableTLS {
+		tlsCerts, err = certs.Load(certs.Config{
+			CertFile:     cfg.TLSCertFile,
+			KeyFile:      cfg.TLSKeyFile,
+			ClientCAFile: cfg.TLSClientCAFile,
+		})
+		if err != nil {
+			logger.Fatal("Invalid TLS configuration", "err", err)
+		}
+	}
+
+	b := broker.NewMemoryBroker()
+	return &App{
+		Config: cfg,
+		Broker: b,
+		Store:  st,
+		Auth:   verifier,
+		Policy: rooms,
+		Limiter: ratelimit.New(ratelimit.Limits{
+			PerConnection: ratelimit.Rate{PerSecond: cfg.RateLimitConnection, Burst: cfg.RateLimitConnectionBurst},
+			PerUser:       ratelimit.Rate{PerSecond: cfg.RateLimitUser, Burst: cfg.RateLimitUserBurst},
+			PerRoom:       ratelimit.Rate{PerSecond: cfg.RateLimitRoom, Burst: cfg.RateLimitRoomBurst},
+			Strikes:       cfg.RateLimitStrikes,
+		}),
+		Connections: connlimit.New(connlimit.Limits{Max: cfg.MaxConnections, PerIP: cfg.MaxConnectionsPerIP}),
+		Metrics:     metrics.New(),
+		Presence: presence.New(b, presence.Options{
+			Timeout:       cfg.PresenceTimeout,
+			TypingTimeout: cfg.TypingTimeout,
+		}),
+		TLS:             tlsCerts,
+		shutdownTracing: shutdownTracing,
+	}
+}
+
+// GRPCOptions returns the options of a gRPC server of the app.
+func (a *App) GRPCOptions() grpc.Options {
+	overflow, err := grpc.ParseOverflowPolicy(a.Config.GRPCOverflowPolicy)
+	if err != nil {
+		logger.Fatal("Invalid GRPC_OVERFLOW_POLICY", "err", err)
+	}
+	return grpc.Options{
+		SendQueueSize: a.Config.GRPCSendQueueSize,
+		Overflow:      overflow,
+		Auth:          a.Auth,
+		Policy:        a.Policy,
+		Limiter:       a.Limiter,
+		Connections:   a.Connections,
+		TLS:           a.TLS,
+		Metrics:       a.Metrics,
+		Presence:      a.Presence,
+	}
+}
+
+// WebSocketOptions returns the options of a WebSocket server of the app.
+func (a *App) WebSocketOptions() websocket.Options {
+	return websocket.Options{
+		Auth:        a.Auth,
+		Policy:      a.Policy,
+		Limiter:     a.Limiter,
+		Connections: a.Connections,
+		TLS:         a.TLS,
+		Origins:     a.allowedOrigins(),
+		Metrics:     a.Metrics,
+		Presence:    a.Presence,
+	}
+}
+
+// SignalROptions returns the options of a SignalR server of the app.
+func (a *App) SignalROptions() signalr.Options {
+	return signalr.Options{
+		Auth:        a.Auth,
+		Policy:      a.Policy,
+		Limiter:     a.Limiter,
+		Connections: a.Connections,
+		TLS:         a.TLS,
+		Origins:     a.allowedOrigins(),
+		Metrics:     a.Metrics,
+		Presence:    a.Presence,
+	}
+}
+
+// allowedOrigins loads the browser origins on first use, as gRPC does not
+// check them.
+func (a *App) allowedOrigins() *origin.Allowlist {
+	if a.origins != nil {
+		return a.origins
+	}
+	origins, err := origin.New(a.Config.AllowedOrigins, a.Config.OriginDevMode)
+	if err != nil {
+		logger.Fatal("Invalid ALLOWED_ORIGINS", "err", err)
+	}
+	if origins.Dev() {
+		slog.Warn("Origin dev mode is on, every browser origin is allowed")
+	}
+	a.origins = origins
+	return origins
+}
+
+// Run starts servers and serves until the process is signalled to stop or
+// one of them fails; since they share one broker, a failing server takes the
+// whole process down with it. The servers are then shut down together within
+// the configured timeout and the shared parts closed. A failure exits with
+// status 1.
+func (a *App) Run(servers ...Server) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if a.TLS != nil {
+		go a.TLS.Watch(ctx, certs.DefaultInterval)
+	}
+	go a.Presence.Watch(ctx, presence.DefaultInterval)
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv Server) {
+			if err := srv.Start(); err != nil {
+				errs <- fmt.Errorf("%s server: %w", srv.Name, err)
+			}
+		}(srv)
+	}
+
+	var failure error
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutdown signal received, draining connections")
+	case failure = <-errs:
+		slog.Error("Server stopping", "err", failure)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), a.Config.ShutdownTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				slog.Error("Server shutdown failed", "server", srv.Name, "err", err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+	a.Broker.Close()
+	if err := a.Store.Close(); err != nil {
+		slog.Error("Closing message store failed", "err", err)
+	}
+	if err := a.shutdownTracing(shutdownCtx); err != nil {
+		slog.Error("Flushing traces failed", "err", err)
+	}
+
+	if failure != nil {
+		os.Exit(1)
+	}
+	slog.Info("Server stopped")
+}
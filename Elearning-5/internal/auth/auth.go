@@ -0,0 +1,164 @@
+// Package auth verifies the JWTs clients present on every protocol. The
+// subject of a verified token is the client's identity; clients cannot name
+// themselves once authentication is enabled.
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrNoToken is returned by Verify for an empty token.
+	ErrNoToken = errors.New("auth: missing token")
+	// ErrInvalidToken wraps every reason a token is rejected.
+	ErrInvalidToken = errors.New("auth: invalid token")
+)
+
+// Config selects the keys tokens are verified with. Authentication is
+// disabled when no key is configured.
+type Config struct {
+	// Secret is the HS256 key
+	Secret string
+	// PublicKeyFile is a PEM RSA public key or certificate for RS256 tokens
+	PublicKeyFile string
+	// JWKSFile is a JSON Web Key Set of RS256 keys, picked by the token's kid
+	JWKSFile string
+
+	// Issuer and Audience, when set, must match the iss and aud claims
+	Issuer   string
+	Audience string
+}
+
+// Verifier checks tokens signed with HS256 or RS256. A nil Verifier has
+// authentication disabled.
+type Verifier struct {
+	secret []byte
+	rsaKey *rsa.PublicKey            // key for RS256 tokens without a known kid
+	jwks   map[string]*rsa.PublicKey // kid -> key
+	parser *jwt.Parser
+}
+
+// NewVerifier loads the keys of cfg.
+func NewVerifier(cfg Config) (*Verifier, error) {
+	v := &Verifier{secret: []byte(cfg.Secret)}
+
+	if cfg.PublicKeyFile != "" {
+		key, err := loadPublicKey(cfg.PublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load RS256 public key: %w", err)
+		}
+		v.rsaKey = key
+	}
+	if cfg.JWKSFile != "" {
+		keys, err := loadJWKS(cfg.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("load JWKS: %w", err)
+		}
+		v.jwks = keys
+	}
+
+	opts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"HS256", "RS256"}),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(30 * time.Second),
+	}
+	if cfg.Issuer != "" {
+		opts = append(opts, jwt.WithIssuer(cfg.Issuer))
+	}
+	if cfg.Audience != "" {
+		opts = append(opts, jwt.WithAudience(cfg.Audience))
+	}
+	v.parser = jwt.NewParser(opts...)
+	return v, nil
+}
+
+// Enabled reports whether any key is configured. Servers skip
+// authentication otherwise and trust the user names clients send.
+func (v *Verifier) Enabled() bool {
+	return v != nil && (len(v.secret) > 0 || v.rsaKey != nil || len(v.jwks) > 0)
+}
+
+// Verify checks the signature and claims of token and returns its subject.
+func (v *Verifier) Verify(token string) (string, error) {
+	if token == "" {
+		return "", ErrNoToken
+	}
+
+	var claims jwt.RegisteredClaims
+	if _, err := v.parser.ParseWithClaims(token, &claims, v.key); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+	return claims.Subject, nil
+}
+
+// key picks the verification key for the token's algorithm and kid.
+func (v *Verifier) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method.Alg() {
+	case "HS256":
+		if len(v.secret) == 0 {
+			return nil, errors.New("HS256 is not configured")
+		}
+		return v.secret, nil
+
+	case "RS256":
+		if kid, _ := token.Header["kid"].(string); kid != "" {
+			if key, ok := v.jwks[kid]; ok {
+				return key, nil
+			}
+		}
+		if v.rsaKey == nil {
+			return nil, errors.New("unknown RS256 key")
+		}
+		return v.rsaKey, nil
+	}
+	return nil, fmt.Errorf("unexpected signing method %s", token.Method.Alg())
+}
+
+// TokenFromHeader returns the token of a "Bearer <token>" Authorization
+// value, or "" if it is not one.
+func TokenFromHeader(value string) string {
+	const prefix = "bearer "
+	if len(value) > len(prefix) && strings.EqualFold(value[:len(prefix)], prefix) {
+		return strings.TrimSpace(value[len(prefix):])
+	}
+	return ""
+}
+
+// TokenFromRequest returns the token of an HTTP request. Browsers cannot set
+// headers on WebSocket upgrades, so upgrades, such as the SignalR connects,
+// may carry it in the access_token query parameter instead. Other requests
+// need the Authorization header, keeping tokens out of their URLs.
+func TokenFromRequest(r *http.Request) string {
+	if token := TokenFromHeader(r.Header.Get("Authorization")); token != "" {
+		return token
+	}
+	if !websocket.IsWebSocketUpgrade(r) {
+		return ""
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+type userKey struct{}
+
+// WithUser returns a context carrying the verified user.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// UserFrom returns the verified user of ctx, if any.
+func UserFrom(ctx context.Context) (string, bool) {
+	user, ok := ctx.Value(userKey{}).(string)
+	return user, ok
+}
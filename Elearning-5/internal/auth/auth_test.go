@@ -0,0 +1,149 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.RegisteredClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func validClaims(sub string) jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{
+		Subject:   sub,
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+}
+
+func TestVerifyHS256(t *testing.T) {
+	v, err := NewVerifier(Config{Secret: "secret", Issuer: "chat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := validClaims("alice")
+	claims.Issuer = "chat"
+	if user, err := v.Verify(sign(t, jwt.SigningMethodHS256, []byte("secret"), "", claims)); err != nil || user != "alice" {
+		t.Fatalf("Verify = %q, %v, want alice", user, err)
+	}
+
+	expired := claims
+	expired.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour))
+	noExpiry := claims
+	noExpiry.ExpiresAt = nil
+	noSubject := claims
+	noSubject.Subject = ""
+	otherIssuer := claims
+	otherIssuer.Issuer = "other"
+
+	for name, token := range map[string]string{
+		"wrong secret": sign(t, jwt.SigningMethodHS256, []byte("guess"), "", claims),
+		"expired":      sign(t, jwt.SigningMethodHS256, []byte("secret"), "", expired),
+		"no expiry":    sign(t, jwt.SigningMethodHS256, []byte("secret"), "", noExpiry),
+		"no subject":   sign(t, jwt.SigningMethodHS256, []byte("secret"), "", noSubject),
+		"other issuer": sign(t, jwt.SigningMethodHS256, []byte("secret"), "", otherIssuer),
+		"alg none":     sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, "", claims),
+		"garbage":      "not.a.token",
+	} {
+		if _, err := v.Verify(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: Verify error = %v, want ErrInvalidToken", name, err)
+		}
+	}
+	if _, err := v.Verify(""); !errors.Is(err, ErrNoToken) {
+		t.Errorf("empty token: Verify error = %v, want ErrNoToken", err)
+	}
+}
+
+func TestVerifyRS256(t *testing.T) {
+	dir := t.TempDir()
+	pemKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwksKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	der, _ := x509.MarshalPKIXPublicKey(&pemKey.PublicKey)
+	pemFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600)
+
+	jwks, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "k1",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(jwksKey.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(jwksKey.E)).Bytes()),
+	}}})
+	jwksFile := filepath.Join(dir, "jwks.json")
+	os.WriteFile(jwksFile, jwks, 0o600)
+
+	v, err := NewVerifier(Config{PublicKeyFile: pemFile, JWKSFile: jwksFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, token := range map[string]string{
+		"PEM key":  sign(t, jwt.SigningMethodRS256, pemKey, "", validClaims("bob")),
+		"JWKS key": sign(t, jwt.SigningMethodRS256, jwksKey, "k1", validClaims("bob")),
+	} {
+		if user, err := v.Verify(token); err != nil || user != "bob" {
+			t.Errorf("%s: Verify = %q, %v, want bob", name, user, err)
+		}
+	}
+
+	// Without a secret HS256 tokens are refused, even one signed with the
+	// public key bytes
+	if _, err := v.Verify(sign(t, jwt.SigningMethodHS256, der, "", validClaims("bob"))); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("HS256 token: Verify error = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestEnabled(t *testing.T) {
+	var nilVerifier *Verifier
+	if nilVerifier.Enabled() {
+		t.Error("nil verifier is enabled")
+	}
+	v, _ := NewVerifier(Config{})
+	if v.Enabled() {
+		t.Error("verifier without keys is enabled")
+	}
+}
+
+func TestTokenFromRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/history?access_token=query", nil)
+	if got := TokenFromRequest(r); got != "" {
+		t.Errorf("query token of a plain request = %q, want none", got)
+	}
+	r = httptest.NewRequest("GET", "/ws?access_token=query", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	if got := TokenFromRequest(r); got != "query" {
+		t.Errorf("query token of an upgrade = %q", got)
+	}
+	r.Header.Set("Authorization", "Bearer header")
+	if got := TokenFromRequest(r); got != "header" {
+		t.Errorf("header token = %q, want it to take precedence", got)
+	}
+	if got := TokenFromHeader("Basic abc"); got != "" {
+		t.Errorf("basic credentials = %q, want none", got)
+	}
+}
@@ -0,0 +1,140 @@
+package broker
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+)
+
+// ErrClosed is returned when publishing to or subscribing on a closed broker.
+var ErrClosed = errors.New("broker: closed")
+
+// Message is the protocol-neutral chat message that the WebSocket, SignalR
+// and gRPC hubs exchange through a Broker.
+type Message struct {
+	ID        string `json:"id"`
+	User      string `json:"user"`
+	Message   string `json:"message"`
+	Timestamp string `json:"timestamp"`
+	Room      string `json:"room"`
+	Type      string `json:"type"`          // message, join, leave, system, direct
+	Source    string `json:"source"`        // protocol the message arrived on: websocket, signalr, grpc
+	Seq       uint64 `json:"seq,omitempty"` // position in the room's history, 0 if not stored
+	// To is the recipient of a direct message. Direct messages are kept in
+	// the conversation room of their two users but delivered to the
+	// connections of User and To only, never to a room.
+	To string `json:"to,omitempty"`
+	// TraceParent is the W3C trace context of the publish, which delivery
+	// spans on every protocol continue.
+	TraceParent string `json:"traceparent,omitempty"`
+}
+
+// Involves reports whether user sent or receives the direct message m.
+func (m Message) Involves(user string) bool {
+	return user != "" && (user == m.User || user == m.To)
+}
+
+// Subscription delivers every message published after it was created.
+type Subscription interface {
+	Messages() <-chan Message
+	Unsubscribe()
+}
+
+// Broker connects the protocol hubs so that a room spans all of them. Hubs
+// publish what their clients send and deliver what they receive from their
+// subscription, including their own messages.
+type Broker interface {
+	Publish(msg Message) error
+	Subscribe() (Subscription, error)
+	Close() error
+}
+
+// MemoryBroker is an in-process Broker for hubs that run in the same binary.
+type MemoryBroker struct {
+	subscribers map[*memorySubscription]bool
+	mutex       sync.RWMutex
+	buffer      int
+	closed      bool
+}
+
+type memorySubscription struct {
+	broker *MemoryBroker
+	ch     chan Message
+	once   sync.Once
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		subscribers: make(map[*memorySubscription]bool),
+		buffer:      1024,
+	}
+}
+
+func (b *MemoryBroker) Publish(msg Message) error {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+
+	if b.closed {
+		return ErrClosed
+	}
+
+	for sub := range b.subscribers {
+		select {
+		case sub.ch <- msg:
+		default:
+			// Subscriber is not keeping up, drop rather than stall every hub
+			slog.Warn("Broker subscriber full, dropping message", "id", msg.ID)
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe() (Subscription, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	sub := &memorySubscription{
+		broker: b,
+		ch:     make(chan Message, b.buffer),
+	}
+	b.subscribers[sub] = true
+	return sub, nil
+}
+
+// Close closes every subscription channel. Further publishes fail with
+// ErrClosed.
+func (b *MemoryBroker) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	for sub := range b.subscribers {
+		delete(b.subscribers, sub)
+		close(sub.ch)
+	}
+	return nil
+}
+
+func (s *memorySubscription) Messages() <-chan Message {
+	return s.ch
+}
+
+func (s *memorySubscription) Unsubscribe() {
+	s.once.Do(func() {
+		s.broker.mutex.Lock()
+		defer s.broker.mutex.Unlock()
+
+		if _, ok := s.broker.subscribers[s]; ok {
+			delete(s.broker.subscribers, s)
+			close(s.ch)
+		}
+	})
+}
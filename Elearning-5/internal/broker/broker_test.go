@@ -0,0 +1,92 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func receive(t *testing.T, sub Subscription) Message {
+	t.Helper()
+	select {
+	case msg, ok := <-sub.Messages():
+		if !ok {
+			t.Fatal("subscription closed")
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return Message{}
+	}
+}
+
+func TestPublishReachesEverySubscriber(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	first, _ := b.Subscribe()
+	second, _ := b.Subscribe()
+	if err := b.Publish(Message{ID: "1", Room: "room1"}); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	for _, sub := range []Subscription{first, second} {
+		if got := receive(t, sub); got.ID != "1" {
+			t.Errorf("received %v, want message 1", got)
+		}
+	}
+
+	first.Unsubscribe()
+	first.Unsubscribe() // twice is harmless
+	if _, open := <-first.Messages(); open {
+		t.Error("unsubscribed channel is still open")
+	}
+	b.Publish(Message{ID: "2"})
+	if got := receive(t, second); got.ID != "2" {
+		t.Errorf("received %v, want message 2", got)
+	}
+}
+
+func TestFullSubscriberDoesNotBlockPublish(t *testing.T) {
+	b := NewMemoryBroker()
+	b.buffer = 1
+	defer b.Close()
+
+	slow, _ := b.Subscribe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			b.Publish(Message{ID: "msg"})
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Publish blocked on a full subscriber")
+	}
+	if n := len(slow.Messages()); n != 1 {
+		t.Errorf("slow subscriber holds %d messages, want 1", n)
+	}
+}
+
+func TestClosedBroker(t *testing.T) {
+	b := NewMemoryBroker()
+	sub, _ := b.Subscribe()
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if _, open := <-sub.Messages(); open {
+		t.Error("subscription is still open after Close")
+	}
+	sub.Unsubscribe()
+
+	if err := b.Publish(Message{}); !errors.Is(err, ErrClosed) {
+		t.Errorf("Publish after Close = %v, want ErrClosed", err)
+	}
+	if _, err := b.Subscribe(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Subscribe after Close = %v, want ErrClosed", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("second Close = %v", err)
+	}
+}
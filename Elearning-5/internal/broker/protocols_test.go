@@ -0,0 +1,152 @@
+package broker_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"elearning-5/internal/broker"
+	chatgrpc "elearning-5/internal/grpc"
+	"elearning-5/internal/grpc/pb"
+	"elearning-5/internal/signalr"
+	"elearning-5/internal/store"
+	chatws "elearning-5/internal/websocket"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// TestRoomSpansProtocols publishes a message on each protocol and checks
+// that a client of every other protocol in the room receives it.
+func TestRoomSpansProtocols(t *testing.T) {
+	b := broker.NewMemoryBroker()
+	st := store.NewMemoryStore(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	wsServer := chatws.NewServer(b, st, chatws.Options{})
+	wsLis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go wsServer.Serve(wsLis)
+
+	grpcServer := chatgrpc.NewServer(b, st, chatgrpc.Options{})
+	grpcLis := bufconn.Listen(1024 * 1024)
+	go grpcServer.Serve(grpcLis)
+
+	hub := signalr.NewHub(b, st)
+	go hub.Run()
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		wsServer.Shutdown(ctx)
+		grpcServer.Shutdown(ctx)
+		hub.Shutdown(ctx)
+		b.Close()
+	})
+
+	// A client on every protocol joins room1
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws://"+wsLis.Addr().String()+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial /ws: %v", err)
+	}
+	defer wsConn.Close()
+	wsConn.WriteJSON(chatws.Message{Type: "join", User: "alice", Room: "room1", Message: "alice joined the chat"})
+
+	grpcConn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return grpcLis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial gRPC: %v", err)
+	}
+	defer grpcConn.Close()
+	client := pb.NewChatServiceClient(grpcConn)
+	stream, err := client.StreamMessages(ctx, &pb.StreamRequest{User: "bob", Room: "room1"})
+	if err != nil {
+		t.Fatalf("StreamMessages: %v", err)
+	}
+
+	carol := signalr.NewConnection("carol")
+	hub.AddConnection(carol)
+	hub.AddToGroup(carol.ID, "room1")
+
+	// Each waits for a message text, skipping joins and welcomes
+	wsReceived := func(text string) {
+		t.Helper()
+		wsConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			var msg chatws.Message
+			if err := wsConn.ReadJSON(&msg); err != nil {
+				t.Fatalf("WebSocket client waiting for %q: %v", text, err)
+			}
+			if msg.Message == text {
+				return
+			}
+		}
+	}
+	grpcReceived := func(text string) {
+		t.Helper()
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				t.Fatalf("gRPC client waiting for %q: %v", text, err)
+			}
+			if msg.Message == text {
+				return
+			}
+		}
+	}
+	signalrReceived := func(text string) {
+		t.Helper()
+		for {
+			select {
+			case data := <-carol.Send:
+				var inv struct {
+					Target    string           `json:"target"`
+					Arguments []broker.Message `json:"arguments"`
+				}
+				json.Unmarshal(bytes.TrimSuffix(data, []byte{signalr.RecordSeparator}), &inv)
+				if inv.Target == "ReceiveMessage" && len(inv.Arguments) == 1 && inv.Arguments[0].Message == text {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("SignalR client waiting for %q timed out", text)
+			}
+		}
+	}
+	// The WebSocket client is in the room once its join comes back
+	wsReceived("alice joined the chat")
+
+	wsConn.WriteJSON(chatws.Message{Message: "from websocket"})
+	grpcReceived("from websocket")
+	signalrReceived("from websocket")
+
+	if _, err := client.SendMessage(ctx, &pb.MessageRequest{User: "bob", Message: "from grpc", Room: "room1"}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	wsReceived("from grpc")
+	signalrReceived("from grpc")
+
+	err = hub.Publish(ctx, broker.Message{ID: "msg_signalr", User: "carol", Message: "from signalr", Room: "room1", Type: "message"})
+	if err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	wsReceived("from signalr")
+	grpcReceived("from signalr")
+
+	// All three share the history of the room
+	msgs, err := st.Range(store.Query{Room: "room1"})
+	if err != nil || len(msgs) != 3 {
+		t.Errorf("stored %d messages, %v, want 3", len(msgs), err)
+	}
+}
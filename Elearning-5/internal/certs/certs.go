@@ -0,0 +1,192 @@
+// Package certs serves TLS certificates that are reloaded when their files
+// change. Handshakes after a reload use the new files; established
+// connections keep the certificate they were opened with.
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultInterval is how often Watch checks the files for changes.
+const DefaultInterval = 10 * time.Second
+
+// Config names the files of a Reloader. ClientCAFile is optional; when set,
+// MutualConfig requires client certificates signed by one of its CAs.
+type Config struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+}
+
+// Reloader holds the current certificate and client CAs.
+type Reloader struct {
+	cfg Config
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	versions  map[string]fileVersion // path -> version loaded
+}
+
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+// Load reads the files of cfg.
+func Load(cfg Config) (*Reloader, error) {
+	if cfg.CertFile == "" || cfg.KeyFile == "" {
+		return nil, errors.New("a certificate and a key file are required")
+	}
+	r := &Reloader{cfg: cfg}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	return files
+}
+
+// reload reads every file again. Nothing changes when one of them is
+// invalid, such as a key that does not match the new certificate yet.
+func (r *Reloader) reload() error {
+	versions := make(map[string]fileVersion)
+	for _, path := range r.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		versions[path] = fileVersion{modTime: info.ModTime(), size: info.Size()}
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s: no PEM certificates", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert, r.clientCAs, r.versions = &cert, clientCAs, versions
+	return nil
+}
+
+// changed reports whether a file differs from the version loaded.
+func (r *Reloader) changed() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, path := range r.files() {
+		info, err := os.Stat(path)
+		if err != nil {
+			// Being replaced; look again on the next tick
+			continue
+		}
+		if (fileVersion{modTime: info.ModTime(), size: info.Size()}) != r.versions[path] {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch reloads the files every interval once they have changed, until ctx
+// is done. A failed reload keeps the previous certificate and is retried.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !r.changed() {
+			continue
+		}
+		if err := r.reload(); err != nil {
+			slog.Warn("TLS certificate reload failed, keeping the current one", "err", err)
+			continue
+		}
+		slog.Info("TLS certificate reloaded", "file", r.cfg.CertFile)
+	}
+}
+
+func (r *Reloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ServerConfig returns a TLS configuration serving the current certificate.
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+	}
+}
+
+// MutualConfig is ServerConfig that also requires a client certificate
+// signed by a current client CA, when ClientCAFile is set.
+func (r *Reloader) MutualConfig() *tls.Config {
+	cfg := r.ServerConfig()
+	if r.cfg.ClientCAFile == "" {
+		return cfg
+	}
+	// The CAs may be reloaded, so the chain is verified here rather than
+	// against a fixed ClientCAs pool
+	cfg.ClientAuth = tls.RequireAnyClientCert
+	cfg.VerifyPeerCertificate = r.verifyClient
+	return cfg
+}
+
+func (r *Reloader) verifyClient(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	r.mu.RLock()
+	roots := r.clientCAs
+	r.mu.RUnlock()
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return err
+}
@@ -0,0 +1,178 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issue creates a certificate for name signed by parent, or a self-signed CA
+// when parent is nil.
+func issue(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		tmpl.ExtKeyUsage = nil
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func write(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// handshake connects a client to a TLS server using cfg and returns the
+// serial number of the server certificate.
+func handshake(t *testing.T, cfg *tls.Config, client *tls.Config) (*big.Int, error) {
+	t.Helper()
+	lis, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	go func() {
+		conn, err := lis.Accept()
+		if err != nil {
+			return
+		}
+		conn.(*tls.Conn).Handshake()
+		// Read so that the server's verdict on the client certificate
+		// reaches the client
+		conn.Read(make([]byte, 1))
+		conn.Close()
+	}()
+
+	conn, err := tls.Dial("tcp", lis.Addr().String(), client)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// With TLS 1.3 a rejected client certificate shows on the first read
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	conn.Write([]byte{0})
+	if _, err := conn.Read(make([]byte, 1)); err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber, nil
+}
+
+func TestReloadOnChange(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caPEM, _ := issue(t, "ca", nil, nil, 0)
+	first, _, certPEM, keyPEM := issue(t, "server", ca, caKey, x509.ExtKeyUsageServerAuth)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	write(t, certFile, certPEM)
+	write(t, keyFile, keyPEM)
+
+	r, err := Load(Config{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	client := &tls.Config{RootCAs: roots}
+
+	if serial, err := handshake(t, r.ServerConfig(), client); err != nil || serial.Cmp(first.SerialNumber) != 0 {
+		t.Fatalf("handshake = %v, %v, want the first certificate", serial, err)
+	}
+	if r.changed() {
+		t.Fatal("files reported changed before being written")
+	}
+
+	// A certificate without its key yet is not loaded
+	second, _, certPEM, keyPEM := issue(t, "server", ca, caKey, x509.ExtKeyUsageServerAuth)
+	write(t, certFile, certPEM)
+	if !r.changed() {
+		t.Fatal("new certificate not detected")
+	}
+	if err := r.reload(); err == nil {
+		t.Fatal("reload of a mismatched key pair succeeded")
+	}
+	write(t, keyFile, keyPEM)
+	if err := r.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if serial, err := handshake(t, r.ServerConfig(), client); err != nil || serial.Cmp(second.SerialNumber) != 0 {
+		t.Fatalf("handshake = %v, %v, want the reloaded certificate", serial, err)
+	}
+}
+
+func TestMutualConfigRequiresClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caPEM, _ := issue(t, "ca", nil, nil, 0)
+	_, _, certPEM, keyPEM := issue(t, "server", ca, caKey, x509.ExtKeyUsageServerAuth)
+	_, _, clientPEM, clientKeyPEM := issue(t, "client", ca, caKey, x509.ExtKeyUsageClientAuth)
+	otherCA, otherKey, _, _ := issue(t, "other", nil, nil, 0)
+	_, _, strangerPEM, strangerKeyPEM := issue(t, "stranger", otherCA, otherKey, x509.ExtKeyUsageClientAuth)
+
+	files := map[string][]byte{"cert.pem": certPEM, "key.pem": keyPEM, "ca.pem": caPEM}
+	for name, data := range files {
+		write(t, filepath.Join(dir, name), data)
+	}
+	r, err := Load(Config{
+		CertFile:     filepath.Join(dir, "cert.pem"),
+		KeyFile:      filepath.Join(dir, "key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(caPEM)
+	clientCert, _ := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	strangerCert, _ := tls.X509KeyPair(strangerPEM, strangerKeyPEM)
+
+	if _, err := handshake(t, r.MutualConfig(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}); err != nil {
+		t.Errorf("client with a certificate of the CA: %v", err)
+	}
+	if _, err := handshake(t, r.MutualConfig(), &tls.Config{RootCAs: roots}); err == nil {
+		t.Error("client without a certificate was accepted")
+	}
+	if _, err := handshake(t, r.MutualConfig(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{strangerCert}}); err == nil {
+		t.Error("client with a certificate of another CA was accepted")
+	}
+	// ServerConfig does not ask for client certificates
+	if _, err := handshake(t, r.ServerConfig(), &tls.Config{RootCAs: roots}); err != nil {
+		t.Errorf("ServerConfig without a client certificate: %v", err)
+	}
+}
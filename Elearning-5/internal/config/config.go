@@ -3,23 +3,143 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
-	GRPCPort       string
-	WebSocketPort  string
-	SignalRPort    string
-	MaxConnections int
-	EnableTLS      bool
+	GRPCPort      string
+	WebSocketPort string
+	SignalRPort   string
+	// MetricsPort serves /metrics for grpc-server, which has no HTTP port
+	// of its own. The other servers serve /metrics on their port
+	MetricsPort string
+
+	// EnableTLS serves every protocol over TLS with TLSCertFile and
+	// TLSKeyFile, reloaded when they change. gRPC also requires client
+	// certificates signed by TLSClientCAFile when it is set
+	EnableTLS       bool
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+
+	// AllowedOrigins are the browser origins allowed by CORS and WebSocket
+	// upgrades, such as https://app.example.com or https://*.example.com.
+	// OriginDevMode allows every origin instead
+	AllowedOrigins []string
+	OriginDevMode  bool
+
+	// MaxConnections caps the open connections of the process, and
+	// MaxConnectionsPerIP those of one remote address; zero does not cap
+	MaxConnections      int
+	MaxConnectionsPerIP int
+
+	// LogFormat is text or json and LogLevel debug, info, warn or error.
+	// Chat messages are logged at the debug level with their bodies
+	// redacted unless LogMessageBodies is set
+	LogFormat        string
+	LogLevel         string
+	LogMessageBodies bool
+
+	// TracingExporter is none, stdout or otlp. The OTLP exporter is
+	// configured by the standard OTEL_EXPORTER_OTLP_* variables
+	TracingExporter string
+
+	// PresenceTimeout is how long a connection counts for its user's
+	// presence without a heartbeat. TypingTimeout ends a typing indicator
+	// the client stopped repeating
+	PresenceTimeout time.Duration
+	TypingTimeout   time.Duration
+
+	// ShutdownTimeout bounds how long servers drain connections on SIGTERM
+	ShutdownTimeout time.Duration
+
+	// GRPCSendQueueSize is the number of messages buffered per gRPC stream
+	GRPCSendQueueSize int
+	// GRPCOverflowPolicy is drop-oldest, drop-newest or disconnect
+	GRPCOverflowPolicy string
+
+	// HistoryStore is memory or disk
+	HistoryStore string
+	HistoryDir   string
+	// HistorySize is the number of messages per room the memory store keeps
+	HistorySize int
+
+	// JWT keys; authentication is disabled when none is set
+	JWTSecret        string // HS256 key
+	JWTPublicKeyFile string // PEM RSA public key for RS256
+	JWTJWKSFile      string // JSON Web Key Set of RS256 keys
+	JWTIssuer        string
+	JWTAudience      string
+
+	// RoomsFile configures private and read-only rooms and member roles;
+	// every room is public when empty
+	RoomsFile string
+
+	// Token buckets for posted messages, in messages per second; zero
+	// disables a limit
+	RateLimitConnection      float64
+	RateLimitConnectionBurst int
+	RateLimitUser            float64
+	RateLimitUserBurst       int
+	RateLimitRoom            float64
+	RateLimitRoomBurst       int
+	// RateLimitStrikes is the number of rejected messages within a minute
+	// after which a client is disconnected; zero never disconnects
+	RateLimitStrikes int
 }
 
 func Load() *Config {
 	return &Config{
-		GRPCPort:       getEnv("GRPC_PORT", "50051"),
-		WebSocketPort:  getEnv("WS_PORT", "8080"),
-		SignalRPort:    getEnv("SIGNALR_PORT", "8081"),
-		MaxConnections: getEnvAsInt("MAX_CONNECTIONS", 10000),
-		EnableTLS:      getEnvAsBool("ENABLE_TLS", false),
+		GRPCPort:      getEnv("GRPC_PORT", "50051"),
+		WebSocketPort: getEnv("WS_PORT", "8080"),
+		SignalRPort:   getEnv("SIGNALR_PORT", "8081"),
+		MetricsPort:   getEnv("METRICS_PORT", "9090"),
+
+		EnableTLS:       getEnvAsBool("ENABLE_TLS", false),
+		TLSCertFile:     getEnv("TLS_CERT_FILE", ""),
+		TLSKeyFile:      getEnv("TLS_KEY_FILE", ""),
+		TLSClientCAFile: getEnv("TLS_CLIENT_CA_FILE", ""),
+
+		AllowedOrigins: getEnvAsList("ALLOWED_ORIGINS", []string{"http://localhost", "https://localhost", "http://localhost:3000"}),
+		OriginDevMode:  getEnvAsBool("ORIGIN_DEV_MODE", false),
+
+		MaxConnections:      getEnvAsInt("MAX_CONNECTIONS", 10000),
+		MaxConnectionsPerIP: getEnvAsInt("MAX_CONNECTIONS_PER_IP", 100),
+
+		LogFormat:        getEnv("LOG_FORMAT", "text"),
+		LogLevel:         getEnv("LOG_LEVEL", "info"),
+		LogMessageBodies: getEnvAsBool("LOG_MESSAGE_BODIES", false),
+
+		TracingExporter: getEnv("TRACING_EXPORTER", "none"),
+
+		PresenceTimeout: time.Duration(getEnvAsInt("PRESENCE_TIMEOUT", 60)) * time.Second,
+		TypingTimeout:   time.Duration(getEnvAsInt("TYPING_TIMEOUT", 5)) * time.Second,
+
+		ShutdownTimeout: time.Duration(getEnvAsInt("SHUTDOWN_TIMEOUT", 15)) * time.Second,
+
+		GRPCSendQueueSize:  getEnvAsInt("GRPC_SEND_QUEUE_SIZE", 256),
+		GRPCOverflowPolicy: getEnv("GRPC_OVERFLOW_POLICY", "disconnect"),
+
+		HistoryStore: getEnv("HISTORY_STORE", "memory"),
+		HistoryDir:   getEnv("HISTORY_DIR", "data"),
+		HistorySize:  getEnvAsInt("HISTORY_SIZE", 1000),
+
+		JWTSecret:        getEnv("JWT_SECRET", ""),
+		JWTPublicKeyFile: getEnv("JWT_PUBLIC_KEY_FILE", ""),
+		JWTJWKSFile:      getEnv("JWT_JWKS_FILE", ""),
+		JWTIssuer:        getEnv("JWT_ISSUER", ""),
+		JWTAudience:      getEnv("JWT_AUDIENCE", ""),
+
+		RoomsFile: getEnv("ROOMS_FILE", ""),
+
+		RateLimitConnection:      getEnvAsFloat("RATE_LIMIT_CONNECTION", 5),
+		RateLimitConnectionBurst: getEnvAsInt("RATE_LIMIT_CONNECTION_BURST", 10),
+		RateLimitUser:            getEnvAsFloat("RATE_LIMIT_USER", 10),
+		RateLimitUserBurst:       getEnvAsInt("RATE_LIMIT_USER_BURST", 20),
+		RateLimitRoom:            getEnvAsFloat("RATE_LIMIT_ROOM", 50),
+		RateLimitRoomBurst:       getEnvAsInt("RATE_LIMIT_ROOM_BURST", 100),
+		RateLimitStrikes:         getEnvAsInt("RATE_LIMIT_STRIKES", 10),
 	}
 }
 
@@ -39,6 +159,30 @@ func getEnvAsInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+func getEnvAsFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatValue, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatValue
+		}
+	}
+	return defaultValue
+}
+
+// getEnvAsList splits a comma-separated value.
+func getEnvAsList(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
 func getEnvAsBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
 		if boolValue, err := strconv.ParseBool(value); err == nil {
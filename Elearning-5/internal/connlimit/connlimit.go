@@ -0,0 +1,128 @@
+// Package connlimit caps the number of open connections, in total and per
+// remote IP, so that a single misbehaving machine cannot take every slot.
+package connlimit
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limits configures a Limiter. Zero values do not limit.
+type Limits struct {
+	Max   int
+	PerIP int
+}
+
+// RetryAfter is how long rejected clients are asked to wait before trying
+// again.
+const RetryAfter = 10 * time.Second
+
+// Scope is the cap a connection exceeded.
+type Scope string
+
+const (
+	Total Scope = "total"
+	IP    Scope = "ip"
+)
+
+// Error is returned for a connection over a cap.
+type Error struct {
+	Scope Scope
+	Limit int
+}
+
+func (e *Error) Error() string {
+	if e.Scope == IP {
+		return fmt.Sprintf("too many connections from this address (limit %d)", e.Limit)
+	}
+	return fmt.Sprintf("too many connections (limit %d)", e.Limit)
+}
+
+// Limiter counts the open connections of one or more servers. A nil Limiter
+// admits everything.
+type Limiter struct {
+	limits Limits
+
+	mu       sync.Mutex
+	active   int
+	perIP    map[string]int
+	rejected int64
+}
+
+func New(limits Limits) *Limiter {
+	return &Limiter{limits: limits, perIP: make(map[string]int)}
+}
+
+// Acquire admits a connection from ip. The returned function releases it and
+// must be called once the connection is closed; calling it again does
+// nothing.
+func (l *Limiter) Acquire(ip string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.Max > 0 && l.active >= l.limits.Max {
+		l.rejected++
+		return nil, &Error{Scope: Total, Limit: l.limits.Max}
+	}
+	if l.limits.PerIP > 0 && l.perIP[ip] >= l.limits.PerIP {
+		l.rejected++
+		return nil, &Error{Scope: IP, Limit: l.limits.PerIP}
+	}
+	l.active++
+	l.perIP[ip]++
+
+	var once sync.Once
+	return func() { once.Do(func() { l.release(ip) }) }, nil
+}
+
+func (l *Limiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active--
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+}
+
+// Stats is a snapshot of a Limiter.
+type Stats struct {
+	Active   int   `json:"active"`
+	Max      int   `json:"max"`
+	PerIP    int   `json:"per_ip_max"`
+	Rejected int64 `json:"rejected"`
+}
+
+func (l *Limiter) Stats() Stats {
+	if l == nil {
+		return Stats{}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return Stats{Active: l.active, Max: l.limits.Max, PerIP: l.limits.PerIP, Rejected: l.rejected}
+}
+
+// Reject answers a request refused by Acquire with 503 Service Unavailable
+// and a Retry-After header.
+func Reject(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(RetryAfter/time.Second)))
+	http.Error(w, err.Error(), http.StatusServiceUnavailable)
+}
+
+// Host returns the IP of a host:port address, or addr itself when it has no
+// port.
+func Host(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
@@ -0,0 +1,71 @@
+package connlimit
+
+import (
+	"errors"
+	"testing"
+)
+
+func scope(err error) Scope {
+	var limited *Error
+	if errors.As(err, &limited) {
+		return limited.Scope
+	}
+	return ""
+}
+
+func TestCaps(t *testing.T) {
+	l := New(Limits{Max: 3, PerIP: 2})
+
+	releaseA1, err := l.Acquire("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire("10.0.0.1"); scope(err) != IP {
+		t.Fatalf("third connection from one address: %v, want the per-IP cap", err)
+	}
+	if _, err := l.Acquire("10.0.0.2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire("10.0.0.3"); scope(err) != Total {
+		t.Fatalf("connection over the total: %v, want the total cap", err)
+	}
+
+	// Releasing twice frees one slot only
+	releaseA1()
+	releaseA1()
+	if _, err := l.Acquire("10.0.0.3"); err != nil {
+		t.Fatalf("connection after a release: %v", err)
+	}
+	if _, err := l.Acquire("10.0.0.4"); scope(err) != Total {
+		t.Fatalf("connection over the total: %v, want the total cap", err)
+	}
+
+	want := Stats{Active: 3, Max: 3, PerIP: 2, Rejected: 3}
+	if got := l.Stats(); got != want {
+		t.Errorf("Stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestNilLimiterAdmitsEverything(t *testing.T) {
+	var l *Limiter
+	release, err := l.Acquire("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
+
+func TestHost(t *testing.T) {
+	for addr, want := range map[string]string{
+		"10.0.0.1:4242": "10.0.0.1",
+		"[::1]:4242":    "::1",
+		"bufconn":       "bufconn",
+	} {
+		if got := Host(addr); got != want {
+			t.Errorf("Host(%q) = %q, want %q", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,427 @@
+package grpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"elearning-5/internal/auth"
+	"elearning-5/internal/broker"
+	"elearning-5/internal/grpc/pb"
+	"elearning-5/internal/metrics"
+	"elearning-5/internal/policy"
+	"elearning-5/internal/presence"
+	"elearning-5/internal/ratelimit"
+	"elearning-5/internal/tracing"
+	"elearning-5/pkg/logger"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+var errSlowConsumer = errors.New("client is too slow")
+
+// refusedCodes are the ErrorEvent codes of the refusals a Chat session
+// survives. Policy denials carry the code of the policy instead.
+var refusedCodes = map[codes.Code]string{
+	codes.InvalidArgument:    "invalid_argument",
+	codes.FailedPrecondition: "failed_precondition",
+	codes.PermissionDenied:   "permission_denied",
+}
+
+// chatSession is the state of one Chat stream. Events for the client go
+// through queue; user, rooms and lastAck are only touched by the goroutine
+// running Chat.
+type chatSession struct {
+	id     string
+	queue  *sendQueue[*pb.ServerEvent]
+	cancel context.CancelCauseFunc
+
+	limit    *ratelimit.Conn
+	presence *presence.Conn
+	log      *slog.Logger
+	trace    context.Context // parent of the spans of the client's messages
+	user     string
+	rooms    map[string]bool
+	lastAck  string // ID of the last message the client acknowledged
+}
+
+// send queues an event for the client. Under the Disconnect policy a client
+// that lets its queue fill up is disconnected.
+func (c *chatSession) send(ev *pb.ServerEvent) {
+	if !c.queue.push(ev) {
+		c.cancel(errSlowConsumer)
+	}
+}
+
+func (c *chatSession) deliver(ctx context.Context, msg broker.Message) {
+	if msg.Type == presence.TypingType && msg.User == c.presence.User() {
+		return
+	}
+	_, span := tracing.Child(ctx, tracing.DeliverSpan, tracing.ProtocolKey.String(metrics.GRPC),
+		tracing.RecipientKey.String(c.id), tracing.QueueDepthKey.Int(len(c.queue.items)))
+	defer span.End()
+
+	c.send(toServerEvent(msg))
+}
+
+// Chat serves a bidirectional session. Client events are handled in order on
+// the RPC goroutine while a sender goroutine drains the session's queue. A
+// traceparent in the stream metadata is the parent of every message sent.
+func (s *Server) Chat(stream pb.ChatService_ChatServer) error {
+	ctx, cancel := context.WithCancelCause(stream.Context())
+	defer cancel(nil)
+
+	sess := &chatSession{
+		id:       generateSessionID(),
+		queue:    newSendQueue[*pb.ServerEvent](s.options.SendQueueSize, s.options.Overflow, &s.droppedMessages, s.options.Metrics),
+		cancel:   cancel,
+		limit:    s.options.Limiter.NewConn(),
+		presence: s.options.Presence.Connect(metrics.GRPC),
+		trace:    tracing.FromIncomingContext(stream.Context()),
+		rooms:    make(map[string]bool),
+	}
+	sess.log = logger.Conn(metrics.GRPC, sess.id, peerAddr(stream.Context()))
+	// The session is alive while its stream is open, even when the client
+	// has nothing to say
+	sess.presence.KeepAlive()
+	if user, ok := auth.UserFrom(stream.Context()); ok {
+		sess.user = user
+		sess.log = sess.log.With(logger.UserKey, user)
+		sess.presence.Identify(user)
+		s.identify(user, sess.id, sess)
+	}
+	atomic.AddInt32(&s.activeConns, 1)
+	s.options.Metrics.Connected(metrics.GRPC)
+	sess.log.Info("gRPC Chat session started", "streams", atomic.LoadInt32(&s.activeConns))
+
+	sent := make(chan error, 1)
+	go func() { sent <- sess.queue.run(counted(s.options.Metrics, stream.Send)) }()
+
+	events := make(chan *pb.ClientEvent)
+	received := make(chan error, 1)
+	go func() {
+		for {
+			ev, err := stream.Recv()
+			if err != nil {
+				received <- err
+				return
+			}
+			s.options.Metrics.Received(metrics.GRPC, proto.Size(ev))
+			select {
+			case events <- ev:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var err error
+	shuttingDown, senderDone := false, false
+loop:
+	for {
+		select {
+		case ev := <-events:
+			if err = s.handleChatEvent(sess, ev); err != nil {
+				break loop
+			}
+
+		case err = <-received:
+			if errors.Is(err, io.EOF) {
+				// The client is done sending; flush what is queued for it
+				err = nil
+			}
+			break loop
+
+		case err = <-sent:
+			senderDone = true
+			break loop
+
+		case <-ctx.Done():
+			if errors.Is(context.Cause(ctx), errSlowConsumer) {
+				err = s.slowConsumer(sess.log)
+				// The sender may be stuck in Send, which fails once the
+				// RPC ends
+				senderDone = true
+			} else {
+				err = status.FromContextError(ctx.Err()).Err()
+			}
+			break loop
+
+		case <-s.relayDone:
+			sess.send(&pb.ServerEvent{Event: &pb.ServerEvent_Message{Message: &pb.MessageResponse{
+				Id:        generateID(),
+				User:      "System",
+				Message:   "Server is shutting down",
+				Timestamp: time.Now().Format(time.RFC3339),
+			}}})
+			shuttingDown = true
+			break loop
+		}
+	}
+
+	for room := range sess.rooms {
+		s.leave(room, sess.id)
+		if !shuttingDown {
+			s.announce(sess, "leave", room)
+		}
+	}
+	s.forget(sess.user, sess.id)
+	sess.presence.Close()
+	sess.queue.close()
+	if !senderDone {
+		<-sent
+	}
+	atomic.AddInt32(&s.activeConns, -1)
+	s.options.Metrics.Disconnected(metrics.GRPC)
+
+	sess.log.Info("gRPC Chat session ended", "last_ack", sess.lastAck, "streams", atomic.LoadInt32(&s.activeConns))
+	return err
+}
+
+// handleChatEvent applies one client event. A refused event is answered with
+// an ErrorEvent; a returned error ends the session with that status. Every
+// event is a presence heartbeat.
+func (s *Server) handleChatEvent(sess *chatSession, ev *pb.ClientEvent) error {
+	sess.presence.Heartbeat()
+
+	switch e := ev.Event.(type) {
+	case *pb.ClientEvent_Join:
+		return s.chatRefused(sess, e.Join.GetRoom(), s.chatJoin(sess, e.Join))
+
+	case *pb.ClientEvent_Leave:
+		room := e.Leave.GetRoom()
+		if !sess.rooms[room] {
+			return nil
+		}
+		s.leave(room, sess.id)
+		delete(sess.rooms, room)
+		sess.presence.Leave(room)
+		return s.announce(sess, "leave", room)
+
+	case *pb.ClientEvent_Message:
+		ctx, span := tracing.Start(sess.trace, tracing.ReceiveSpan, tracing.ProtocolKey.String(metrics.GRPC),
+			tracing.UserKey.String(sess.user), tracing.RoomKey.String(e.Message.GetRoom()))
+		err := s.chatMessage(ctx, sess, e.Message)
+		tracing.End(span, err)
+		return s.chatRefused(sess, e.Message.GetRoom(), err)
+
+	case *pb.ClientEvent_Direct:
+		ctx, span := tracing.Start(sess.trace, tracing.ReceiveSpan, tracing.ProtocolKey.String(metrics.GRPC),
+			tracing.UserKey.String(sess.user))
+		err := s.chatDirect(ctx, sess, e.Direct)
+		tracing.End(span, err)
+		return s.chatRefused(sess, policy.DirectRoom(sess.user, e.Direct.GetTo()), err)
+
+	case *pb.ClientEvent_Typing:
+		room := e.Typing.GetRoom()
+		if !sess.rooms[room] {
+			return s.chatRefused(sess, room, status.Errorf(codes.FailedPrecondition, "join room %q before typing in it", room))
+		}
+		if ok, err := s.chatLimit(sess, room); !ok {
+			return err
+		}
+		sess.presence.Typing(room, e.Typing.GetTyping())
+		return nil
+
+	case *pb.ClientEvent_Presence:
+		if err := sess.presence.SetStatus(presence.Status(e.Presence.GetStatus())); err != nil {
+			return s.chatRefused(sess, "", status.Error(codes.InvalidArgument, err.Error()))
+		}
+		return nil
+
+	case *pb.ClientEvent_Ack:
+		sess.lastAck = e.Ack.GetMessageId()
+		return nil
+
+	default:
+		return status.Error(codes.InvalidArgument, "event is required")
+	}
+}
+
+// chatMessage publishes a message of the session user and acknowledges it.
+func (s *Server) chatMessage(ctx context.Context, sess *chatSession, req *pb.MessageRequest) error {
+	if sess.user == "" {
+		return status.Error(codes.FailedPrecondition, "join a room before sending messages")
+	}
+	if user := req.GetUser(); user != "" && user != sess.user {
+		return status.Errorf(codes.InvalidArgument, "user %q does not match session user %q", user, sess.user)
+	}
+	if !sess.rooms[req.GetRoom()] {
+		return status.Errorf(codes.FailedPrecondition, "join room %q before sending to it", req.GetRoom())
+	}
+	if ok, err := s.chatLimit(sess, req.GetRoom()); !ok {
+		return err
+	}
+	response, err := s.sendMessage(ctx, sess.user, req.GetMessage(), req.GetRoom())
+	if err != nil {
+		return err
+	}
+	sess.presence.Typing(req.GetRoom(), false)
+	sess.send(&pb.ServerEvent{Event: &pb.ServerEvent_Ack{Ack: &pb.AckEvent{MessageId: response.Id}}})
+	return nil
+}
+
+// chatDirect sends a direct message of the session user and acknowledges
+// it.
+func (s *Server) chatDirect(ctx context.Context, sess *chatSession, req *pb.DirectMessageRequest) error {
+	if sess.user == "" {
+		return status.Error(codes.FailedPrecondition, "join a room before sending messages")
+	}
+	if user := req.GetUser(); user != "" && user != sess.user {
+		return status.Errorf(codes.InvalidArgument, "user %q does not match session user %q", user, sess.user)
+	}
+	if ok, err := s.chatLimit(sess, policy.DirectRoom(sess.user, req.GetTo())); !ok {
+		return err
+	}
+	response, err := s.sendDirect(ctx, sess.user, req.GetTo(), req.GetMessage())
+	if err != nil {
+		return err
+	}
+	sess.send(&pb.ServerEvent{Event: &pb.ServerEvent_Ack{Ack: &pb.AckEvent{MessageId: response.Id}}})
+	return nil
+}
+
+// chatLimit takes a token for an event of the session in room and reports
+// whether to go on with it. A rejected event is answered with an ErrorEvent
+// and skipped; a session that keeps exceeding its limits is ended with
+// RESOURCE_EXHAUSTED.
+func (s *Server) chatLimit(sess *chatSession, room string) (bool, error) {
+	err := sess.limit.Allow(sess.user, room)
+	var limited *ratelimit.Error
+	if !errors.As(err, &limited) {
+		return err == nil, err
+	}
+	if sess.limit.Exceeded() {
+		sess.log.Warn("Rate limit exceeded, disconnecting", logger.RoomKey, room)
+		s.options.Metrics.Evicted(metrics.GRPC, metrics.RateLimited)
+		return false, rateLimited(err)
+	}
+
+	sess.send(&pb.ServerEvent{Event: &pb.ServerEvent_Error{Error: &pb.ErrorEvent{
+		Code:         ratelimit.Code,
+		Message:      limited.Error(),
+		Room:         room,
+		RetryAfterMs: limited.RetryAfter.Milliseconds(),
+	}}})
+	return false, nil
+}
+
+// chatRefused answers an event of the session in room that err refused
+// because of the client's request, such as a policy denial or a message to a
+// room not joined, with an ErrorEvent and lets the session go on. Other
+// errors, of the transport or the protocol, are returned to end the session.
+func (s *Server) chatRefused(sess *chatSession, room string, err error) error {
+	st, ok := status.FromError(err)
+	code, refused := refusedCodes[st.Code()]
+	if err == nil || !ok || !refused {
+		return err
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok {
+			code = info.Reason
+		}
+	}
+	sess.send(&pb.ServerEvent{Event: &pb.ServerEvent_Error{Error: &pb.ErrorEvent{
+		Code:    code,
+		Message: st.Message(),
+		Room:    room,
+	}}})
+	return nil
+}
+
+// chatJoin adds the session to a room. The first join sets the session user
+// of an unauthenticated stream.
+func (s *Server) chatJoin(sess *chatSession, join *pb.JoinEvent) error {
+	room, user := join.GetRoom(), join.GetUser()
+	if room == "" {
+		return status.Error(codes.InvalidArgument, "room is required")
+	}
+	switch {
+	case sess.user == "" && user == "":
+		return status.Error(codes.InvalidArgument, "user is required to join the first room")
+	case sess.user == "":
+		sess.user = user
+		sess.log = sess.log.With(logger.UserKey, user)
+		sess.presence.Identify(user)
+		s.identify(user, sess.id, sess)
+	case user != "" && user != sess.user:
+		return status.Errorf(codes.InvalidArgument, "user %q does not match session user %q", user, sess.user)
+	}
+
+	if sess.rooms[room] {
+		return nil
+	}
+	if room != AllRooms {
+		if err := s.authorize(sess.user, room, policy.Join); err != nil {
+			return err
+		}
+	}
+	s.join(room, sess.id, sess)
+	sess.rooms[room] = true
+	sess.log.Info("Joined room", logger.RoomKey, room)
+	if err := s.announce(sess, "join", room); err != nil {
+		return err
+	}
+	// The room hears of the user's presence after their join
+	if room != AllRooms {
+		sess.presence.Join(room)
+	}
+	return nil
+}
+
+// announce publishes a join or leave of the session user. Subscriptions to
+// every room are not announced.
+func (s *Server) announce(sess *chatSession, kind, room string) error {
+	if room == AllRooms {
+		return nil
+	}
+
+	text := " joined the chat"
+	if kind == "leave" {
+		text = " left the chat"
+	}
+	_, err := s.publish(context.Background(), broker.Message{
+		ID:        generateID(),
+		User:      sess.user,
+		Message:   sess.user + text,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Room:      room,
+		Type:      kind,
+	})
+	return err
+}
+
+func toServerEvent(msg broker.Message) *pb.ServerEvent {
+	switch msg.Type {
+	case "join":
+		return &pb.ServerEvent{Event: &pb.ServerEvent_Join{Join: &pb.JoinEvent{User: msg.User, Room: msg.Room}}}
+	case "leave":
+		return &pb.ServerEvent{Event: &pb.ServerEvent_Leave{Leave: &pb.LeaveEvent{User: msg.User, Room: msg.Room}}}
+	case presence.TypingType:
+		return &pb.ServerEvent{Event: &pb.ServerEvent_Typing{Typing: &pb.TypingEvent{
+			User:   msg.User,
+			Room:   msg.Room,
+			Typing: msg.Message == presence.TypingStarted,
+		}}}
+	case presence.PresenceType:
+		return &pb.ServerEvent{Event: &pb.ServerEvent_Presence{Presence: &pb.PresenceEvent{
+			User:   msg.User,
+			Room:   msg.Room,
+			Status: msg.Message,
+		}}}
+	default:
+		return &pb.ServerEvent{Event: &pb.ServerEvent_Message{Message: toMessageResponse(msg)}}
+	}
+}
+
+func generateSessionID() string {
+	return fmt.Sprintf("chat_%d_%d", time.Now().UnixNano(), rand.Int63())
+}
@@ -0,0 +1,5 @@
+package grpc
+
+// Regenerate pb/chat.pb.go and pb/chat_grpc.pb.go after editing pb/chat.proto.
+// Requires protoc, protoc-gen-go and protoc-gen-go-grpc on PATH.
+//go:generate protoc --go_out=. --go-grpc_out=. pb/chat.proto
@@ -0,0 +1,128 @@
+package grpc
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"elearning-5/internal/metrics"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultSendQueueSize is the number of items buffered per stream when
+// Options.SendQueueSize is not set.
+const DefaultSendQueueSize = 256
+
+// OverflowPolicy decides what happens to a stream whose send queue is full.
+type OverflowPolicy string
+
+const (
+	// DropOldest discards the oldest queued item to make room.
+	DropOldest OverflowPolicy = "drop-oldest"
+	// DropNewest discards the item that did not fit.
+	DropNewest OverflowPolicy = "drop-newest"
+	// Disconnect ends the stream with RESOURCE_EXHAUSTED.
+	Disconnect OverflowPolicy = "disconnect"
+)
+
+// ParseOverflowPolicy parses the name of an overflow policy.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch policy := OverflowPolicy(name); policy {
+	case DropOldest, DropNewest, Disconnect:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy %q (want %s, %s or %s)", name, DropOldest, DropNewest, Disconnect)
+	}
+}
+
+// sendQueue buffers the outgoing items of one stream so that delivering to a
+// slow client never blocks the relay or the other streams. A single goroutine
+// drains it with run, which also keeps stream.Send calls serialized.
+type sendQueue[T any] struct {
+	mu      sync.Mutex
+	items   chan T
+	closed  bool
+	policy  OverflowPolicy
+	dropped *int64 // shared counter of items discarded by the policy
+	metrics *metrics.Metrics
+}
+
+func newSendQueue[T any](size int, policy OverflowPolicy, dropped *int64, m *metrics.Metrics) *sendQueue[T] {
+	return &sendQueue[T]{items: make(chan T, size), policy: policy, dropped: dropped, metrics: m}
+}
+
+// push queues item without blocking, applying the overflow policy when the
+// queue is full. It returns false when the stream must be disconnected.
+// Items pushed after close are discarded.
+func (q *sendQueue[T]) push(item T) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return true
+	}
+	q.metrics.QueueDepth(metrics.GRPC, len(q.items))
+	select {
+	case q.items <- item:
+		return true
+	default:
+	}
+
+	switch q.policy {
+	case DropNewest:
+		atomic.AddInt64(q.dropped, 1)
+		q.metrics.Dropped(metrics.GRPC, metrics.QueueFull)
+		return true
+
+	case DropOldest:
+		// run may have drained an item since the queue was found full, in
+		// which case nothing is discarded
+		select {
+		case <-q.items:
+			atomic.AddInt64(q.dropped, 1)
+			q.metrics.Dropped(metrics.GRPC, metrics.QueueFull)
+		default:
+		}
+		// Only run receives concurrently and pushes hold mu, so there is room
+		q.items <- item
+		return true
+
+	default:
+		return false
+	}
+}
+
+// close stops accepting items. run returns once the queued ones are sent.
+func (q *sendQueue[T]) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.items)
+	}
+}
+
+// run sends queued items until the queue is closed and drained or send
+// fails.
+func (q *sendQueue[T]) run(send func(T) error) error {
+	for item := range q.items {
+		if err := send(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// counted wraps a stream's send so that every message it sends is counted
+// by m.
+func counted[T proto.Message](m *metrics.Metrics, send func(T) error) func(T) error {
+	return func(item T) error {
+		if err := send(item); err != nil {
+			return err
+		}
+		m.Sent(metrics.GRPC, proto.Size(item))
+		return nil
+	}
+}
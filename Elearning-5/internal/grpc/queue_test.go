@@ -0,0 +1,79 @@
+package grpc
+
+import "testing"
+
+func fill(q *sendQueue[int], items ...int) []bool {
+	results := make([]bool, len(items))
+	for i, item := range items {
+		results[i] = q.push(item)
+	}
+	return results
+}
+
+func drain(q *sendQueue[int]) []int {
+	q.close()
+	var items []int
+	q.run(func(item int) error {
+		items = append(items, item)
+		return nil
+	})
+	return items
+}
+
+func TestSendQueueOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy     OverflowPolicy
+		wantPushed []bool
+		wantItems  []int
+		wantDrops  int64
+	}{
+		{DropOldest, []bool{true, true, true}, []int{2, 3}, 1},
+		{DropNewest, []bool{true, true, true}, []int{1, 2}, 1},
+		{Disconnect, []bool{true, true, false}, []int{1, 2}, 0},
+	}
+
+	for _, tt := range tests {
+		var dropped int64
+		q := newSendQueue[int](2, tt.policy, &dropped, nil)
+
+		pushed := fill(q, 1, 2, 3)
+		items := drain(q)
+
+		for i := range pushed {
+			if pushed[i] != tt.wantPushed[i] {
+				t.Errorf("%s: push results = %v, want %v", tt.policy, pushed, tt.wantPushed)
+				break
+			}
+		}
+		if len(items) != len(tt.wantItems) || items[0] != tt.wantItems[0] || items[1] != tt.wantItems[1] {
+			t.Errorf("%s: sent %v, want %v", tt.policy, items, tt.wantItems)
+		}
+		if dropped != tt.wantDrops {
+			t.Errorf("%s: dropped = %d, want %d", tt.policy, dropped, tt.wantDrops)
+		}
+	}
+}
+
+func TestSendQueueDiscardsAfterClose(t *testing.T) {
+	var dropped int64
+	q := newSendQueue[int](1, Disconnect, &dropped, nil)
+	q.close()
+
+	if !q.push(1) {
+		t.Error("push after close asked for a disconnect")
+	}
+	if items := drain(q); len(items) != 0 {
+		t.Errorf("sent %v after close, want nothing", items)
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, name := range []string{"drop-oldest", "drop-newest", "disconnect"} {
+		if policy, err := ParseOverflowPolicy(name); err != nil || string(policy) != name {
+			t.Errorf("ParseOverflowPolicy(%q) = %q, %v", name, policy, err)
+		}
+	}
+	if _, err := ParseOverflowPolicy("block"); err == nil {
+		t.Error("ParseOverflowPolicy(\"block\") succeeded, want error")
+	}
+}
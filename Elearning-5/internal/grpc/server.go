@@ -2,34 +2,190 @@ package grpc
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"elearning-5/internal/auth"
+	"elearning-5/internal/broker"
+	"elearning-5/internal/certs"
+	"elearning-5/internal/connlimit"
 	"elearning-5/internal/grpc/pb"
+	"elearning-5/internal/metrics"
+	"elearning-5/internal/policy"
+	"elearning-5/internal/presence"
+	"elearning-5/internal/ratelimit"
+	"elearning-5/internal/store"
+	"elearning-5/internal/tracing"
+	"elearning-5/pkg/logger"
+	"elearning-5/pkg/middleware"
 
+	"go.opentelemetry.io/otel/attribute"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
+// AllRooms is the StreamRequest room value that subscribes a stream to the
+// traffic of every room.
+const AllRooms = "*"
+
+// member is a stream that receives the broker traffic of the rooms it is in.
+// ctx carries the trace of the message.
+type member interface {
+	deliver(ctx context.Context, msg broker.Message)
+}
+
+// subscriber is a StreamMessages stream.
+type subscriber struct {
+	id       string
+	user     string
+	room     string
+	queue    *sendQueue[*pb.MessageResponse]
+	cancel   context.CancelCauseFunc
+	log      *slog.Logger
+	presence *presence.Conn
+
+	holdMu  sync.Mutex
+	holding bool                  // history is being loaded
+	held    []*pb.MessageResponse // live messages received meanwhile
+}
+
+func (sub *subscriber) deliver(ctx context.Context, msg broker.Message) {
+	if presence.Ephemeral(msg.Type) {
+		// MessageResponse cannot tell presence from chat messages
+		return
+	}
+	_, span := tracing.Child(ctx, tracing.DeliverSpan, tracing.ProtocolKey.String(metrics.GRPC),
+		tracing.RecipientKey.String(sub.id), tracing.QueueDepthKey.Int(len(sub.queue.items)))
+	defer span.End()
+
+	sub.holdMu.Lock()
+	defer sub.holdMu.Unlock()
+
+	if sub.holding {
+		sub.held = append(sub.held, toMessageResponse(msg))
+		return
+	}
+	sub.send(toMessageResponse(msg))
+}
+
+// hold makes deliver buffer live messages until release.
+func (sub *subscriber) hold() {
+	sub.holdMu.Lock()
+	defer sub.holdMu.Unlock()
+	sub.holding = true
+}
+
+// release sends the history, then the live messages held since hold that
+// are not part of it.
+func (sub *subscriber) release(history []broker.Message) {
+	sub.holdMu.Lock()
+	defer sub.holdMu.Unlock()
+
+	sent := make(map[string]bool, len(history))
+	for _, msg := range history {
+		sub.send(toMessageResponse(msg))
+		sent[msg.ID] = true
+	}
+	for _, msg := range sub.held {
+		if !sent[msg.Id] {
+			sub.send(msg)
+		}
+	}
+	sub.holding, sub.held = false, nil
+}
+
+// send queues a message for the client. Under the Disconnect policy a
+// client that lets its queue fill up is disconnected.
+func (sub *subscriber) send(msg *pb.MessageResponse) {
+	if !sub.queue.push(msg) {
+		sub.cancel(errSlowConsumer)
+	}
+}
+
+// Options configures a Server. Zero values select the defaults.
+type Options struct {
+	// SendQueueSize is the number of messages buffered per stream,
+	// DefaultSendQueueSize if zero.
+	SendQueueSize int
+	// Overflow is applied to streams whose queue is full, Disconnect if
+	// empty.
+	Overflow OverflowPolicy
+	// Auth verifies the bearer token of every RPC. Clients name themselves
+	// when it is nil or has no keys.
+	Auth *auth.Verifier
+	// Policy decides who may join and post in each room; nil allows
+	// everything.
+	Policy *policy.Policy
+	// Limiter throttles the messages of every connection, user and room;
+	// nil does not limit.
+	Limiter *ratelimit.Limiter
+	// Connections caps the open streams in total and per remote IP; nil
+	// does not cap. The HTTP/2 connections and unary calls are not capped.
+	Connections *connlimit.Limiter
+	// TLS serves the current certificate and, when it has a client CA,
+	// requires client certificates signed by it; nil serves plaintext.
+	TLS *certs.Reloader
+	// Metrics records the server's activity; nil records nothing. The
+	// gRPC server does not serve it, its owner does over HTTP.
+	Metrics *metrics.Metrics
+	// Presence tracks the users of Chat sessions and StreamMessages streams
+	// and relays the typing indicators of Chat sessions; nil tracks nothing.
+	Presence *presence.Tracker
+}
+
 type Server struct {
 	pb.UnimplementedChatServiceServer
-	clients       map[string]pb.ChatService_StreamMessagesServer
+	rooms         map[string]map[string]member // room -> stream ID -> member
+	users         map[string]map[string]member // user -> stream ID -> member, for direct messages
 	clientMutex   sync.RWMutex
 	startTime     time.Time
 	totalMessages int64
 	activeConns   int32
+	broker        broker.Broker
+	store         store.MessageStore
+	options       Options
+
+	droppedMessages int64 // discarded by DropOldest or DropNewest
+	slowDisconnects int64 // streams ended by Disconnect
+
+	grpcServer *grpc.Server
+	serverMu   sync.Mutex
+	quit       chan struct{} // closed by Shutdown
+	relayDone  chan struct{} // closed when relay has delivered pending messages
+	stopOnce   sync.Once
 }
 
-func NewServer() *Server {
+func NewServer(b broker.Broker, st store.MessageStore, opts Options) *Server {
+	if opts.SendQueueSize <= 0 {
+		opts.SendQueueSize = DefaultSendQueueSize
+	}
+	if opts.Overflow == "" {
+		opts.Overflow = Disconnect
+	}
+
 	return &Server{
-		clients:   make(map[string]pb.ChatService_StreamMessagesServer),
+		rooms:     make(map[string]map[string]member),
+		users:     make(map[string]map[string]member),
 		startTime: time.Now(),
+		broker:    b,
+		store:     st,
+		options:   opts,
+		quit:      make(chan struct{}),
+		relayDone: make(chan struct{}),
 	}
 }
 
@@ -39,80 +195,564 @@ func (s *Server) Start(port string) error {
 		return err
 	}
 
-	grpcServer := grpc.NewServer(
+	slog.Info("gRPC server listening", "port", port)
+	return s.Serve(lis)
+}
+
+// Serve registers the chat service on a new gRPC server and serves it on
+// lis until Shutdown is called.
+func (s *Server) Serve(lis net.Listener) error {
+	authFailed := s.options.Metrics.AuthFailures(metrics.GRPC)
+	opts := []grpc.ServerOption{
 		grpc.MaxConcurrentStreams(1000),
-		grpc.MaxRecvMsgSize(1024*1024), // 1MB
-		grpc.MaxSendMsgSize(1024*1024), // 1MB
-	)
+		grpc.MaxRecvMsgSize(1024 * 1024), // 1MB
+		grpc.MaxSendMsgSize(1024 * 1024), // 1MB
+		// Ping idle clients so that the streams of dead ones end; open
+		// streams keep their users online
+		grpc.KeepaliveParams(keepalive.ServerParameters{Time: time.Minute, Timeout: 20 * time.Second}),
+		grpc.ChainUnaryInterceptor(middleware.AuthInterceptor(s.options.Auth, authFailed)),
+		grpc.ChainStreamInterceptor(middleware.StreamAuthInterceptor(s.options.Auth, authFailed), s.admit),
+	}
+	if s.options.TLS != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(s.options.TLS.MutualConfig())))
+	}
+	grpcServer := grpc.NewServer(opts...)
 	pb.RegisterChatServiceServer(grpcServer, s)
 
-	log.Printf("🚀 gRPC server listening on :%s", port)
+	s.serverMu.Lock()
+	s.grpcServer = grpcServer
+	s.serverMu.Unlock()
+
+	// Subscribe before serving so that no message sent over an RPC can be
+	// published before the relay listens
+	sub, err := s.broker.Subscribe()
+	if err != nil {
+		return err
+	}
+	go s.relay(sub)
+
 	return grpcServer.Serve(lis)
 }
 
-func (s *Server) SendMessage(ctx context.Context, req *pb.MessageRequest) (*pb.MessageResponse, error) {
-	if req.User == "" || req.Message == "" {
+// Shutdown stops accepting RPCs, delivers broker messages that are already
+// queued, sends every stream a final system message and waits for in-flight
+// RPCs to finish. When ctx expires the remaining RPCs are cancelled.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.quit) })
+
+	s.serverMu.Lock()
+	grpcServer := s.grpcServer
+	s.serverMu.Unlock()
+
+	if grpcServer == nil {
+		return nil
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		grpcServer.Stop()
+		return ctx.Err()
+	}
+}
+
+// SendMessage publishes a chat message. A traceparent in the request
+// metadata becomes the parent of the message's trace.
+func (s *Server) SendMessage(ctx context.Context, req *pb.MessageRequest) (response *pb.MessageResponse, err error) {
+	ctx, span := tracing.Start(tracing.FromIncomingContext(ctx), tracing.ReceiveSpan,
+		tracing.ProtocolKey.String(metrics.GRPC), tracing.RoomKey.String(req.Room))
+	defer func() { tracing.End(span, err) }()
+
+	user, err := identity(ctx, req.User)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(tracing.UserKey.String(user))
+	s.options.Metrics.Received(metrics.GRPC, proto.Size(req))
+	if err := rateLimited(s.options.Limiter.Peer(peerAddr(ctx)).Allow(user, req.Room)); err != nil {
+		return nil, err
+	}
+	return s.sendMessage(ctx, user, req.Message, req.Room)
+}
+
+// SendDirectMessage publishes a private message to a user. A traceparent in
+// the request metadata becomes the parent of the message's trace.
+func (s *Server) SendDirectMessage(ctx context.Context, req *pb.DirectMessageRequest) (response *pb.MessageResponse, err error) {
+	ctx, span := tracing.Start(tracing.FromIncomingContext(ctx), tracing.ReceiveSpan,
+		tracing.ProtocolKey.String(metrics.GRPC))
+	defer func() { tracing.End(span, err) }()
+
+	user, err := identity(ctx, req.User)
+	if err != nil {
+		return nil, err
+	}
+	span.SetAttributes(tracing.UserKey.String(user))
+	s.options.Metrics.Received(metrics.GRPC, proto.Size(req))
+	if err := rateLimited(s.options.Limiter.Peer(peerAddr(ctx)).Allow(user, policy.DirectRoom(user, req.To))); err != nil {
+		return nil, err
+	}
+	return s.sendDirect(ctx, user, req.To, req.Message)
+}
+
+// peerHost returns the host of the caller's address, which the connection
+// caps count streams by.
+func peerHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	return connlimit.Host(p.Addr.String())
+}
+
+// peerAddr returns the caller's address, host and port. It names the
+// caller in logs and keys the connection bucket of its unary calls, so that
+// clients behind one NAT or proxy do not share a bucket.
+func peerAddr(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	return p.Addr.String()
+}
+
+// admit counts every stream against the connection caps while it is open.
+// Streams over a cap are refused with UNAVAILABLE and a RetryInfo.
+func (s *Server) admit(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	release, err := s.options.Connections.Acquire(peerHost(ss.Context()))
+	if err != nil {
+		slog.Warn("gRPC stream refused", "method", info.FullMethod, logger.RemoteKey, peerAddr(ss.Context()), "err", err)
+		st := status.New(codes.Unavailable, err.Error())
+		if detailed, derr := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(connlimit.RetryAfter)}); derr == nil {
+			st = detailed
+		}
+		return st.Err()
+	}
+	defer release()
+	return handler(srv, ss)
+}
+
+// rateLimited turns a *ratelimit.Error into RESOURCE_EXHAUSTED with an
+// ErrorInfo and a RetryInfo. Other errors are returned as they are.
+func rateLimited(err error) error {
+	var limited *ratelimit.Error
+	if !errors.As(err, &limited) {
+		return err
+	}
+
+	st := status.New(codes.ResourceExhausted, limited.Error())
+	detailed, derr := st.WithDetails(
+		&errdetails.ErrorInfo{
+			Reason:   ratelimit.Code,
+			Domain:   "chat",
+			Metadata: map[string]string{"scope": string(limited.Scope)},
+		},
+		&errdetails.RetryInfo{RetryDelay: durationpb.New(limited.RetryAfter)},
+	)
+	if derr == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// authorize checks that user may perform action in room. A denial becomes
+// PERMISSION_DENIED with an ErrorInfo whose reason is the policy code.
+func (s *Server) authorize(user, room string, action policy.Action) error {
+	err := s.options.Policy.Authorize(user, room, action)
+	var denied *policy.Error
+	if !errors.As(err, &denied) {
+		return err
+	}
+
+	st := status.New(codes.PermissionDenied, denied.Error())
+	detailed, derr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: string(denied.Code),
+		Domain: "chat",
+		Metadata: map[string]string{
+			"room":   denied.Room,
+			"action": string(denied.Action),
+		},
+	})
+	if derr == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+// identity returns the user an RPC acts as: the subject of its token when
+// authentication is enabled, otherwise the user the client claims. A claim
+// that contradicts the token is rejected.
+func identity(ctx context.Context, claimed string) (string, error) {
+	user, ok := auth.UserFrom(ctx)
+	if !ok {
+		return claimed, nil
+	}
+	if claimed != "" && claimed != user {
+		return "", status.Errorf(codes.PermissionDenied, "user %q does not match the authenticated user %q", claimed, user)
+	}
+	return user, nil
+}
+
+// sendMessage publishes a chat message. Streams receive it back through the
+// broker subscription in relay. ctx carries the span of its receipt.
+func (s *Server) sendMessage(ctx context.Context, user, message, room string) (*pb.MessageResponse, error) {
+	if user == "" || message == "" {
 		return nil, status.Error(codes.InvalidArgument, "user and message are required")
 	}
+	if room == AllRooms {
+		return nil, status.Errorf(codes.InvalidArgument, "room %q is reserved for subscriptions", AllRooms)
+	}
+	_, span := tracing.Child(ctx, tracing.AuthorizeSpan, tracing.UserKey.String(user), tracing.RoomKey.String(room))
+	err := s.authorize(user, room, policy.Send)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
 
+	response := &pb.MessageResponse{
+		Id:        generateID(),
+		User:      user,
+		Message:   message,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Room:      room,
+	}
+
+	seq, err := s.publish(ctx, broker.Message{
+		ID:        response.Id,
+		User:      response.User,
+		Message:   response.Message,
+		Timestamp: response.Timestamp,
+		Room:      response.Room,
+		Type:      "message",
+	})
+	if err != nil {
+		return nil, err
+	}
+	response.Seq = seq
 	atomic.AddInt64(&s.totalMessages, 1)
 
+	slog.Debug("Message published",
+		logger.ProtocolKey, metrics.GRPC, logger.UserKey, user, logger.RoomKey, room,
+		"id", response.Id, logger.Body(message))
+	return response, nil
+}
+
+// sendDirect publishes a direct message from user to the user to, kept in
+// their conversation room. The streams of both receive it back through the
+// broker subscription in relay. ctx carries the span of its receipt.
+func (s *Server) sendDirect(ctx context.Context, user, to, message string) (*pb.MessageResponse, error) {
+	if user == "" || message == "" {
+		return nil, status.Error(codes.InvalidArgument, "user and message are required")
+	}
+	if to == "" || to == user {
+		return nil, status.Error(codes.InvalidArgument, "a direct message needs a recipient other than the sender")
+	}
+
 	response := &pb.MessageResponse{
 		Id:        generateID(),
-		User:      req.User,
-		Message:   req.Message,
+		User:      user,
+		Message:   message,
 		Timestamp: time.Now().Format(time.RFC3339),
-		Room:      req.Room,
+		Room:      policy.DirectRoom(user, to),
+		To:        to,
 	}
 
-	// Broadcast to relevant clients
-	s.clientMutex.RLock()
-	defer s.clientMutex.RUnlock()
+	seq, err := s.publish(ctx, broker.Message{
+		ID:        response.Id,
+		User:      response.User,
+		Message:   response.Message,
+		Timestamp: response.Timestamp,
+		Room:      response.Room,
+		Type:      "direct",
+		To:        response.To,
+	})
+	if err != nil {
+		return nil, err
+	}
+	response.Seq = seq
+	atomic.AddInt64(&s.totalMessages, 1)
+
+	slog.Debug("Direct message published",
+		logger.ProtocolKey, metrics.GRPC, logger.UserKey, user, "to", to,
+		"id", response.Id, logger.Body(message))
+	return response, nil
+}
+
+// publish stores a message sent over gRPC and hands it to the broker, which
+// delivers it to every protocol including this server. It returns the
+// sequence number of stored messages. ctx carries the span of its receipt.
+func (s *Server) publish(ctx context.Context, msg broker.Message) (uint64, error) {
+	select {
+	case <-s.quit:
+		return 0, status.Error(codes.Unavailable, "server is shutting down")
+	default:
+	}
 
-	for clientID, stream := range s.clients {
-		// Send to clients in the same room or all rooms
-		if shouldSendToClient(clientID, req.Room) {
-			if err := stream.Send(response); err != nil {
-				log.Printf("Failed to send to client %s: %v", clientID, err)
-				// Don't remove here, let stream context handle disconnection
+	msg.Source = "grpc"
+	attrs := []attribute.KeyValue{tracing.RoomKey.String(msg.Room), tracing.MessageKey.String(msg.ID)}
+	if store.Persisted(msg) {
+		_, span := tracing.Child(ctx, tracing.PersistSpan, attrs...)
+		seq, err := s.store.Append(msg)
+		tracing.End(span, err)
+		if err != nil {
+			return 0, status.Errorf(codes.Internal, "store message: %v", err)
+		}
+		msg.Seq = seq
+	}
+
+	ctx, span := tracing.Child(ctx, tracing.PublishSpan, attrs...)
+	msg.TraceParent = tracing.Inject(ctx)
+	err := s.broker.Publish(msg)
+	tracing.End(span, err)
+	if err != nil {
+		return 0, status.Errorf(codes.Unavailable, "publish message: %v", err)
+	}
+	return msg.Seq, nil
+}
+
+// relay delivers broker messages from every protocol to the streams of the
+// message's room, or of the users of a direct message, until Shutdown is
+// called.
+func (s *Server) relay(sub broker.Subscription) {
+	defer close(s.relayDone)
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case msg, ok := <-sub.Messages():
+			if !ok {
+				return
+			}
+			s.deliver(msg)
+
+		case <-s.quit:
+			// Deliver what is already queued before streams are closed
+			for {
+				select {
+				case msg, ok := <-sub.Messages():
+					if !ok {
+						return
+					}
+					s.deliver(msg)
+				default:
+					return
+				}
 			}
 		}
 	}
+}
 
-	log.Printf("📨 gRPC Message from %s: %s", req.User, req.Message)
-	return response, nil
+func (s *Server) deliver(msg broker.Message) {
+	defer s.options.Metrics.Fanout(metrics.GRPC, time.Now())
+
+	ctx := tracing.Extract(context.Background(), msg.TraceParent)
+	if msg.Type == "direct" {
+		for _, m := range s.recipients(msg.User, msg.To) {
+			m.deliver(ctx, msg)
+		}
+		return
+	}
+	for _, m := range s.members(msg.Room) {
+		m.deliver(ctx, msg)
+	}
+}
+
+func toMessageResponse(msg broker.Message) *pb.MessageResponse {
+	return &pb.MessageResponse{
+		Id:        msg.ID,
+		User:      msg.User,
+		Message:   msg.Message,
+		Timestamp: msg.Timestamp,
+		Room:      msg.Room,
+		Seq:       msg.Seq,
+		To:        msg.To,
+	}
 }
 
+// StreamMessages streams the messages of a room. Messages are queued per
+// stream and sent by a dedicated goroutine, so a slow client only affects
+// itself.
 func (s *Server) StreamMessages(req *pb.StreamRequest, stream pb.ChatService_StreamMessagesServer) error {
-	clientID := generateClientID(req.User, req.Room)
+	if req.LastSeq > 0 && req.Room == AllRooms {
+		return status.Error(codes.InvalidArgument, "last_seq needs a single room")
+	}
+	user, err := identity(stream.Context(), req.User)
+	if err != nil {
+		return err
+	}
+	if req.Room != AllRooms {
+		if err := s.authorize(user, req.Room, policy.Join); err != nil {
+			return err
+		}
+	}
 
-	s.clientMutex.Lock()
-	s.clients[clientID] = stream
-	atomic.AddInt32(&s.activeConns, 1)
-	s.clientMutex.Unlock()
+	ctx, cancel := context.WithCancelCause(stream.Context())
+	defer cancel(nil)
+
+	sub := &subscriber{
+		id:     generateClientID(user, req.Room),
+		user:   user,
+		room:   req.Room,
+		queue:  newSendQueue[*pb.MessageResponse](s.options.SendQueueSize, s.options.Overflow, &s.droppedMessages, s.options.Metrics),
+		cancel: cancel,
+	}
+	sub.log = logger.Conn(metrics.GRPC, sub.id, peerAddr(stream.Context())).With(logger.UserKey, user, logger.RoomKey, req.Room)
+	sub.presence = s.options.Presence.Connect(metrics.GRPC)
+	sub.presence.KeepAlive()
+	sub.presence.Identify(user)
 
-	log.Printf("🔗 gRPC Client connected: %s (Total: %d)", clientID, atomic.LoadInt32(&s.activeConns))
+	sent := make(chan error, 1)
+	go func() { sent <- sub.queue.run(counted(s.options.Metrics, stream.Send)) }()
 
 	// Send welcome message
-	welcomeMsg := &pb.MessageResponse{
+	sub.send(&pb.MessageResponse{
 		Id:        generateID(),
 		User:      "System",
 		Message:   "Welcome to gRPC Chat!",
 		Timestamp: time.Now().Format(time.RFC3339),
 		Room:      req.Room,
+	})
+
+	// Join before loading the history so that nothing published meanwhile
+	// is missed; release drops what is both live and history
+	if req.Room != AllRooms {
+		sub.hold()
+	}
+	s.join(sub.room, sub.id, sub)
+	s.identify(user, sub.id, sub)
+	if req.Room != AllRooms {
+		sub.presence.Join(req.Room)
+	}
+	atomic.AddInt32(&s.activeConns, 1)
+	s.options.Metrics.Connected(metrics.GRPC)
+
+	if req.Room != AllRooms {
+		var history []broker.Message
+		history, err = s.history(req)
+		sub.release(history)
 	}
-	stream.Send(welcomeMsg)
 
-	// Keep connection alive until client disconnects
-	<-stream.Context().Done()
+	sub.log.Info("gRPC client connected", "streams", atomic.LoadInt32(&s.activeConns))
 
-	s.clientMutex.Lock()
-	delete(s.clients, clientID)
+	// Keep connection alive until client disconnects or the server stops,
+	// unless it cannot resume, in which case it ends once the welcome is sent
+	senderDone := false
+	if err == nil {
+		select {
+		case err = <-sent:
+			senderDone = true
+		case <-ctx.Done():
+			if errors.Is(context.Cause(ctx), errSlowConsumer) {
+				err = s.slowConsumer(sub.log)
+				// The sender may be stuck in Send, which fails once the RPC ends
+				senderDone = true
+			}
+		case <-s.relayDone:
+			sub.send(&pb.MessageResponse{
+				Id:        generateID(),
+				User:      "System",
+				Message:   "Server is shutting down",
+				Timestamp: time.Now().Format(time.RFC3339),
+				Room:      req.Room,
+			})
+		}
+	}
+
+	s.leave(sub.room, sub.id)
+	s.forget(user, sub.id)
+	sub.presence.Close()
+	sub.queue.close()
+	if !senderDone {
+		<-sent
+	}
 	atomic.AddInt32(&s.activeConns, -1)
-	s.clientMutex.Unlock()
+	s.options.Metrics.Disconnected(metrics.GRPC)
+
+	sub.log.Info("gRPC client disconnected", "streams", atomic.LoadInt32(&s.activeConns))
+	return err
+}
+
+// history loads what a stream of a single room receives before live
+// messages. Only a resume that cannot be served fails the stream, with
+// OUT_OF_RANGE; otherwise a history that cannot be loaded is skipped.
+func (s *Server) history(req *pb.StreamRequest) ([]broker.Message, error) {
+	var msgs []broker.Message
+	var err error
+	if req.LastSeq > 0 {
+		msgs, err = store.Resume(s.store, req.Room, req.LastSeq)
+	} else {
+		msgs, err = store.Replay(s.store, req.Room, req.SinceId, int(req.HistoryLimit))
+	}
+	if errors.Is(err, store.ErrGapTooLarge) {
+		return nil, status.Error(codes.OutOfRange, err.Error())
+	}
+	if err != nil {
+		slog.Error("Loading history failed", logger.RoomKey, req.Room, "err", err)
+	}
+	return msgs, nil
+}
 
-	log.Printf("🔌 gRPC Client disconnected: %s (Total: %d)", clientID, atomic.LoadInt32(&s.activeConns))
-	return nil
+// slowConsumer records that a stream was disconnected by the Disconnect
+// overflow policy and returns the status ending it.
+func (s *Server) slowConsumer(log *slog.Logger) error {
+	atomic.AddInt64(&s.slowDisconnects, 1)
+	s.options.Metrics.Evicted(metrics.GRPC, metrics.SlowConsumer)
+	log.Warn("gRPC stream is too slow, disconnecting")
+	return status.Error(codes.ResourceExhausted, "client is too slow, disconnecting")
+}
+
+// GetHistory returns a page of a room's history. Pass next_before as before
+// to get the previous page.
+func (s *Server) GetHistory(ctx context.Context, req *pb.HistoryRequest) (*pb.HistoryResponse, error) {
+	if req.Room == "" || req.Room == AllRooms {
+		return nil, status.Error(codes.InvalidArgument, "room is required")
+	}
+	user, _ := auth.UserFrom(ctx)
+	if err := s.authorize(user, req.Room, policy.Join); err != nil {
+		return nil, err
+	}
+
+	page, err := store.History(s.store, req.Room, req.Before, int(req.Limit))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "unknown cursor %q", req.Before)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "load history: %v", err)
+	}
+
+	response := &pb.HistoryResponse{NextBefore: page.NextBefore}
+	for _, msg := range page.Messages {
+		response.Messages = append(response.Messages, toMessageResponse(msg))
+	}
+	return response, nil
+}
+
+// ListMembers returns the users in a room on every protocol with their
+// presence.
+func (s *Server) ListMembers(ctx context.Context, req *pb.ListMembersRequest) (*pb.ListMembersResponse, error) {
+	if req.Room == "" || req.Room == AllRooms {
+		return nil, status.Error(codes.InvalidArgument, "room is required")
+	}
+	user, _ := auth.UserFrom(ctx)
+	if err := s.authorize(user, req.Room, policy.Join); err != nil {
+		return nil, err
+	}
+
+	response := &pb.ListMembersResponse{}
+	for _, m := range s.options.Presence.Members(req.Room) {
+		response.Members = append(response.Members, &pb.Member{
+			User:   m.User,
+			Status: string(m.Status),
+			Typing: m.Typing,
+		})
+	}
+	return response, nil
 }
 
 func (s *Server) GetStats(ctx context.Context, req *pb.StatsRequest) (*pb.StatsResponse, error) {
@@ -120,10 +760,111 @@ func (s *Server) GetStats(ctx context.Context, req *pb.StatsRequest) (*pb.StatsR
 		ActiveConnections: atomic.LoadInt32(&s.activeConns),
 		TotalMessages:     atomic.LoadInt64(&s.totalMessages),
 		Uptime:            int64(time.Since(s.startTime).Seconds()),
+		DroppedMessages:   atomic.LoadInt64(&s.droppedMessages),
+		SlowDisconnects:   atomic.LoadInt64(&s.slowDisconnects),
 	}
+	caps := s.options.Connections.Stats()
+	stats.OpenConnections = int32(caps.Active)
+	stats.MaxConnections = int32(caps.Max)
+	stats.MaxConnectionsPerIp = int32(caps.PerIP)
+	stats.RejectedConnections = caps.Rejected
 	return stats, nil
 }
 
+// join adds a stream to the members of room.
+func (s *Server) join(room, id string, m member) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+
+	if s.rooms[room] == nil {
+		s.rooms[room] = make(map[string]member)
+	}
+	if _, ok := s.rooms[room][id]; !ok {
+		s.options.Metrics.Joined(metrics.GRPC, room)
+	}
+	s.rooms[room][id] = m
+}
+
+func (s *Server) leave(room, id string) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+
+	if members, ok := s.rooms[room]; ok {
+		if _, ok := members[id]; ok {
+			s.options.Metrics.Left(metrics.GRPC, room)
+		}
+		delete(members, id)
+		if len(members) == 0 {
+			delete(s.rooms, room)
+		}
+	}
+}
+
+// identify adds a stream to the recipients of the direct messages of user.
+// Anonymous streams receive none.
+func (s *Server) identify(user, id string, m member) {
+	if user == "" {
+		return
+	}
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+
+	if s.users[user] == nil {
+		s.users[user] = make(map[string]member)
+	}
+	s.users[user][id] = m
+}
+
+func (s *Server) forget(user, id string) {
+	s.clientMutex.Lock()
+	defer s.clientMutex.Unlock()
+
+	if streams, ok := s.users[user]; ok {
+		delete(streams, id)
+		if len(streams) == 0 {
+			delete(s.users, user)
+		}
+	}
+}
+
+// recipients returns a snapshot of the streams of the given users, like
+// members.
+func (s *Server) recipients(users ...string) []member {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	var recipients []member
+	for _, user := range users {
+		for _, m := range s.users[user] {
+			recipients = append(recipients, m)
+		}
+	}
+	return recipients
+}
+
+// members returns a snapshot of the streams that should receive a message
+// sent to room, so that sending happens without holding clientMutex.
+func (s *Server) members(room string) []member {
+	s.clientMutex.RLock()
+	defer s.clientMutex.RUnlock()
+
+	members := make([]member, 0, len(s.rooms[room])+len(s.rooms[AllRooms]))
+	for _, m := range s.rooms[room] {
+		members = append(members, m)
+	}
+	if !s.options.Policy.Readable(room) {
+		// Subscriptions to every room only see rooms open to everyone
+		return members
+	}
+	for id, m := range s.rooms[AllRooms] {
+		// A Chat session may be in both
+		if _, dup := s.rooms[room][id]; !dup {
+			members = append(members, m)
+		}
+	}
+	return members
+}
+
 func generateID() string {
 	return fmt.Sprintf("msg_%d_%d", time.Now().UnixNano(), rand.Int63())
 }
@@ -131,9 +872,3 @@ func generateID() string {
 func generateClientID(user, room string) string {
 	return fmt.Sprintf("%s_%s_%d", user, room, time.Now().UnixNano())
 }
-
-func shouldSendToClient(clientID, room string) bool {
-	// Simple logic: send to all clients for now
-	// In production, implement room-based filtering
-	return true
-}
@@ -0,0 +1,962 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"elearning-5/internal/auth"
+	"elearning-5/internal/broker"
+	"elearning-5/internal/connlimit"
+	"elearning-5/internal/grpc/pb"
+	"elearning-5/internal/metrics"
+	"elearning-5/internal/policy"
+	"elearning-5/internal/presence"
+	"elearning-5/internal/ratelimit"
+	"elearning-5/internal/store"
+	"elearning-5/internal/tracing"
+
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newTestClient serves a Server on an in-memory listener and returns a
+// client connected to it.
+func newTestClient(t *testing.T) (*Server, pb.ChatServiceClient) {
+	t.Helper()
+	return newTestClientWithOptions(t, Options{})
+}
+
+func newTestClientWithOptions(t *testing.T, opts Options) (*Server, pb.ChatServiceClient) {
+	t.Helper()
+	return newTestClientOn(t, broker.NewMemoryBroker(), opts)
+}
+
+// newTestClientOn serves a Server on b, which it closes when the test ends.
+func newTestClientOn(t *testing.T, b broker.Broker, opts Options) (*Server, pb.ChatServiceClient) {
+	t.Helper()
+
+	if opts.Presence == nil {
+		opts.Presence = presence.New(b, presence.Options{})
+	}
+	s := NewServer(b, store.NewMemoryStore(0), opts)
+	lis := bufconn.Listen(1024 * 1024)
+	go s.Serve(lis)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial bufconn: %v", err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+		b.Close()
+	})
+	return s, pb.NewChatServiceClient(conn)
+}
+
+// subscribe opens a StreamMessages stream and consumes the welcome message.
+func subscribe(t *testing.T, client pb.ChatServiceClient, room string) pb.ChatService_StreamMessagesClient {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	stream, err := client.StreamMessages(ctx, &pb.StreamRequest{User: "reader", Room: room})
+	if err != nil {
+		t.Fatalf("StreamMessages: %v", err)
+	}
+	welcome, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("receive welcome: %v", err)
+	}
+	if welcome.User != "System" {
+		t.Fatalf("first message = %v, want system welcome", welcome)
+	}
+	return stream
+}
+
+func recvWithTimeout(stream pb.ChatService_StreamMessagesClient, timeout time.Duration) (*pb.MessageResponse, error) {
+	type result struct {
+		msg *pb.MessageResponse
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		msg, err := stream.Recv()
+		ch <- result{msg, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.msg, r.err
+	case <-time.After(timeout):
+		return nil, context.DeadlineExceeded
+	}
+}
+
+func TestSendMessageReachesStreamsOfTheRoom(t *testing.T) {
+	_, client := newTestClient(t)
+	ctx := context.Background()
+
+	room1 := subscribe(t, client, "room1")
+	room2 := subscribe(t, client, "room2")
+	all := subscribe(t, client, AllRooms)
+
+	sent, err := client.SendMessage(ctx, &pb.MessageRequest{User: "alice", Message: "hello", Room: "room1"})
+	if err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+
+	for name, stream := range map[string]pb.ChatService_StreamMessagesClient{"room1": room1, "all rooms": all} {
+		got, err := recvWithTimeout(stream, 2*time.Second)
+		if err != nil {
+			t.Fatalf("%s subscriber: %v", name, err)
+		}
+		if got.Id != sent.Id || got.Message != "hello" || got.Room != "room1" {
+			t.Errorf("%s subscriber received %v, want %v", name, got, sent)
+		}
+	}
+
+	if got, err := recvWithTimeout(room2, 200*time.Millisecond); err == nil {
+		t.Errorf("room2 subscriber received %v from room1", got)
+	}
+}
+
+func TestSendMessageValidatesRequest(t *testing.T) {
+	_, client := newTestClient(t)
+	ctx := context.Background()
+
+	for _, req := range []*pb.MessageRequest{
+		{User: "", Message: "hello", Room: "room1"},
+		{User: "alice", Message: "", Room: "room1"},
+		{User: "alice", Message: "hello", Room: AllRooms},
+	} {
+		_, err := client.SendMessage(ctx, req)
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("SendMessage(%v) error = %v, want InvalidArgument", req, err)
+		}
+	}
+}
+
+func TestGetStats(t *testing.T) {
+	_, client := newTestClient(t)
+	ctx := context.Background()
+
+	subscribe(t, client, "room1")
+	if _, err := client.SendMessage(ctx, &pb.MessageRequest{User: "alice", Message: "hello", Room: "room1"}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+
+	stats, err := client.GetStats(ctx, &pb.StatsRequest{})
+	if err != nil {
+		t.Fatalf("GetStats: %v", err)
+	}
+	if stats.ActiveConnections != 1 || stats.TotalMessages != 1 {
+		t.Errorf("GetStats = %v, want 1 active connection and 1 message", stats)
+	}
+}
+
+func TestShutdownSendsFinalMessage(t *testing.T) {
+	s, client := newTestClient(t)
+	stream := subscribe(t, client, "room1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	msg, err := recvWithTimeout(stream, time.Second)
+	if err != nil {
+		t.Fatalf("receive final message: %v", err)
+	}
+	if msg.User != "System" {
+		t.Errorf("final message = %v, want system message", msg)
+	}
+}
+
+func recvEvent(t *testing.T, stream pb.ChatService_ChatClient) *pb.ServerEvent {
+	t.Helper()
+
+	type result struct {
+		ev  *pb.ServerEvent
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		ev, err := stream.Recv()
+		ch <- result{ev, err}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			t.Fatalf("receive event: %v", r.err)
+		}
+		return r.ev
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for event")
+		return nil
+	}
+}
+
+// joinChat opens a Chat stream for user, joins room and consumes the join
+// and presence events it receives back.
+func joinChat(t *testing.T, client pb.ChatServiceClient, user, room string) pb.ChatService_ChatClient {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	stream, err := client.Chat(ctx)
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+	join := &pb.ClientEvent{Event: &pb.ClientEvent_Join{Join: &pb.JoinEvent{User: user, Room: room}}}
+	if err := stream.Send(join); err != nil {
+		t.Fatalf("send join: %v", err)
+	}
+	recvArrival(t, stream, user, room)
+	return stream
+}
+
+// recvArrival receives the join of user to room and the announcement of
+// their presence that follows it.
+func recvArrival(t *testing.T, stream pb.ChatService_ChatClient, user, room string) {
+	t.Helper()
+	if got := recvEvent(t, stream).GetJoin(); got.GetUser() != user || got.GetRoom() != room {
+		t.Fatalf("received %v, want the join of %s to %s", got, user, room)
+	}
+	if got := recvEvent(t, stream).GetPresence(); got.GetUser() != user || got.GetRoom() != room || got.GetStatus() != "online" {
+		t.Fatalf("received %v, want %s online in %s", got, user, room)
+	}
+}
+
+func TestChatSession(t *testing.T) {
+	_, client := newTestClient(t)
+
+	alice := joinChat(t, client, "alice", "room1")
+	reader := subscribe(t, client, "room1")
+	if got := recvEvent(t, alice).GetPresence(); got.GetUser() != "reader" || got.GetStatus() != "online" {
+		t.Fatalf("alice received %v, want the reader online", got)
+	}
+	bob := joinChat(t, client, "bob", "room1")
+
+	recvArrival(t, alice, "bob", "room1")
+	if got, err := recvWithTimeout(reader, 2*time.Second); err != nil || got.User != "bob" {
+		t.Fatalf("StreamMessages received %v, %v, want bob's join", got, err)
+	}
+
+	// Typing goes to the other sessions only
+	typing := &pb.ClientEvent{Event: &pb.ClientEvent_Typing{Typing: &pb.TypingEvent{Room: "room1", Typing: true}}}
+	if err := alice.Send(typing); err != nil {
+		t.Fatalf("send typing: %v", err)
+	}
+	if got := recvEvent(t, bob).GetTyping(); got.GetUser() != "alice" || !got.GetTyping() {
+		t.Fatalf("bob received %v, want alice typing", got)
+	}
+
+	message := &pb.ClientEvent{Event: &pb.ClientEvent_Message{Message: &pb.MessageRequest{Message: "hello", Room: "room1"}}}
+	if err := alice.Send(message); err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+
+	// The ack and the echo of alice's message may arrive in either order
+	var ackID, echoID string
+	for i := 0; i < 2; i++ {
+		ev := recvEvent(t, alice)
+		switch {
+		case ev.GetAck() != nil:
+			ackID = ev.GetAck().MessageId
+		case ev.GetMessage() != nil:
+			echoID = ev.GetMessage().Id
+		default:
+			t.Fatalf("alice received unexpected %v", ev)
+		}
+	}
+	if ackID == "" || ackID != echoID {
+		t.Fatalf("ack %q does not match echoed message %q", ackID, echoID)
+	}
+
+	got := recvEvent(t, bob).GetMessage()
+	if got.GetId() != ackID || got.GetUser() != "alice" || got.GetMessage() != "hello" {
+		t.Errorf("bob received %v, want alice's message %s", got, ackID)
+	}
+	if got, err := recvWithTimeout(reader, 2*time.Second); err != nil || got.Id != ackID {
+		t.Errorf("StreamMessages received %v, %v, want alice's message", got, err)
+	}
+	// Sending the message ended alice's typing indicator
+	if got := recvEvent(t, bob).GetTyping(); got.GetUser() != "alice" || got.GetTyping() {
+		t.Fatalf("bob received %v, want alice to stop typing", got)
+	}
+
+	leave := &pb.ClientEvent{Event: &pb.ClientEvent_Leave{Leave: &pb.LeaveEvent{Room: "room1"}}}
+	if err := alice.Send(leave); err != nil {
+		t.Fatalf("send leave: %v", err)
+	}
+	if got := recvEvent(t, bob).GetLeave(); got.GetUser() != "alice" {
+		t.Errorf("bob received %v, want alice's leave", got)
+	}
+}
+
+func TestListMembersShowsPresence(t *testing.T) {
+	_, client := newTestClient(t)
+	alice := joinChat(t, client, "alice", "room1")
+	bob := joinChat(t, client, "bob", "room1")
+	recvArrival(t, alice, "bob", "room1")
+
+	members, err := client.ListMembers(context.Background(), &pb.ListMembersRequest{Room: "room1"})
+	if err != nil {
+		t.Fatalf("ListMembers: %v", err)
+	}
+	if got := members.Members; len(got) != 2 || got[0].User != "alice" || got[1].User != "bob" || got[0].Status != "online" {
+		t.Fatalf("members = %v, want alice and bob online", got)
+	}
+
+	away := &pb.ClientEvent{Event: &pb.ClientEvent_Presence{Presence: &pb.PresenceEvent{Status: "away"}}}
+	if err := alice.Send(away); err != nil {
+		t.Fatalf("send presence: %v", err)
+	}
+	if got := recvEvent(t, bob).GetPresence(); got.GetUser() != "alice" || got.GetRoom() != "room1" || got.GetStatus() != "away" {
+		t.Fatalf("bob received %v, want alice away", got)
+	}
+	members, err = client.ListMembers(context.Background(), &pb.ListMembersRequest{Room: "room1"})
+	if err != nil || members.Members[0].Status != "away" {
+		t.Errorf("ListMembers = %v, %v, want alice away", members, err)
+	}
+
+	if _, err := client.ListMembers(context.Background(), &pb.ListMembersRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("ListMembers without a room: %v, want InvalidArgument", err)
+	}
+}
+
+func TestStreamSubscribersAreMembers(t *testing.T) {
+	_, client := newTestClient(t)
+	alice := joinChat(t, client, "alice", "room1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	carol, err := client.StreamMessages(ctx, &pb.StreamRequest{User: "carol", Room: "room1"})
+	if err != nil {
+		t.Fatalf("StreamMessages: %v", err)
+	}
+	recvWithTimeout(carol, 2*time.Second) // welcome
+	if got := recvEvent(t, alice).GetPresence(); got.GetUser() != "carol" || got.GetStatus() != "online" {
+		t.Fatalf("alice received %v, want carol online", got)
+	}
+	members, err := client.ListMembers(context.Background(), &pb.ListMembersRequest{Room: "room1"})
+	if err != nil {
+		t.Fatalf("ListMembers: %v", err)
+	}
+	if got := members.Members; len(got) != 2 || got[1].User != "carol" || got[1].Status != "online" {
+		t.Fatalf("members = %v, want alice and carol online", got)
+	}
+
+	cancel()
+	if got := recvEvent(t, alice).GetPresence(); got.GetUser() != "carol" || got.GetStatus() != "offline" {
+		t.Fatalf("alice received %v, want carol offline", got)
+	}
+	members, err = client.ListMembers(context.Background(), &pb.ListMembersRequest{Room: "room1"})
+	if err != nil || len(members.Members) != 1 {
+		t.Errorf("ListMembers = %v, %v, want alice only", members, err)
+	}
+}
+
+func TestIdleStreamsStayOnline(t *testing.T) {
+	b := broker.NewMemoryBroker()
+	tracker := presence.New(b, presence.Options{Timeout: 50 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tracker.Watch(ctx, 10*time.Millisecond)
+	_, client := newTestClientOn(t, b, Options{Presence: tracker})
+
+	joinChat(t, client, "alice", "room1")
+	bob, err := client.StreamMessages(ctx, &pb.StreamRequest{User: "bob", Room: "room1"})
+	if err != nil {
+		t.Fatalf("StreamMessages: %v", err)
+	}
+	recvWithTimeout(bob, 2*time.Second) // welcome
+
+	// Neither client says anything for several timeouts
+	time.Sleep(200 * time.Millisecond)
+	members, err := client.ListMembers(context.Background(), &pb.ListMembersRequest{Room: "room1"})
+	if err != nil {
+		t.Fatalf("ListMembers: %v", err)
+	}
+	if got := members.Members; len(got) != 2 || got[0].Status != "online" || got[1].Status != "online" {
+		t.Errorf("members = %v, want alice and bob online", got)
+	}
+}
+
+func TestDirectMessagesReachOnlyTheirUsers(t *testing.T) {
+	_, client := newTestClient(t)
+	ctx := context.Background()
+
+	alice := joinChat(t, client, "alice", "room1")
+	bob := joinChat(t, client, "bob", "room2")
+	carol := joinChat(t, client, "carol", "room1")
+	recvArrival(t, alice, "carol", "room1")
+	all := subscribe(t, client, AllRooms)
+	bobStream, err := client.StreamMessages(ctx, &pb.StreamRequest{User: "bob", Room: "room3"})
+	if err != nil {
+		t.Fatalf("StreamMessages: %v", err)
+	}
+	recvWithTimeout(bobStream, 2*time.Second) // welcome
+
+	sent, err := client.SendDirectMessage(ctx, &pb.DirectMessageRequest{User: "alice", To: "bob", Message: "see me after class"})
+	if err != nil {
+		t.Fatalf("SendDirectMessage: %v", err)
+	}
+	if sent.Room != policy.DirectRoom("alice", "bob") || sent.To != "bob" || sent.Seq != 1 {
+		t.Fatalf("SendDirectMessage = %v, want it stored in the conversation of alice and bob", sent)
+	}
+	for name, stream := range map[string]pb.ChatService_ChatClient{"bob": bob, "alice": alice} {
+		if got := recvEvent(t, stream).GetMessage(); got.GetId() != sent.Id || got.GetTo() != "bob" {
+			t.Errorf("%s received %v, want the direct message", name, got)
+		}
+	}
+	if got, err := recvWithTimeout(bobStream, 2*time.Second); err != nil || got.Id != sent.Id {
+		t.Errorf("bob's StreamMessages received %v, %v, want the direct message", got, err)
+	}
+
+	// Bob answers over his Chat session
+	reply := &pb.ClientEvent{Event: &pb.ClientEvent_Direct{Direct: &pb.DirectMessageRequest{To: "alice", Message: "ok"}}}
+	if err := bob.Send(reply); err != nil {
+		t.Fatalf("send direct: %v", err)
+	}
+	if got := recvEvent(t, alice).GetMessage(); got.GetUser() != "bob" || got.GetTo() != "alice" || got.GetMessage() != "ok" {
+		t.Errorf("alice received %v, want bob's reply", got)
+	}
+
+	// Neither room members nor subscribers to every room see them
+	if _, err := client.SendMessage(ctx, &pb.MessageRequest{User: "alice", Message: "hello", Room: "room1"}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if got := recvEvent(t, carol).GetMessage(); got.GetMessage() != "hello" {
+		t.Errorf("carol received %v, want the room message", got)
+	}
+	if got, err := recvWithTimeout(all, 2*time.Second); err != nil || got.Message != "hello" {
+		t.Errorf("subscriber to every room received %v, %v, want the room message", got, err)
+	}
+
+	if _, err := client.GetHistory(ctx, &pb.HistoryRequest{Room: sent.Room}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("GetHistory of the conversation as anonymous: %v, want PermissionDenied", err)
+	}
+	if _, err := client.SendDirectMessage(ctx, &pb.DirectMessageRequest{User: "alice", To: "alice", Message: "hi"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("SendDirectMessage to oneself: %v, want InvalidArgument", err)
+	}
+	if _, err := client.SendMessage(ctx, &pb.MessageRequest{User: "alice", Message: "hi", Room: sent.Room}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("SendMessage to the conversation room: %v, want PermissionDenied", err)
+	}
+}
+
+func TestChatRefusesMessageToRoomNotJoined(t *testing.T) {
+	_, client := newTestClient(t)
+	stream := joinChat(t, client, "alice", "room1")
+
+	message := &pb.ClientEvent{Event: &pb.ClientEvent_Message{Message: &pb.MessageRequest{Message: "hello", Room: "room2"}}}
+	if err := stream.Send(message); err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	if got := recvEvent(t, stream).GetError(); got.GetCode() != "failed_precondition" || got.GetRoom() != "room2" {
+		t.Errorf("received error %v, want a failed_precondition error for room2", got)
+	}
+
+	// The session goes on
+	message = &pb.ClientEvent{Event: &pb.ClientEvent_Message{Message: &pb.MessageRequest{Message: "hello", Room: "room1"}}}
+	if err := stream.Send(message); err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	if got := recvEvent(t, stream); got.GetMessage().GetMessage() != "hello" && got.GetAck() == nil {
+		t.Errorf("received %v, want the message or its ack", got)
+	}
+}
+
+func TestChatMutedMemberStaysConnected(t *testing.T) {
+	p := policy.New()
+	if err := p.SetRoom(policy.Room{Name: "class", Kind: policy.Public, Members: map[string]policy.Role{"mallory": policy.Muted}}); err != nil {
+		t.Fatal(err)
+	}
+	_, client := newTestClientWithOptions(t, Options{Policy: p})
+	bob := joinChat(t, client, "bob", "class")
+	mallory := joinChat(t, client, "mallory", "class")
+	recvArrival(t, bob, "mallory", "class")
+
+	post := func(stream pb.ChatService_ChatClient, text string) {
+		t.Helper()
+		message := &pb.ClientEvent{Event: &pb.ClientEvent_Message{Message: &pb.MessageRequest{Message: text, Room: "class"}}}
+		if err := stream.Send(message); err != nil {
+			t.Fatalf("send message: %v", err)
+		}
+	}
+	post(mallory, "spam")
+	if got := recvEvent(t, mallory).GetError(); got.GetCode() != string(policy.UserMuted) || got.GetRoom() != "class" {
+		t.Fatalf("received error %v, want a muted error for class", got)
+	}
+
+	post(bob, "hello")
+	if got := recvEvent(t, mallory).GetMessage(); got.GetMessage() != "hello" || got.GetUser() != "bob" {
+		t.Errorf("muted member received %v, want bob's message", got)
+	}
+}
+
+func TestSlowStreamIsDisconnected(t *testing.T) {
+	_, client := newTestClientWithOptions(t, Options{SendQueueSize: 1, Overflow: Disconnect})
+	ctx := context.Background()
+
+	// Never read from the stream, so that flow control blocks the sender
+	// once the transport window is full
+	subscribe(t, client, "room1")
+
+	payload := strings.Repeat("x", 1024)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats, err := client.GetStats(ctx, &pb.StatsRequest{})
+		if err != nil {
+			t.Fatalf("GetStats: %v", err)
+		}
+		if stats.SlowDisconnects == 1 && stats.ActiveConnections == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("GetStats = %v, want the stream disconnected", stats)
+		}
+		for i := 0; i < 50; i++ {
+			if _, err := client.SendMessage(ctx, &pb.MessageRequest{User: "alice", Message: payload, Room: "room1"}); err != nil {
+				t.Fatalf("SendMessage: %v", err)
+			}
+		}
+	}
+}
+
+func TestStreamMessagesReplaysHistory(t *testing.T) {
+	_, client := newTestClient(t)
+	ctx := context.Background()
+
+	var sent []string
+	for i := 0; i < 3; i++ {
+		resp, err := client.SendMessage(ctx, &pb.MessageRequest{User: "alice", Message: "hello", Room: "room1"})
+		if err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+		sent = append(sent, resp.Id)
+	}
+
+	for _, tt := range []struct {
+		name string
+		req  *pb.StreamRequest
+		want []string
+	}{
+		{"last messages", &pb.StreamRequest{User: "bob", Room: "room1", HistoryLimit: 2}, sent[1:]},
+		{"since ID", &pb.StreamRequest{User: "bob", Room: "room1", SinceId: sent[0]}, sent[1:]},
+	} {
+		streamCtx, cancel := context.WithCancel(ctx)
+		stream, err := client.StreamMessages(streamCtx, tt.req)
+		if err != nil {
+			t.Fatalf("StreamMessages: %v", err)
+		}
+		if _, err := recvWithTimeout(stream, 2*time.Second); err != nil {
+			t.Fatalf("receive welcome: %v", err)
+		}
+		for _, id := range tt.want {
+			got, err := recvWithTimeout(stream, 2*time.Second)
+			if err != nil || got.Id != id {
+				t.Errorf("%s: received %v, %v, want %s", tt.name, got, err, id)
+			}
+		}
+		cancel()
+	}
+}
+
+func TestStreamMessagesResumesFromLastSeq(t *testing.T) {
+	_, client := newTestClient(t)
+	ctx := context.Background()
+
+	var sent []*pb.MessageResponse
+	for i := 0; i < 3; i++ {
+		resp, err := client.SendMessage(ctx, &pb.MessageRequest{User: "alice", Message: "hello", Room: "room1"})
+		if err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+		if resp.Seq != uint64(i+1) {
+			t.Fatalf("message %d has seq %d, want %d", i, resp.Seq, i+1)
+		}
+		sent = append(sent, resp)
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := client.StreamMessages(streamCtx, &pb.StreamRequest{User: "bob", Room: "room1", LastSeq: 1})
+	if err != nil {
+		t.Fatalf("StreamMessages: %v", err)
+	}
+	if _, err := recvWithTimeout(stream, 2*time.Second); err != nil {
+		t.Fatalf("receive welcome: %v", err)
+	}
+	for _, want := range sent[1:] {
+		got, err := recvWithTimeout(stream, 2*time.Second)
+		if err != nil || got.Id != want.Id || got.Seq != want.Seq {
+			t.Fatalf("received %v, %v, want seq %d", got, err, want.Seq)
+		}
+	}
+
+	// A seq the room never reached cannot be resumed from
+	stream, err = client.StreamMessages(streamCtx, &pb.StreamRequest{User: "bob", Room: "room1", LastSeq: 10})
+	if err != nil {
+		t.Fatalf("StreamMessages: %v", err)
+	}
+	for {
+		_, err := recvWithTimeout(stream, 2*time.Second)
+		if err == nil {
+			continue
+		}
+		if status.Code(err) != codes.OutOfRange {
+			t.Fatalf("stream ended with %v, want OutOfRange", err)
+		}
+		break
+	}
+}
+
+func TestGetHistoryPaginates(t *testing.T) {
+	_, client := newTestClient(t)
+	ctx := context.Background()
+
+	var sent []string
+	for i := 0; i < 3; i++ {
+		resp, err := client.SendMessage(ctx, &pb.MessageRequest{User: "alice", Message: "hello", Room: "room1"})
+		if err != nil {
+			t.Fatalf("SendMessage: %v", err)
+		}
+		sent = append(sent, resp.Id)
+	}
+
+	page, err := client.GetHistory(ctx, &pb.HistoryRequest{Room: "room1", Limit: 2})
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if len(page.Messages) != 2 || page.Messages[0].Id != sent[1] || page.NextBefore != sent[1] {
+		t.Fatalf("first page = %v, want the last two messages", page)
+	}
+
+	page, err = client.GetHistory(ctx, &pb.HistoryRequest{Room: "room1", Before: page.NextBefore, Limit: 2})
+	if err != nil {
+		t.Fatalf("GetHistory: %v", err)
+	}
+	if len(page.Messages) != 1 || page.Messages[0].Id != sent[0] || page.NextBefore != "" {
+		t.Fatalf("second page = %v, want the first message only", page)
+	}
+
+	if _, err := client.GetHistory(ctx, &pb.HistoryRequest{Room: "room1", Before: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetHistory with unknown cursor error = %v, want NotFound", err)
+	}
+}
+
+func TestAuthenticatedRPCsActAsTokenSubject(t *testing.T) {
+	verifier, err := auth.NewVerifier(auth.Config{Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, client := newTestClientWithOptions(t, Options{Auth: verifier})
+
+	ctx := context.Background()
+	if _, err := client.SendMessage(ctx, &pb.MessageRequest{User: "alice", Message: "hi", Room: "room1"}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("SendMessage without token: %v, want Unauthenticated", err)
+	}
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   "alice",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).SignedString([]byte("secret"))
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+
+	resp, err := client.SendMessage(ctx, &pb.MessageRequest{Message: "hi", Room: "room1"})
+	if err != nil || resp.User != "alice" {
+		t.Fatalf("SendMessage = %v, %v, want a message from alice", resp, err)
+	}
+	if _, err := client.SendMessage(ctx, &pb.MessageRequest{User: "mallory", Message: "hi", Room: "room1"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("SendMessage as another user: %v, want PermissionDenied", err)
+	}
+
+	stream, err := client.StreamMessages(context.Background(), &pb.StreamRequest{Room: "room1"})
+	if err != nil {
+		t.Fatalf("StreamMessages: %v", err)
+	}
+	if _, err := recvWithTimeout(stream, 2*time.Second); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("StreamMessages without token: %v, want Unauthenticated", err)
+	}
+}
+
+func TestRoomPolicyIsEnforced(t *testing.T) {
+	rooms := policy.New()
+	rooms.SetRoom(policy.Room{Name: "staff", Kind: policy.Private, Members: map[string]policy.Role{"alice": policy.Owner}})
+	rooms.SetRoom(policy.Room{Name: "news", Kind: policy.ReadOnly})
+	_, client := newTestClientWithOptions(t, Options{Policy: rooms})
+	ctx := context.Background()
+
+	all := subscribe(t, client, AllRooms)
+
+	_, err := client.SendMessage(ctx, &pb.MessageRequest{User: "bob", Message: "hi", Room: "staff"})
+	st := status.Convert(err)
+	if st.Code() != codes.PermissionDenied {
+		t.Fatalf("SendMessage to private room: %v, want PermissionDenied", err)
+	}
+	if details := st.Details(); len(details) != 1 || details[0].(*errdetails.ErrorInfo).Reason != string(policy.NotInvited) {
+		t.Errorf("details = %v, want ErrorInfo with reason %s", details, policy.NotInvited)
+	}
+	if _, err := client.SendMessage(ctx, &pb.MessageRequest{User: "bob", Message: "hi", Room: "news"}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("SendMessage to read-only room: %v, want PermissionDenied", err)
+	}
+
+	stream, err := client.StreamMessages(ctx, &pb.StreamRequest{User: "bob", Room: "staff"})
+	if err != nil {
+		t.Fatalf("StreamMessages: %v", err)
+	}
+	if _, err := recvWithTimeout(stream, 2*time.Second); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("StreamMessages of private room: %v, want PermissionDenied", err)
+	}
+
+	// Subscriptions to every room see public rooms only
+	if _, err := client.SendMessage(ctx, &pb.MessageRequest{User: "alice", Message: "secret", Room: "staff"}); err != nil {
+		t.Fatalf("SendMessage as owner: %v", err)
+	}
+	if _, err := client.SendMessage(ctx, &pb.MessageRequest{User: "alice", Message: "public", Room: "lobby"}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if got, err := recvWithTimeout(all, 2*time.Second); err != nil || got.Message != "public" {
+		t.Errorf("* stream received %v, %v, want the public message only", got, err)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Limits{
+		PerConnection: ratelimit.Rate{PerSecond: 0.01, Burst: 1},
+		Strikes:       2,
+	})
+	_, client := newTestClientWithOptions(t, Options{Limiter: limiter})
+	ctx := context.Background()
+
+	if _, err := client.SendMessage(ctx, &pb.MessageRequest{User: "bob", Message: "one", Room: "lobby"}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	_, err := client.SendMessage(ctx, &pb.MessageRequest{User: "bob", Message: "two", Room: "lobby"})
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("second SendMessage: %v, want ResourceExhausted", err)
+	}
+	var retry *errdetails.RetryInfo
+	for _, d := range st.Details() {
+		if r, ok := d.(*errdetails.RetryInfo); ok {
+			retry = r
+		}
+	}
+	if retry.GetRetryDelay().AsDuration() <= 0 {
+		t.Errorf("details = %v, want a RetryInfo with a delay", st.Details())
+	}
+
+	// A Chat session is told about a rejected message, then disconnected
+	// once it has used up its strikes
+	stream := joinChat(t, client, "alice", "room1")
+	message := &pb.ClientEvent{Event: &pb.ClientEvent_Message{Message: &pb.MessageRequest{Message: "hello", Room: "room1"}}}
+	for i := 0; i < 2; i++ {
+		if err := stream.Send(message); err != nil {
+			t.Fatalf("send message: %v", err)
+		}
+	}
+	for {
+		ev := recvEvent(t, stream)
+		if ev.GetError() != nil {
+			if ev.GetError().Code != ratelimit.Code || ev.GetError().RetryAfterMs <= 0 {
+				t.Errorf("error event = %v, want rate_limited with a retry delay", ev.GetError())
+			}
+			break
+		}
+	}
+	if err := stream.Send(message); err != nil {
+		t.Fatalf("send message: %v", err)
+	}
+	for {
+		_, err := stream.Recv()
+		if err != nil {
+			if status.Code(err) != codes.ResourceExhausted {
+				t.Errorf("Recv error = %v, want ResourceExhausted", err)
+			}
+			break
+		}
+	}
+}
+
+func TestUnaryRateLimitIsPerConnection(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Limits{PerConnection: ratelimit.Rate{PerSecond: 0.01, Burst: 1}})
+	b := broker.NewMemoryBroker()
+	s := NewServer(b, store.NewMemoryStore(0), Options{Limiter: limiter})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+		b.Close()
+	})
+
+	// Two clients on one host, as behind a NAT, have a bucket each
+	for _, user := range []string{"alice", "bob"} {
+		conn, err := grpc.Dial(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		client := pb.NewChatServiceClient(conn)
+
+		req := &pb.MessageRequest{User: user, Message: "hi", Room: "lobby"}
+		if _, err := client.SendMessage(context.Background(), req); err != nil {
+			t.Fatalf("first SendMessage of %s: %v", user, err)
+		}
+		if _, err := client.SendMessage(context.Background(), req); status.Code(err) != codes.ResourceExhausted {
+			t.Fatalf("second SendMessage of %s: %v, want ResourceExhausted", user, err)
+		}
+	}
+}
+
+func TestConnectionCaps(t *testing.T) {
+	caps := connlimit.New(connlimit.Limits{Max: 10, PerIP: 1})
+	_, client := newTestClientWithOptions(t, Options{Connections: caps})
+	ctx := context.Background()
+
+	subscribe(t, client, "room1")
+
+	stream, err := client.Chat(ctx)
+	if err != nil {
+		t.Fatalf("Chat: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("second stream: %v, want Unavailable", err)
+	}
+
+	// Unary calls are not connections
+	stats, err := client.GetStats(ctx, &pb.StatsRequest{})
+	if err != nil {
+		t.Fatalf("GetStats: %v", err)
+	}
+	if stats.OpenConnections != 1 || stats.MaxConnectionsPerIp != 1 || stats.RejectedConnections != 1 {
+		t.Errorf("stats = %v, want 1 open and 1 rejected connection", stats)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := metrics.New()
+	verifier, err := auth.NewVerifier(auth.Config{Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, client := newTestClientWithOptions(t, Options{Auth: verifier, Metrics: m})
+
+	if _, err := client.SendMessage(context.Background(), &pb.MessageRequest{Message: "hi", Room: "room1"}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("SendMessage without token: %v, want Unauthenticated", err)
+	}
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Subject:   "alice",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}).SignedString([]byte("secret"))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+
+	stream, err := client.StreamMessages(ctx, &pb.StreamRequest{Room: "room1"})
+	if err != nil {
+		t.Fatalf("StreamMessages: %v", err)
+	}
+	if _, err := recvWithTimeout(stream, 2*time.Second); err != nil {
+		t.Fatalf("receive welcome: %v", err)
+	}
+	if _, err := client.SendMessage(ctx, &pb.MessageRequest{Message: "hi", Room: "room1"}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if _, err := recvWithTimeout(stream, 2*time.Second); err != nil {
+		t.Fatalf("receive message: %v", err)
+	}
+
+	// The sender counts a message once Send returns, which may be after
+	// the client got it
+	var missing []string
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		w := httptest.NewRecorder()
+		m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+		missing = nil
+		for _, want := range []string{
+			`chat_connections{protocol="grpc"} 1`,
+			`chat_room_connections{protocol="grpc",room="room1"} 1`,
+			`chat_messages_received_total{protocol="grpc"} 1`,
+			`chat_messages_sent_total{protocol="grpc"} 2`,
+			`chat_fanout_duration_seconds_count{protocol="grpc"} 2`, // with the presence of alice
+			`chat_auth_failures_total{protocol="grpc",reason="missing_token"} 1`,
+		} {
+			if !strings.Contains(w.Body.String(), want) {
+				missing = append(missing, want)
+			}
+		}
+		if len(missing) == 0 {
+			return
+		}
+	}
+	t.Errorf("metrics lack %v", missing)
+}
+
+func TestTracingFollowsMessageToStreams(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(trace.NewNoopTracerProvider()) })
+
+	_, client := newTestClient(t)
+	stream := subscribe(t, client, "room1")
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	ctx := metadata.AppendToOutgoingContext(context.Background(), tracing.Header, "00-"+traceID+"-00f067aa0ba902b7-01")
+	if _, err := client.SendMessage(ctx, &pb.MessageRequest{User: "alice", Message: "hi", Room: "room1"}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+	if _, err := recvWithTimeout(stream, 2*time.Second); err != nil {
+		t.Fatalf("receive message: %v", err)
+	}
+
+	// Every span has ended once the message is queued for the stream
+	missing := map[string]bool{
+		tracing.ReceiveSpan:   true,
+		tracing.AuthorizeSpan: true,
+		tracing.PersistSpan:   true,
+		tracing.PublishSpan:   true,
+		tracing.DeliverSpan:   true,
+	}
+	for _, span := range recorder.Ended() {
+		if got := span.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("span %s is in trace %s, want %s", span.Name(), got, traceID)
+		}
+		delete(missing, span.Name())
+	}
+	if len(missing) > 0 {
+		t.Errorf("spans missing: %v", missing)
+	}
+}
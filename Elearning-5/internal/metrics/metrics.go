@@ -0,0 +1,230 @@
+// Package metrics collects the Prometheus metrics of every protocol in one
+// registry, served in the text format at /metrics.
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"elearning-5/internal/auth"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Protocol labels.
+const (
+	WebSocket = "websocket"
+	SignalR   = "signalr"
+	GRPC      = "grpc"
+)
+
+// Reasons for dropped messages and evicted clients.
+const (
+	QueueFull    = "queue_full"
+	SlowConsumer = "slow_consumer"
+	RateLimited  = "rate_limited"
+)
+
+// Metrics records what the servers do. A nil Metrics records nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	connections  *prometheus.GaugeVec
+	roomMembers  *prometheus.GaugeVec
+	received     *prometheus.CounterVec
+	sent         *prometheus.CounterVec
+	bytesIn      *prometheus.CounterVec
+	bytesOut     *prometheus.CounterVec
+	dropped      *prometheus.CounterVec
+	evicted      *prometheus.CounterVec
+	queueDepth   *prometheus.HistogramVec
+	fanout       *prometheus.HistogramVec
+	authFailures *prometheus.CounterVec
+
+	mu    sync.Mutex
+	rooms map[[2]string]int // protocol, room -> connections
+}
+
+// New returns metrics registered in a new registry, along with the Go
+// runtime and process collectors.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		rooms:    make(map[[2]string]int),
+		connections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "chat_connections",
+			Help: "Open client connections; gRPC counts Chat and StreamMessages streams.",
+		}, []string{"protocol"}),
+		roomMembers: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "chat_room_connections",
+			Help: "Connections in each room.",
+		}, []string{"protocol", "room"}),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_messages_received_total",
+			Help: "Messages received from clients.",
+		}, []string{"protocol"}),
+		sent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_messages_sent_total",
+			Help: "Messages written to clients.",
+		}, []string{"protocol"}),
+		bytesIn: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_received_bytes_total",
+			Help: "Bytes of the messages received from clients.",
+		}, []string{"protocol"}),
+		bytesOut: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_sent_bytes_total",
+			Help: "Bytes of the messages written to clients.",
+		}, []string{"protocol"}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_messages_dropped_total",
+			Help: "Messages discarded instead of being sent to a client.",
+		}, []string{"protocol", "reason"}),
+		evicted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_clients_evicted_total",
+			Help: "Clients disconnected by the server.",
+		}, []string{"protocol", "reason"}),
+		queueDepth: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "chat_send_queue_depth",
+			Help:    "Messages already waiting in a client's send queue when another is queued.",
+			Buckets: []float64{0, 1, 4, 16, 64, 128, 256, 512, 1024},
+		}, []string{"protocol"}),
+		fanout: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "chat_fanout_duration_seconds",
+			Help:    "Time to queue one broker message for every local recipient.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}, []string{"protocol"}),
+		authFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "chat_auth_failures_total",
+			Help: "Requests and RPCs rejected for a missing or invalid token.",
+		}, []string{"protocol", "reason"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.connections, m.roomMembers,
+		m.received, m.sent, m.bytesIn, m.bytesOut,
+		m.dropped, m.evicted, m.queueDepth, m.fanout,
+		m.authFailures,
+	)
+	return m
+}
+
+// Handler serves the registry in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	if m == nil {
+		return http.NotFoundHandler()
+	}
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Registry is the registry the metrics are in, for more collectors.
+func (m *Metrics) Registry() *prometheus.Registry {
+	if m == nil {
+		return nil
+	}
+	return m.registry
+}
+
+func (m *Metrics) Connected(protocol string) {
+	if m != nil {
+		m.connections.WithLabelValues(protocol).Inc()
+	}
+}
+
+func (m *Metrics) Disconnected(protocol string) {
+	if m != nil {
+		m.connections.WithLabelValues(protocol).Dec()
+	}
+}
+
+// Joined counts a connection in room until Left is called for it. The
+// series of a room is removed once it is empty.
+func (m *Metrics) Joined(protocol, room string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{protocol, room}
+	m.rooms[key]++
+	m.roomMembers.WithLabelValues(protocol, room).Set(float64(m.rooms[key]))
+}
+
+func (m *Metrics) Left(protocol, room string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := [2]string{protocol, room}
+	if m.rooms[key]--; m.rooms[key] > 0 {
+		m.roomMembers.WithLabelValues(protocol, room).Set(float64(m.rooms[key]))
+		return
+	}
+	delete(m.rooms, key)
+	m.roomMembers.DeleteLabelValues(protocol, room)
+}
+
+// Received counts a message of size bytes from a client.
+func (m *Metrics) Received(protocol string, size int) {
+	if m != nil {
+		m.received.WithLabelValues(protocol).Inc()
+		m.bytesIn.WithLabelValues(protocol).Add(float64(size))
+	}
+}
+
+// Sent counts a message of size bytes written to a client.
+func (m *Metrics) Sent(protocol string, size int) {
+	if m != nil {
+		m.sent.WithLabelValues(protocol).Inc()
+		m.bytesOut.WithLabelValues(protocol).Add(float64(size))
+	}
+}
+
+func (m *Metrics) Dropped(protocol, reason string) {
+	if m != nil {
+		m.dropped.WithLabelValues(protocol, reason).Inc()
+	}
+}
+
+func (m *Metrics) Evicted(protocol, reason string) {
+	if m != nil {
+		m.evicted.WithLabelValues(protocol, reason).Inc()
+	}
+}
+
+// QueueDepth records how many messages were queued for a client when
+// another was added.
+func (m *Metrics) QueueDepth(protocol string, depth int) {
+	if m != nil {
+		m.queueDepth.WithLabelValues(protocol).Observe(float64(depth))
+	}
+}
+
+// Fanout records the time since start spent delivering a message to the
+// local recipients.
+func (m *Metrics) Fanout(protocol string, start time.Time) {
+	if m != nil {
+		m.fanout.WithLabelValues(protocol).Observe(time.Since(start).Seconds())
+	}
+}
+
+// AuthFailures returns a function counting the authentication errors of
+// protocol, for middleware.RequireAuth and the gRPC interceptors.
+func (m *Metrics) AuthFailures(protocol string) func(error) {
+	if m == nil {
+		return nil
+	}
+	return func(err error) {
+		reason := "invalid_token"
+		if errors.Is(err, auth.ErrNoToken) {
+			reason = "missing_token"
+		}
+		m.authFailures.WithLabelValues(protocol, reason).Inc()
+	}
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"elearning-5/internal/auth"
+)
+
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 200 {
+		t.Fatalf("GET /metrics = %d", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestMetricsAreExposed(t *testing.T) {
+	m := New()
+	m.Connected(WebSocket)
+	m.Connected(WebSocket)
+	m.Disconnected(WebSocket)
+	m.Joined(SignalR, "general")
+	m.Joined(SignalR, "general")
+	m.Joined(SignalR, "random")
+	m.Left(SignalR, "random")
+	m.Received(GRPC, 10)
+	m.Received(GRPC, 5)
+	m.Sent(GRPC, 7)
+	m.Dropped(GRPC, QueueFull)
+	m.Evicted(WebSocket, SlowConsumer)
+	m.QueueDepth(SignalR, 3)
+	m.Fanout(WebSocket, time.Now())
+	m.AuthFailures(GRPC)(auth.ErrNoToken)
+	m.AuthFailures(GRPC)(fmt.Errorf("%w: expired", auth.ErrInvalidToken))
+
+	body := scrape(t, m)
+	for _, want := range []string{
+		`chat_connections{protocol="websocket"} 1`,
+		`chat_room_connections{protocol="signalr",room="general"} 2`,
+		`chat_messages_received_total{protocol="grpc"} 2`,
+		`chat_received_bytes_total{protocol="grpc"} 15`,
+		`chat_messages_sent_total{protocol="grpc"} 1`,
+		`chat_sent_bytes_total{protocol="grpc"} 7`,
+		`chat_messages_dropped_total{protocol="grpc",reason="queue_full"} 1`,
+		`chat_clients_evicted_total{protocol="websocket",reason="slow_consumer"} 1`,
+		`chat_send_queue_depth_bucket{protocol="signalr",le="4"} 1`,
+		`chat_fanout_duration_seconds_count{protocol="websocket"} 1`,
+		`chat_auth_failures_total{protocol="grpc",reason="missing_token"} 1`,
+		`chat_auth_failures_total{protocol="grpc",reason="invalid_token"} 1`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics lack %s", want)
+		}
+	}
+	// Empty rooms are not kept as series
+	if strings.Contains(body, `room="random"`) {
+		t.Error("metrics still have the empty room random")
+	}
+}
+
+func TestNilMetricsRecordNothing(t *testing.T) {
+	var m *Metrics
+	m.Connected(WebSocket)
+	m.Joined(GRPC, "general")
+	m.Left(GRPC, "general")
+	m.Received(SignalR, 1)
+	m.QueueDepth(GRPC, 1)
+	m.Fanout(GRPC, time.Now())
+	if m.AuthFailures(GRPC) != nil {
+		t.Error("AuthFailures of nil metrics is not nil")
+	}
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 404 {
+		t.Errorf("GET /metrics of nil metrics = %d, want 404", w.Code)
+	}
+}
@@ -0,0 +1,118 @@
+// Package origin decides which browser origins may call the HTTP endpoints
+// and open WebSocket connections.
+package origin
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/rs/cors"
+)
+
+// Allowlist holds the allowed origins. Patterns are origins such as
+// https://app.example.com, or https://*.example.com for every subdomain of
+// example.com (but not example.com itself). A nil Allowlist allows every
+// origin, like dev mode.
+type Allowlist struct {
+	dev       bool
+	exact     map[string]bool
+	wildcards []wildcard
+}
+
+type wildcard struct {
+	scheme string
+	suffix string // ".example.com"
+	port   string
+}
+
+// New returns an allowlist of patterns. In dev mode every origin is allowed
+// and patterns are ignored; "*" is only accepted that way.
+func New(patterns []string, dev bool) (*Allowlist, error) {
+	a := &Allowlist{dev: dev, exact: make(map[string]bool)}
+	if dev {
+		return a, nil
+	}
+
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if pattern == "*" {
+			return nil, fmt.Errorf("origin %q allows everything, use dev mode instead", pattern)
+		}
+		u, err := url.Parse(pattern)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("origin %q is not of the form scheme://host[:port]", pattern)
+		}
+
+		scheme, host, port := strings.ToLower(u.Scheme), strings.ToLower(u.Hostname()), u.Port()
+		if rest, ok := strings.CutPrefix(host, "*."); ok {
+			if rest == "" || strings.Contains(rest, "*") {
+				return nil, fmt.Errorf("origin %q: only a leading *. is supported", pattern)
+			}
+			a.wildcards = append(a.wildcards, wildcard{scheme: scheme, suffix: "." + rest, port: port})
+			continue
+		}
+		if strings.Contains(host, "*") {
+			return nil, fmt.Errorf("origin %q: only a leading *. is supported", pattern)
+		}
+		a.exact[normalize(scheme, host, port)] = true
+	}
+	return a, nil
+}
+
+func normalize(scheme, host, port string) string {
+	if port != "" {
+		host += ":" + port
+	}
+	return scheme + "://" + host
+}
+
+// Dev reports whether every origin is allowed.
+func (a *Allowlist) Dev() bool {
+	return a == nil || a.dev
+}
+
+// Allowed reports whether a request from origin may be served.
+func (a *Allowlist) Allowed(origin string) bool {
+	if a.Dev() {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return false
+	}
+
+	scheme, host, port := strings.ToLower(u.Scheme), strings.ToLower(u.Hostname()), u.Port()
+	if a.exact[normalize(scheme, host, port)] {
+		return true
+	}
+	for _, w := range a.wildcards {
+		if w.scheme == scheme && w.port == port && strings.HasSuffix(host, w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckOrigin is a websocket.Upgrader CheckOrigin. Requests without an
+// Origin header come from non-browser clients and are allowed.
+func (a *Allowlist) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || a.Allowed(origin)
+}
+
+// CORS returns a CORS handler with opts whose allowed origins are those of
+// the allowlist.
+func (a *Allowlist) CORS(opts cors.Options) *cors.Cors {
+	if a.Dev() {
+		opts.AllowedOrigins = []string{"*"}
+	} else {
+		opts.AllowedOrigins = nil
+		opts.AllowOriginFunc = a.Allowed
+	}
+	return cors.New(opts)
+}
@@ -0,0 +1,74 @@
+package origin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/rs/cors"
+)
+
+func TestAllowed(t *testing.T) {
+	a, err := New([]string{"https://app.example.com", "https://*.school.edu", "http://localhost:3000"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for origin, want := range map[string]bool{
+		"https://app.example.com":     true,
+		"https://APP.example.com":     true,
+		"http://app.example.com":      false,
+		"https://app.example.com:444": false,
+		"https://evil.example.com":    false,
+		"https://lab.school.edu":      true,
+		"https://a.lab.school.edu":    true,
+		"https://school.edu":          false,
+		"https://evilschool.edu":      false,
+		"https://lab.school.edu.evil": false,
+		"http://localhost:3000":       true,
+		"http://localhost":            false,
+		"null":                        false,
+	} {
+		if got := a.Allowed(origin); got != want {
+			t.Errorf("Allowed(%q) = %v, want %v", origin, got, want)
+		}
+	}
+}
+
+func TestNewRejectsInvalidPatterns(t *testing.T) {
+	for _, pattern := range []string{"*", "example.com", "https://a.*.example.com", "https://example.com/path", "https://*."} {
+		if _, err := New([]string{pattern}, false); err == nil {
+			t.Errorf("New(%q) succeeded", pattern)
+		}
+	}
+	if a, err := New([]string{"*"}, true); err != nil || !a.Allowed("https://anything.test") {
+		t.Errorf("dev mode = %v, %v, want every origin allowed", a, err)
+	}
+}
+
+func TestCheckOriginAndCORS(t *testing.T) {
+	a, _ := New([]string{"https://app.example.com"}, false)
+
+	r := httptest.NewRequest("GET", "/ws", nil)
+	if !a.CheckOrigin(r) {
+		t.Error("request without Origin refused")
+	}
+	r.Header.Set("Origin", "https://evil.test")
+	if a.CheckOrigin(r) {
+		t.Error("request from another origin allowed")
+	}
+
+	handler := a.CORS(cors.Options{AllowCredentials: true}).Handler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {}))
+	for origin, want := range map[string]string{
+		"https://app.example.com": "https://app.example.com",
+		"https://evil.test":       "",
+	} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/stats", nil)
+		r.Header.Set("Origin", origin)
+		handler.ServeHTTP(w, r)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != want {
+			t.Errorf("Access-Control-Allow-Origin for %s = %q, want %q", origin, got, want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Package policy decides who may join and post in a room. Rooms are public
+// unless configured otherwise; configured rooms list the role of each user.
+// The conversation rooms of direct messages are open to their two users only.
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Kind is the access model of a room.
+type Kind string
+
+const (
+	// Public rooms can be joined by anyone; everyone but muted users posts.
+	Public Kind = "public"
+	// Private rooms are invite-only: only users with a role join them.
+	Private Kind = "private"
+	// ReadOnly rooms can be joined by anyone; only owners and moderators
+	// post.
+	ReadOnly Kind = "read-only"
+)
+
+// Role is what a user may do in a room. A user without a role in a room is
+// treated as a member of public and read-only rooms.
+type Role string
+
+const (
+	None      Role = ""
+	Owner     Role = "owner"
+	Moderator Role = "moderator"
+	Member    Role = "member"
+	Muted     Role = "muted" // can join and read but not post
+)
+
+// Action is checked by Authorize.
+type Action string
+
+const (
+	Join Action = "join"
+	Send Action = "send"
+)
+
+// Room is the configuration of one room.
+type Room struct {
+	Name    string          `json:"name"`
+	Kind    Kind            `json:"kind"`
+	Members map[string]Role `json:"members"` // user -> role
+}
+
+// Policy holds the configured rooms. A nil Policy allows everything except
+// reading the direct messages of other users.
+type Policy struct {
+	mu    sync.RWMutex
+	rooms map[string]Room
+}
+
+// New returns a policy in which every room is public.
+func New() *Policy {
+	return &Policy{rooms: make(map[string]Room)}
+}
+
+// Load reads the rooms of a JSON file of the form
+//
+//	{"rooms": [{"name": "staff", "kind": "private", "members": {"alice": "owner"}}]}
+//
+// An empty path returns a policy in which every room is public.
+func Load(path string) (*Policy, error) {
+	p := New()
+	if path == "" {
+		return p, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Rooms []Room `json:"rooms"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, room := range file.Rooms {
+		if err := p.SetRoom(room); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// SetRoom adds or replaces the configuration of a room.
+func (p *Policy) SetRoom(room Room) error {
+	if room.Name == "" {
+		return fmt.Errorf("room without a name")
+	}
+	if strings.HasPrefix(room.Name, directPrefix) {
+		return fmt.Errorf("room %q: names starting with %q are reserved for direct messages", room.Name, directPrefix)
+	}
+	switch room.Kind {
+	case "":
+		room.Kind = Public
+	case Public, Private, ReadOnly:
+	default:
+		return fmt.Errorf("room %q: unknown kind %q", room.Name, room.Kind)
+	}
+
+	members := make(map[string]Role, len(room.Members))
+	for user, role := range room.Members {
+		switch role {
+		case Owner, Moderator, Member, Muted:
+		default:
+			return fmt.Errorf("room %q: unknown role %q for %s", room.Name, role, user)
+		}
+		members[user] = role
+	}
+	room.Members = members
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rooms[room.Name] = room
+	return nil
+}
+
+// Role returns the role of user in room.
+func (p *Policy) Role(room, user string) Role {
+	if p == nil {
+		return None
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.rooms[room].Members[user]
+}
+
+// Readable reports whether anyone may read room, which lets subscriptions to
+// every room receive its messages.
+func (p *Policy) Readable(room string) bool {
+	if strings.HasPrefix(room, directPrefix) {
+		return false
+	}
+	if p == nil {
+		return true
+	}
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.rooms[room].Kind != Private
+}
+
+// Authorize returns an *Error when user may not perform action in room.
+// Anonymous users have the empty name and no role anywhere. Only the two
+// users of a direct conversation room may join it, to read its history, and
+// nobody may send to it as a room.
+func (p *Policy) Authorize(user, room string, action Action) error {
+	if strings.HasPrefix(room, directPrefix) {
+		return authorizeDirect(user, room, action)
+	}
+	if p == nil {
+		return nil
+	}
+
+	p.mu.RLock()
+	cfg, configured := p.rooms[room]
+	p.mu.RUnlock()
+	if !configured {
+		return nil
+	}
+
+	role := None
+	if user != "" {
+		role = cfg.Members[user]
+	}
+	deny := func(code Code) error {
+		return &Error{Code: code, Room: room, User: user, Action: action}
+	}
+
+	if cfg.Kind == Private && role == None {
+		return deny(NotInvited)
+	}
+	if action != Send {
+		return nil
+	}
+	switch {
+	case role == Muted:
+		return deny(UserMuted)
+	case cfg.Kind == ReadOnly && role != Owner && role != Moderator:
+		return deny(RoomReadOnly)
+	}
+	return nil
+}
+
+func authorizeDirect(user, room string, action Action) error {
+	a, b, ok := Participants(room)
+	switch {
+	case !ok || user == "" || (user != a && user != b):
+		return &Error{Code: NotInvited, Room: room, User: user, Action: action}
+	case action == Send:
+		return &Error{Code: DirectOnly, Room: room, User: user, Action: action}
+	}
+	return nil
+}
+
+// directPrefix starts the names of direct conversation rooms.
+const directPrefix = "dm:"
+
+// DirectRoom returns the room that keeps the direct messages between users a
+// and b, the same in both directions. The names are escaped so that no other
+// pair of users shares it.
+func DirectRoom(a, b string) string {
+	a, b = url.QueryEscape(a), url.QueryEscape(b)
+	if b < a {
+		a, b = b, a
+	}
+	return directPrefix + a + ":" + b
+}
+
+// Participants returns the two users of a direct conversation room. ok is
+// false for every other room.
+func Participants(room string) (a, b string, ok bool) {
+	rest, found := strings.CutPrefix(room, directPrefix)
+	if !found {
+		return "", "", false
+	}
+	first, second, found := strings.Cut(rest, ":")
+	if !found {
+		return "", "", false
+	}
+	a, errA := url.QueryUnescape(first)
+	b, errB := url.QueryUnescape(second)
+	if errA != nil || errB != nil || DirectRoom(a, b) != room {
+		return "", "", false
+	}
+	return a, b, true
+}
+
+// Code identifies why an action was denied. Codes are stable and meant for
+// clients to act on.
+type Code string
+
+const (
+	NotInvited   Code = "not_invited"
+	UserMuted    Code = "muted"
+	RoomReadOnly Code = "read_only"
+	// DirectOnly denies sending to a direct conversation room, whose
+	// messages are sent to a user instead.
+	DirectOnly Code = "direct_only"
+)
+
+// Error is returned by Authorize for a denied action.
+type Error struct {
+	Code   Code
+	Room   string
+	User   string
+	Action Action
+}
+
+func (e *Error) Error() string {
+	user := e.User
+	if user == "" {
+		user = "anonymous user"
+	}
+	verb := "join"
+	if e.Action == Send {
+		verb = "send to"
+	}
+	return fmt.Sprintf("%s: %s may not %s room %q", e.Code, user, verb, e.Room)
+}
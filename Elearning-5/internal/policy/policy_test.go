@@ -0,0 +1,154 @@
+package policy
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testPolicy(t *testing.T) *Policy {
+	t.Helper()
+	p := New()
+	for _, room := range []Room{
+		{Name: "staff", Kind: Private, Members: map[string]Role{"alice": Owner, "bob": Member, "carol": Muted}},
+		{Name: "news", Kind: ReadOnly, Members: map[string]Role{"alice": Owner, "dave": Moderator}},
+		{Name: "lobby", Members: map[string]Role{"carol": Muted}},
+	} {
+		if err := p.SetRoom(room); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return p
+}
+
+func TestAuthorize(t *testing.T) {
+	p := testPolicy(t)
+
+	for _, tt := range []struct {
+		user, room string
+		action     Action
+		want       Code // empty when allowed
+	}{
+		{"alice", "staff", Send, ""},
+		{"bob", "staff", Send, ""},
+		{"carol", "staff", Join, ""},
+		{"carol", "staff", Send, UserMuted},
+		{"eve", "staff", Join, NotInvited},
+		{"", "staff", Join, NotInvited},
+		{"eve", "news", Join, ""},
+		{"eve", "news", Send, RoomReadOnly},
+		{"dave", "news", Send, ""},
+		{"eve", "lobby", Send, ""},
+		{"carol", "lobby", Send, UserMuted},
+		{"eve", "anywhere", Send, ""},
+	} {
+		err := p.Authorize(tt.user, tt.room, tt.action)
+		var denied *Error
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%s %s %s: %v, want allowed", tt.user, tt.action, tt.room, err)
+		case tt.want != "" && (!errors.As(err, &denied) || denied.Code != tt.want):
+			t.Errorf("%s %s %s: %v, want %s", tt.user, tt.action, tt.room, err, tt.want)
+		}
+	}
+}
+
+func TestReadable(t *testing.T) {
+	p := testPolicy(t)
+	if p.Readable("staff") {
+		t.Error("private room is readable by everyone")
+	}
+	if !p.Readable("news") || !p.Readable("anywhere") {
+		t.Error("read-only and unconfigured rooms are not readable by everyone")
+	}
+}
+
+func TestNilPolicyAllowsEverything(t *testing.T) {
+	var p *Policy
+	if err := p.Authorize("", "staff", Send); err != nil || !p.Readable("staff") {
+		t.Errorf("nil policy denied: %v", err)
+	}
+}
+
+func TestDirectRooms(t *testing.T) {
+	room := DirectRoom("bob", "alice")
+	if room != DirectRoom("alice", "bob") {
+		t.Errorf("DirectRoom depends on the order of the users")
+	}
+	if a, b, ok := Participants(room); !ok || a != "alice" || b != "bob" {
+		t.Errorf("Participants(%q) = %q, %q, %v", room, a, b, ok)
+	}
+	if DirectRoom("a", "b:c") == DirectRoom("a:b", "c") {
+		t.Error("different pairs of users share a room")
+	}
+	for _, name := range []string{"staff", "dm:alice", "dm:bob:alice", "dm:a:b:c"} {
+		if _, _, ok := Participants(name); ok {
+			t.Errorf("Participants(%q) succeeded", name)
+		}
+	}
+
+	// Even a nil policy keeps direct messages between their users
+	for _, p := range []*Policy{testPolicy(t), nil} {
+		for _, tt := range []struct {
+			user   string
+			action Action
+			want   Code
+		}{
+			{"alice", Join, ""},
+			{"bob", Join, ""},
+			{"alice", Send, DirectOnly},
+			{"eve", Join, NotInvited},
+			{"", Join, NotInvited},
+		} {
+			err := p.Authorize(tt.user, room, tt.action)
+			var denied *Error
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("%s %s %s: %v, want allowed", tt.user, tt.action, room, err)
+			case tt.want != "" && (!errors.As(err, &denied) || denied.Code != tt.want):
+				t.Errorf("%s %s %s: %v, want %s", tt.user, tt.action, room, err, tt.want)
+			}
+		}
+		if p.Readable(room) {
+			t.Error("direct room is readable by everyone")
+		}
+	}
+
+	if err := New().SetRoom(Room{Name: room}); err == nil {
+		t.Error("SetRoom accepted a direct room")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) string {
+		path := filepath.Join(dir, "rooms.json")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	p, err := Load(write(`{"rooms": [{"name": "staff", "kind": "private", "members": {"alice": "owner"}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Role("staff", "alice") != Owner {
+		t.Errorf("role of alice = %q, want owner", p.Role("staff", "alice"))
+	}
+
+	for _, bad := range []string{
+		`{"rooms": [{"name": "staff", "kind": "secret"}]}`,
+		`{"rooms": [{"name": "staff", "members": {"alice": "admin"}}]}`,
+		`{"rooms": [{"kind": "private"}]}`,
+		`not json`,
+	} {
+		if _, err := Load(write(bad)); err == nil {
+			t.Errorf("Load(%s) succeeded, want error", bad)
+		}
+	}
+	if _, err := Load(""); err != nil {
+		t.Errorf("Load without a file: %v", err)
+	}
+}
@@ -0,0 +1,561 @@
+// Package presence tracks whether users are online, away or offline across
+// all of their connections on every protocol, relays debounced typing
+// indicators, and answers who is in a room.
+//
+// Changes are announced through the broker as presence and typing messages
+// to the rooms of the user, so that every protocol delivers them like any
+// other room traffic. Neither kind is stored in the history.
+package presence
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"elearning-5/internal/broker"
+	"elearning-5/pkg/logger"
+)
+
+// Status is the presence of a user.
+type Status string
+
+const (
+	Online  Status = "online"
+	Away    Status = "away"
+	Offline Status = "offline"
+)
+
+// Broker message types. A presence message carries the new Status of its
+// user as its text, a typing message TypingStarted or TypingStopped.
+const (
+	PresenceType = "presence"
+	TypingType   = "typing"
+
+	TypingStarted = "started"
+	TypingStopped = "stopped"
+)
+
+// Defaults used when Options fields are zero.
+const (
+	DefaultTimeout       = 60 * time.Second
+	DefaultTypingTimeout = 5 * time.Second
+	// DefaultInterval is how often Watch looks for silent connections.
+	DefaultInterval = 5 * time.Second
+)
+
+// Ephemeral reports whether a broker message type is presence traffic,
+// which only goes to the clients in its room.
+func Ephemeral(msgType string) bool {
+	return msgType == PresenceType || msgType == TypingType
+}
+
+// Options configures a Tracker. Zero values select the defaults.
+type Options struct {
+	// Timeout is how long a connection counts without a heartbeat. A user
+	// whose connections all went silent is offline even if the transport
+	// has not noticed yet.
+	Timeout time.Duration
+	// TypingTimeout ends a typing indicator that was not repeated or
+	// stopped within it.
+	TypingTimeout time.Duration
+}
+
+// Member is a user in a room roster.
+type Member struct {
+	User   string `json:"user"`
+	Status Status `json:"status"`
+	Typing bool   `json:"typing"`
+}
+
+// Tracker holds the presence of every user of the servers sharing it. A nil
+// Tracker tracks nothing and announces nothing.
+type Tracker struct {
+	broker broker.Broker
+	opts   Options
+	now    func() time.Time
+
+	mu     sync.Mutex
+	users  map[string]*user
+	typing map[typingKey]*typist
+}
+
+// user is the state of one identified user.
+type user struct {
+	conns  map[*Conn]bool
+	status Status // last announced
+}
+
+type typingKey struct {
+	user string
+	room string
+}
+
+// typist is a running typing indicator; its timer stops it.
+type typist struct {
+	timer *time.Timer
+}
+
+func New(b broker.Broker, opts Options) *Tracker {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+	if opts.TypingTimeout <= 0 {
+		opts.TypingTimeout = DefaultTypingTimeout
+	}
+	return &Tracker{
+		broker: b,
+		opts:   opts,
+		now:    time.Now,
+		users:  make(map[string]*user),
+		typing: make(map[typingKey]*typist),
+	}
+}
+
+// Conn is the presence of one connection. Its fields are guarded by the
+// tracker's lock and its methods are safe for concurrent use.
+type Conn struct {
+	tracker  *Tracker
+	protocol string
+
+	user     string // empty until Identify
+	rooms    map[string]bool
+	away     bool
+	lastSeen time.Time
+	kept     bool // alive until closed, see KeepAlive
+	closed   bool
+}
+
+// Connect starts tracking a connection on protocol. It counts for its user
+// once Identify names them.
+func (t *Tracker) Connect(protocol string) *Conn {
+	c := &Conn{tracker: t, protocol: protocol, rooms: make(map[string]bool)}
+	if t != nil {
+		c.lastSeen = t.now()
+	}
+	return c
+}
+
+func (c *Conn) disabled() bool {
+	return c == nil || c.tracker == nil
+}
+
+// Identify sets the user of the connection. Later calls are ignored, a
+// connection never changes user.
+func (c *Conn) Identify(name string) {
+	if c.disabled() || name == "" {
+		return
+	}
+	t := c.tracker
+	t.mu.Lock()
+	if c.user != "" || c.closed {
+		t.mu.Unlock()
+		return
+	}
+	c.user = name
+	c.lastSeen = t.now()
+	u := t.users[name]
+	if u == nil {
+		u = &user{conns: make(map[*Conn]bool), status: Offline}
+		t.users[name] = u
+	}
+	u.conns[c] = true
+	msgs := t.update(name, c.protocol, nil)
+	t.mu.Unlock()
+
+	t.publish(msgs)
+}
+
+// User returns the user named by Identify, empty before.
+func (c *Conn) User() string {
+	if c.disabled() {
+		return ""
+	}
+	c.tracker.mu.Lock()
+	defer c.tracker.mu.Unlock()
+	return c.user
+}
+
+// Join adds room to the rooms the connection is in. The presence of its
+// user is announced to the room unless another of their connections was
+// already in it.
+func (c *Conn) Join(room string) {
+	if c.disabled() {
+		return
+	}
+	t := c.tracker
+	t.mu.Lock()
+	if c.closed || c.rooms[room] {
+		t.mu.Unlock()
+		return
+	}
+	arrived := c.user != "" && !t.inRoom(c.user, room)
+	c.rooms[room] = true
+	var msgs []broker.Message
+	if arrived {
+		msgs = t.update(c.user, c.protocol, nil)
+		if status := t.users[c.user].status; msgs == nil && status != Offline {
+			msgs = []broker.Message{newMessage(PresenceType, c.user, room, string(status), c.protocol)}
+		}
+	}
+	t.mu.Unlock()
+
+	t.publish(msgs)
+}
+
+// Leave removes room from the rooms of the connection, ending the user's
+// typing indicator there unless another of their connections is in it.
+func (c *Conn) Leave(room string) {
+	if c.disabled() {
+		return
+	}
+	t := c.tracker
+	t.mu.Lock()
+	if !c.rooms[room] {
+		t.mu.Unlock()
+		return
+	}
+	delete(c.rooms, room)
+	var msgs []broker.Message
+	if c.user != "" && !t.inRoom(c.user, room) {
+		msgs = t.stopTyping(typingKey{c.user, room}, c.protocol)
+	}
+	t.mu.Unlock()
+
+	t.publish(msgs)
+}
+
+// Heartbeat records that the client is alive. Every message a client sends
+// counts as one, as do transport pings and pongs.
+func (c *Conn) Heartbeat() {
+	if c.disabled() {
+		return
+	}
+	t := c.tracker
+	t.mu.Lock()
+	if c.closed {
+		t.mu.Unlock()
+		return
+	}
+	c.lastSeen = t.now()
+	var msgs []broker.Message
+	if c.user != "" {
+		msgs = t.update(c.user, c.protocol, nil)
+	}
+	t.mu.Unlock()
+
+	t.publish(msgs)
+}
+
+// KeepAlive counts the connection as alive until it closes, as if it kept
+// sending heartbeats. It suits streams whose transport notices dead clients
+// by itself and whose clients may have nothing to send.
+func (c *Conn) KeepAlive() {
+	if c.disabled() {
+		return
+	}
+	t := c.tracker
+	t.mu.Lock()
+	if c.closed {
+		t.mu.Unlock()
+		return
+	}
+	c.kept = true
+	var msgs []broker.Message
+	if c.user != "" {
+		msgs = t.update(c.user, c.protocol, nil)
+	}
+	t.mu.Unlock()
+
+	t.publish(msgs)
+}
+
+// SetStatus marks the connection online or away, as chosen by the client,
+// and counts as a heartbeat. A user is away when all of their live
+// connections are.
+func (c *Conn) SetStatus(status Status) error {
+	if status != Online && status != Away {
+		return fmt.Errorf("invalid status %q (want %s or %s)", status, Online, Away)
+	}
+	if c.disabled() {
+		return nil
+	}
+	t := c.tracker
+	t.mu.Lock()
+	if c.closed {
+		t.mu.Unlock()
+		return nil
+	}
+	c.away = status == Away
+	c.lastSeen = t.now()
+	var msgs []broker.Message
+	if c.user != "" {
+		msgs = t.update(c.user, c.protocol, nil)
+	}
+	t.mu.Unlock()
+
+	t.publish(msgs)
+	return nil
+}
+
+// Typing starts or stops the typing indicator of the user in room. Only the
+// first start is announced; repeating it while typing keeps the indicator
+// alive for another TypingTimeout. Connections that are not identified or
+// not in room are ignored.
+func (c *Conn) Typing(room string, typing bool) {
+	if c.disabled() {
+		return
+	}
+	t := c.tracker
+	t.mu.Lock()
+	if c.user == "" || !c.rooms[room] {
+		t.mu.Unlock()
+		return
+	}
+	key := typingKey{c.user, room}
+	var msgs []broker.Message
+	if typing {
+		msgs = t.startTyping(key, c.protocol)
+	} else {
+		msgs = t.stopTyping(key, c.protocol)
+	}
+	t.mu.Unlock()
+
+	t.publish(msgs)
+}
+
+// Close stops tracking the connection. Its user goes offline when it was
+// their last connection.
+func (c *Conn) Close() {
+	if c.disabled() {
+		return
+	}
+	t := c.tracker
+	t.mu.Lock()
+	if c.closed {
+		t.mu.Unlock()
+		return
+	}
+	c.closed = true
+	rooms := c.rooms
+	c.rooms = make(map[string]bool)
+
+	var msgs []broker.Message
+	if c.user != "" {
+		delete(t.users[c.user].conns, c)
+		for room := range rooms {
+			if !t.inRoom(c.user, room) {
+				msgs = append(msgs, t.stopTyping(typingKey{c.user, room}, c.protocol)...)
+			}
+		}
+		msgs = append(msgs, t.update(c.user, c.protocol, rooms)...)
+	}
+	t.mu.Unlock()
+
+	t.publish(msgs)
+}
+
+// Status returns the presence of a user.
+func (t *Tracker) Status(name string) Status {
+	if t == nil {
+		return Offline
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u := t.users[name]
+	if u == nil {
+		return Offline
+	}
+	return t.status(u)
+}
+
+// Members returns the users with a connection in room, sorted by name.
+func (t *Tracker) Members(room string) []Member {
+	members := []Member{}
+	if t == nil {
+		return members
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for name, u := range t.users {
+		for c := range u.conns {
+			if c.rooms[room] {
+				_, typing := t.typing[typingKey{name, room}]
+				members = append(members, Member{User: name, Status: t.status(u), Typing: typing})
+				break
+			}
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].User < members[j].User })
+	return members
+}
+
+// Watch announces the users whose connections went silent, checking every
+// interval until ctx is done.
+func (t *Tracker) Watch(ctx context.Context, interval time.Duration) {
+	if t == nil {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.sweep()
+		}
+	}
+}
+
+// sweep announces every user whose status changed because time passed.
+func (t *Tracker) sweep() {
+	t.mu.Lock()
+	var msgs []broker.Message
+	for name := range t.users {
+		msgs = append(msgs, t.update(name, "", nil)...)
+	}
+	t.mu.Unlock()
+
+	t.publish(msgs)
+}
+
+// status computes the presence of u from its live connections. The caller
+// holds the lock.
+func (t *Tracker) status(u *user) Status {
+	now := t.now()
+	status := Offline
+	for c := range u.conns {
+		if !c.kept && now.Sub(c.lastSeen) >= t.opts.Timeout {
+			continue
+		}
+		if !c.away {
+			return Online
+		}
+		status = Away
+	}
+	return status
+}
+
+// update returns the presence messages announcing a change of the status
+// of a user to their rooms and to extra rooms they just left. Users without
+// connections are forgotten. The caller holds the lock.
+func (t *Tracker) update(name, source string, extra map[string]bool) []broker.Message {
+	u := t.users[name]
+	status := t.status(u)
+	if len(u.conns) == 0 {
+		delete(t.users, name)
+	}
+	if status == u.status {
+		return nil
+	}
+	u.status = status
+
+	rooms := make(map[string]bool, len(extra))
+	for room := range extra {
+		rooms[room] = true
+	}
+	for c := range u.conns {
+		for room := range c.rooms {
+			rooms[room] = true
+		}
+	}
+	msgs := make([]broker.Message, 0, len(rooms))
+	for room := range rooms {
+		msgs = append(msgs, newMessage(PresenceType, name, room, string(status), source))
+	}
+	return msgs
+}
+
+// inRoom reports whether a connection of the user is in room. The caller
+// holds the lock.
+func (t *Tracker) inRoom(name, room string) bool {
+	u := t.users[name]
+	if u == nil {
+		return false
+	}
+	for c := range u.conns {
+		if c.rooms[room] {
+			return true
+		}
+	}
+	return false
+}
+
+// startTyping starts or extends a typing indicator. The caller holds the
+// lock.
+func (t *Tracker) startTyping(key typingKey, source string) []broker.Message {
+	old, typing := t.typing[key]
+	if typing {
+		old.timer.Stop()
+	}
+	current := &typist{}
+	current.timer = time.AfterFunc(t.opts.TypingTimeout, func() { t.expireTyping(key, current, source) })
+	t.typing[key] = current
+
+	if typing {
+		return nil
+	}
+	return []broker.Message{newMessage(TypingType, key.user, key.room, TypingStarted, source)}
+}
+
+// stopTyping ends a typing indicator if it is running. The caller holds the
+// lock.
+func (t *Tracker) stopTyping(key typingKey, source string) []broker.Message {
+	current, typing := t.typing[key]
+	if !typing {
+		return nil
+	}
+	current.timer.Stop()
+	delete(t.typing, key)
+	return []broker.Message{newMessage(TypingType, key.user, key.room, TypingStopped, source)}
+}
+
+// expireTyping ends an indicator that was not repeated in time, unless it
+// was stopped or restarted meanwhile.
+func (t *Tracker) expireTyping(key typingKey, expired *typist, source string) {
+	t.mu.Lock()
+	var msgs []broker.Message
+	if t.typing[key] == expired {
+		msgs = t.stopTyping(key, source)
+	}
+	t.mu.Unlock()
+
+	t.publish(msgs)
+}
+
+// publish hands presence messages to the broker. It is called without the
+// lock, since a broker may block.
+func (t *Tracker) publish(msgs []broker.Message) {
+	for _, msg := range msgs {
+		err := t.broker.Publish(msg)
+		if errors.Is(err, broker.ErrClosed) {
+			// The servers are shutting down
+			return
+		}
+		if err != nil {
+			// Presence is best effort, the roster stays right
+			slog.Warn("Publishing presence failed", "type", msg.Type, logger.UserKey, msg.User, logger.RoomKey, msg.Room, "err", err)
+			return
+		}
+	}
+}
+
+func newMessage(msgType, name, room, text, source string) broker.Message {
+	return broker.Message{
+		ID:        fmt.Sprintf("msg_%d_%d", time.Now().UnixNano(), rand.Int63()),
+		User:      name,
+		Message:   text,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Room:      room,
+		Type:      msgType,
+		Source:    source,
+	}
+}
@@ -0,0 +1,244 @@
+package presence
+
+import (
+	"testing"
+	"time"
+
+	"elearning-5/internal/broker"
+)
+
+// clock is a fake time source advanced by tests.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newTestTracker(t *testing.T, opts Options) (*Tracker, *clock, broker.Subscription) {
+	t.Helper()
+	b := broker.NewMemoryBroker()
+	sub, err := b.Subscribe()
+	if err != nil {
+		t.Fatalf("subscribe: %v", err)
+	}
+	t.Cleanup(func() { b.Close() })
+
+	tracker := New(b, opts)
+	c := &clock{t: time.Unix(1000, 0)}
+	tracker.now = c.now
+	return tracker, c, sub
+}
+
+// expect reads the next broker message and checks it.
+func expect(t *testing.T, sub broker.Subscription, msgType, user, room, text string) {
+	t.Helper()
+	select {
+	case msg := <-sub.Messages():
+		if msg.Type != msgType || msg.User != user || msg.Room != room || msg.Message != text {
+			t.Fatalf("got %s %q from %s in %s, want %s %q from %s in %s",
+				msg.Type, msg.Message, msg.User, msg.Room, msgType, text, user, room)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no %s %q from %s in %s", msgType, text, user, room)
+	}
+}
+
+func expectNothing(t *testing.T, sub broker.Subscription) {
+	t.Helper()
+	select {
+	case msg := <-sub.Messages():
+		t.Fatalf("unexpected %s %q from %s in %s", msg.Type, msg.Message, msg.User, msg.Room)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestStatusSpansConnections(t *testing.T) {
+	tracker, _, sub := newTestTracker(t, Options{})
+
+	web := tracker.Connect("websocket")
+	web.Identify("alice")
+	web.Join("room1")
+	expect(t, sub, PresenceType, "alice", "room1", string(Online))
+	mobile := tracker.Connect("grpc")
+	mobile.Identify("alice")
+	mobile.Join("room2")
+	expect(t, sub, PresenceType, "alice", "room2", string(Online))
+	// A room the user is already in hears nothing new
+	mobile.Join("room1")
+	expectNothing(t, sub)
+	mobile.Leave("room1")
+	if got := tracker.Status("alice"); got != Online {
+		t.Fatalf("Status = %s, want online", got)
+	}
+
+	// One connection away leaves the user online
+	if err := web.SetStatus(Away); err != nil {
+		t.Fatal(err)
+	}
+	expectNothing(t, sub)
+
+	mobile.SetStatus(Away)
+	if got := tracker.Status("alice"); got != Away {
+		t.Fatalf("Status = %s, want away", got)
+	}
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		msg := <-sub.Messages()
+		if msg.Type != PresenceType || msg.Message != string(Away) {
+			t.Fatalf("got %s %q, want away", msg.Type, msg.Message)
+		}
+		got[msg.Room] = true
+	}
+	if !got["room1"] || !got["room2"] {
+		t.Errorf("away announced to %v, want room1 and room2", got)
+	}
+
+	if err := web.SetStatus("busy"); err == nil {
+		t.Error("SetStatus(busy) succeeded")
+	}
+
+	web.Close()
+	expectNothing(t, sub)
+	mobile.Close()
+	expect(t, sub, PresenceType, "alice", "room2", string(Offline))
+	if got := tracker.Status("alice"); got != Offline {
+		t.Errorf("Status after closing = %s, want offline", got)
+	}
+}
+
+func TestSilentConnectionsGoOffline(t *testing.T) {
+	tracker, clk, sub := newTestTracker(t, Options{Timeout: time.Minute})
+
+	conn := tracker.Connect("signalr")
+	conn.Identify("alice")
+	conn.Join("room1")
+	expect(t, sub, PresenceType, "alice", "room1", string(Online))
+
+	clk.t = clk.t.Add(30 * time.Second)
+	conn.Heartbeat()
+	clk.t = clk.t.Add(59 * time.Second)
+	tracker.sweep()
+	expectNothing(t, sub)
+
+	clk.t = clk.t.Add(time.Second)
+	tracker.sweep()
+	expect(t, sub, PresenceType, "alice", "room1", string(Offline))
+	if members := tracker.Members("room1"); len(members) != 1 || members[0].Status != Offline {
+		t.Errorf("Members = %v, want alice offline", members)
+	}
+
+	conn.Heartbeat()
+	expect(t, sub, PresenceType, "alice", "room1", string(Online))
+}
+
+func TestKeptConnectionsStayOnline(t *testing.T) {
+	tracker, clk, sub := newTestTracker(t, Options{Timeout: time.Minute})
+
+	conn := tracker.Connect("grpc")
+	conn.Identify("alice")
+	conn.Join("room1")
+	expect(t, sub, PresenceType, "alice", "room1", string(Online))
+
+	// A silent connection that went offline comes back when kept alive
+	clk.t = clk.t.Add(time.Minute)
+	tracker.sweep()
+	expect(t, sub, PresenceType, "alice", "room1", string(Offline))
+	conn.KeepAlive()
+	expect(t, sub, PresenceType, "alice", "room1", string(Online))
+
+	clk.t = clk.t.Add(time.Hour)
+	tracker.sweep()
+	expectNothing(t, sub)
+	if got := tracker.Status("alice"); got != Online {
+		t.Errorf("Status = %s, want online", got)
+	}
+
+	// Away is still up to the client
+	conn.SetStatus(Away)
+	expect(t, sub, PresenceType, "alice", "room1", string(Away))
+	conn.Close()
+	expect(t, sub, PresenceType, "alice", "room1", string(Offline))
+}
+
+func TestTypingIsDebounced(t *testing.T) {
+	tracker, _, sub := newTestTracker(t, Options{TypingTimeout: 100 * time.Millisecond})
+
+	conn := tracker.Connect("websocket")
+	conn.Identify("alice")
+	conn.Typing("room1", true) // not in room1
+	expectNothing(t, sub)
+
+	conn.Join("room1")
+	expect(t, sub, PresenceType, "alice", "room1", string(Online))
+	conn.Typing("room1", true)
+	conn.Typing("room1", true)
+	expect(t, sub, TypingType, "alice", "room1", TypingStarted)
+	expectNothing(t, sub)
+	if members := tracker.Members("room1"); len(members) != 1 || !members[0].Typing {
+		t.Errorf("Members = %v, want alice typing", members)
+	}
+
+	conn.Typing("room1", false)
+	expect(t, sub, TypingType, "alice", "room1", TypingStopped)
+	conn.Typing("room1", false)
+	expectNothing(t, sub)
+
+	// An indicator that is not repeated runs out
+	conn.Typing("room1", true)
+	expect(t, sub, TypingType, "alice", "room1", TypingStarted)
+	expect(t, sub, TypingType, "alice", "room1", TypingStopped)
+
+	// Leaving the room stops it too
+	conn.Typing("room1", true)
+	expect(t, sub, TypingType, "alice", "room1", TypingStarted)
+	conn.Leave("room1")
+	expect(t, sub, TypingType, "alice", "room1", TypingStopped)
+}
+
+func TestMembers(t *testing.T) {
+	tracker, _, _ := newTestTracker(t, Options{})
+
+	for _, name := range []string{"carol", "alice", "bob"} {
+		conn := tracker.Connect("grpc")
+		conn.Identify(name)
+		conn.Join("room1")
+		if name == "bob" {
+			conn.SetStatus(Away)
+		}
+	}
+	// Connections count once their user is known
+	tracker.Connect("websocket").Join("room1")
+	second := tracker.Connect("websocket")
+	second.Identify("alice")
+	second.Join("room1")
+
+	want := []Member{{User: "alice", Status: Online}, {User: "bob", Status: Away}, {User: "carol", Status: Online}}
+	got := tracker.Members("room1")
+	if len(got) != len(want) {
+		t.Fatalf("Members = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("member %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+	if got := tracker.Members("room2"); got == nil || len(got) != 0 {
+		t.Errorf("Members of an empty room = %#v, want an empty list", got)
+	}
+}
+
+func TestNilTrackerTracksNothing(t *testing.T) {
+	var tracker *Tracker
+
+	conn := tracker.Connect("websocket")
+	conn.Identify("alice")
+	conn.Join("room1")
+	conn.Heartbeat()
+	conn.KeepAlive()
+	conn.Typing("room1", true)
+	conn.Close()
+	if err := conn.SetStatus("busy"); err == nil {
+		t.Error("SetStatus(busy) succeeded")
+	}
+	if conn.User() != "" || tracker.Status("alice") != Offline || len(tracker.Members("room1")) != 0 {
+		t.Error("nil tracker tracked a connection")
+	}
+}
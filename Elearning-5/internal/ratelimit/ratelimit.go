@@ -0,0 +1,273 @@
+// Package ratelimit throttles the messages clients post with token buckets
+// per connection, per user and per room, and tells the protocols when a
+// client keeps exceeding its limits and should be disconnected.
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Rate is a token bucket refilled with PerSecond tokens up to Burst. A zero
+// Rate does not limit.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+func (r Rate) unlimited() bool {
+	return r.PerSecond <= 0
+}
+
+// Limits configures a Limiter. A client is disconnected after Strikes
+// rejected messages within StrikeWindow; zero Strikes never disconnects.
+type Limits struct {
+	PerConnection Rate
+	PerUser       Rate
+	PerRoom       Rate
+
+	Strikes      int
+	StrikeWindow time.Duration
+}
+
+// DefaultStrikeWindow is used when Limits.StrikeWindow is zero.
+const DefaultStrikeWindow = time.Minute
+
+// Scope is the limit a message exceeded.
+type Scope string
+
+const (
+	Connection Scope = "connection"
+	User       Scope = "user"
+	Room       Scope = "room"
+)
+
+// Code is the error code clients see for a rejected message.
+const Code = "rate_limited"
+
+// Error is returned for a message that exceeds a limit.
+type Error struct {
+	Scope      Scope
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: too many messages per %s, retry in %s", Code, e.Scope, e.RetryAfter.Round(time.Millisecond))
+}
+
+// Limiter holds the buckets shared by all connections of a server. A nil
+// Limiter allows everything.
+type Limiter struct {
+	limits Limits
+	users  *keyed
+	rooms  *keyed
+	peers  *keyed // connections without state of their own, such as unary RPCs
+	now    func() time.Time
+}
+
+func New(limits Limits) *Limiter {
+	if limits.StrikeWindow <= 0 {
+		limits.StrikeWindow = DefaultStrikeWindow
+	}
+	return &Limiter{
+		limits: limits,
+		users:  newKeyed(limits.PerUser),
+		rooms:  newKeyed(limits.PerRoom),
+		peers:  newKeyed(limits.PerConnection),
+		now:    time.Now,
+	}
+}
+
+// Conn is the limit state of one connection. It is safe for concurrent use.
+type Conn struct {
+	limiter *Limiter
+	key     string // peer key for Limiter.Peer, empty for NewConn
+
+	mu          sync.Mutex
+	bucket      bucket
+	strikes     int
+	windowStart time.Time
+}
+
+// NewConn returns the state of a new connection with its own bucket.
+func (l *Limiter) NewConn() *Conn {
+	return &Conn{limiter: l}
+}
+
+// Peer returns the state of a connection identified by key, such as the
+// remote address of unary RPCs, whose bucket is kept by the Limiter. Strikes
+// are not tracked across calls.
+func (l *Limiter) Peer(key string) *Conn {
+	return &Conn{limiter: l, key: key}
+}
+
+// Allow takes a token for a message of user to room from every bucket that
+// applies. Anonymous users have no per-user bucket. It returns an *Error for
+// a message over a limit, which takes no token from any bucket.
+func (c *Conn) Allow(user, room string) error {
+	if c == nil || c.limiter == nil {
+		return nil
+	}
+	l := c.limiter
+	now := l.now()
+
+	// Hold every bucket while checking them all, so that a message refused
+	// by one limit does not use up the others
+	held := []hold{c.holdConn(now)}
+	if user != "" {
+		held = append(held, l.users.hold(User, user, now))
+	}
+	held = append(held, l.rooms.hold(Room, room, now))
+	err := takeAll(held, now)
+	for i := len(held) - 1; i >= 0; i-- {
+		held[i].release()
+	}
+
+	if err != nil {
+		return c.strike(now, err)
+	}
+	return nil
+}
+
+// holdConn holds the connection's bucket, kept by the Limiter for a peer.
+func (c *Conn) holdConn(now time.Time) hold {
+	if c.key != "" {
+		return c.limiter.peers.hold(Connection, c.key, now)
+	}
+	rate := c.limiter.limits.PerConnection
+	if rate.unlimited() {
+		return hold{}
+	}
+	c.mu.Lock()
+	return hold{scope: Connection, rate: rate, bucket: &c.bucket, unlock: c.mu.Unlock}
+}
+
+// hold is a bucket locked for a message. A hold without a bucket does not
+// limit.
+type hold struct {
+	scope  Scope
+	rate   Rate
+	bucket *bucket
+	unlock func()
+}
+
+func (h hold) release() {
+	if h.unlock != nil {
+		h.unlock()
+	}
+}
+
+// takeAll takes a token from every held bucket if each has one. Otherwise
+// it takes none and returns the first limit exceeded.
+func takeAll(held []hold, now time.Time) *Error {
+	for _, h := range held {
+		if h.bucket == nil {
+			continue
+		}
+		if wait, ok := h.bucket.available(h.rate, now); !ok {
+			return &Error{Scope: h.scope, RetryAfter: wait}
+		}
+	}
+	for _, h := range held {
+		if h.bucket != nil {
+			h.bucket.tokens--
+		}
+	}
+	return nil
+}
+
+// strike records a rejected message and returns err.
+func (c *Conn) strike(now time.Time, err *Error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if now.Sub(c.windowStart) > c.limiter.limits.StrikeWindow {
+		c.windowStart, c.strikes = now, 0
+	}
+	c.strikes++
+	return err
+}
+
+// Exceeded reports whether the connection was rejected often enough within
+// the strike window to be disconnected.
+func (c *Conn) Exceeded() bool {
+	if c == nil || c.limiter == nil || c.limiter.limits.Strikes <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.strikes >= c.limiter.limits.Strikes
+}
+
+// bucket is a token bucket. The zero value is full.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// available refills the bucket up to now and reports whether it holds a
+// token, otherwise how long until it does.
+func (b *bucket) available(r Rate, now time.Time) (time.Duration, bool) {
+	burst := math.Max(float64(r.Burst), 1)
+
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*r.PerSecond)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / r.PerSecond * float64(time.Second)), false
+	}
+	return 0, true
+}
+
+// full reports whether the bucket would be full at now, so that dropping it
+// loses nothing.
+func (b *bucket) full(r Rate, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*r.PerSecond >= math.Max(float64(r.Burst), 1)
+}
+
+// keyed holds a bucket per key. Buckets that have refilled are dropped
+// periodically so that the map does not grow with every user and room ever
+// seen.
+type keyed struct {
+	rate      Rate
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+const sweepInterval = time.Minute
+
+func newKeyed(rate Rate) *keyed {
+	return &keyed{rate: rate, buckets: make(map[string]*bucket)}
+}
+
+// hold locks k and returns the bucket of key, which limits scope. The
+// caller releases it.
+func (k *keyed) hold(scope Scope, key string, now time.Time) hold {
+	if k.rate.unlimited() {
+		return hold{}
+	}
+
+	k.mu.Lock()
+	if now.Sub(k.lastSweep) > sweepInterval {
+		for key, b := range k.buckets {
+			if b.full(k.rate, now) {
+				delete(k.buckets, key)
+			}
+		}
+		k.lastSweep = now
+	}
+
+	b := k.buckets[key]
+	if b == nil {
+		b = &bucket{}
+		k.buckets[key] = b
+	}
+	return hold{scope: scope, rate: k.rate, bucket: b, unlock: k.mu.Unlock}
+}
@@ -0,0 +1,162 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// clock is a fake time source advanced by tests.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newTestLimiter(limits Limits) (*Limiter, *clock) {
+	l := New(limits)
+	c := &clock{t: time.Unix(1000, 0)}
+	l.now = c.now
+	return l, c
+}
+
+func scope(err error) Scope {
+	var limited *Error
+	if errors.As(err, &limited) {
+		return limited.Scope
+	}
+	return ""
+}
+
+func TestConnectionBucketRefills(t *testing.T) {
+	l, clk := newTestLimiter(Limits{PerConnection: Rate{PerSecond: 2, Burst: 3}})
+	conn := l.NewConn()
+
+	for i := 0; i < 3; i++ {
+		if err := conn.Allow("alice", "room1"); err != nil {
+			t.Fatalf("message %d within burst: %v", i, err)
+		}
+	}
+	err := conn.Allow("alice", "room1")
+	if scope(err) != Connection {
+		t.Fatalf("message over burst: %v, want connection limit", err)
+	}
+	if limited := err.(*Error); limited.RetryAfter != 500*time.Millisecond {
+		t.Errorf("RetryAfter = %v, want 500ms", limited.RetryAfter)
+	}
+
+	clk.t = clk.t.Add(500 * time.Millisecond)
+	if err := conn.Allow("alice", "room1"); err != nil {
+		t.Errorf("message after refill: %v", err)
+	}
+
+	// Other connections have their own bucket
+	if err := l.NewConn().Allow("alice", "room1"); err != nil {
+		t.Errorf("message on another connection: %v", err)
+	}
+}
+
+func TestUserAndRoomBucketsAreShared(t *testing.T) {
+	l, _ := newTestLimiter(Limits{PerUser: Rate{PerSecond: 1, Burst: 1}, PerRoom: Rate{PerSecond: 1, Burst: 2}})
+
+	if err := l.NewConn().Allow("alice", "room1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.NewConn().Allow("alice", "room2"); scope(err) != User {
+		t.Errorf("second message of alice: %v, want user limit", err)
+	}
+	if err := l.NewConn().Allow("bob", "room1"); err != nil {
+		t.Errorf("first message of bob: %v", err)
+	}
+	if err := l.NewConn().Allow("carol", "room1"); scope(err) != Room {
+		t.Errorf("third message to room1: %v, want room limit", err)
+	}
+	// Anonymous users only share the room bucket
+	if err := l.NewConn().Allow("", "room3"); err != nil {
+		t.Errorf("anonymous message: %v", err)
+	}
+}
+
+func TestRefusedMessageTakesNoToken(t *testing.T) {
+	l, _ := newTestLimiter(Limits{
+		PerConnection: Rate{PerSecond: 1, Burst: 2},
+		PerUser:       Rate{PerSecond: 1, Burst: 2},
+		PerRoom:       Rate{PerSecond: 1, Burst: 1},
+	})
+	conn := l.NewConn()
+
+	if err := conn.Allow("alice", "room1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Allow("alice", "room1"); scope(err) != Room {
+		t.Fatalf("second message to room1: %v, want room limit", err)
+	}
+	// The refused message left the connection and user buckets alone
+	if err := conn.Allow("alice", "room2"); err != nil {
+		t.Errorf("message to room2: %v", err)
+	}
+	if err := l.NewConn().Allow("alice", "room3"); scope(err) != User {
+		t.Errorf("third message of alice: %v, want user limit", err)
+	}
+}
+
+func TestPeerBucketIsKeptAcrossCalls(t *testing.T) {
+	l, _ := newTestLimiter(Limits{PerConnection: Rate{PerSecond: 1, Burst: 1}})
+	if err := l.Peer("10.0.0.1").Allow("", "room1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Peer("10.0.0.1").Allow("", "room1"); scope(err) != Connection {
+		t.Errorf("second call of the peer: %v, want connection limit", err)
+	}
+	if err := l.Peer("10.0.0.2").Allow("", "room1"); err != nil {
+		t.Errorf("call of another peer: %v", err)
+	}
+}
+
+func TestStrikes(t *testing.T) {
+	l, clk := newTestLimiter(Limits{PerConnection: Rate{PerSecond: 1, Burst: 1}, Strikes: 3, StrikeWindow: time.Minute})
+	conn := l.NewConn()
+
+	conn.Allow("alice", "room1")
+	conn.Allow("alice", "room1")
+	conn.Allow("alice", "room1")
+	if conn.Exceeded() {
+		t.Fatal("exceeded after two strikes")
+	}
+
+	// Strikes expire with the window
+	clk.t = clk.t.Add(2 * time.Minute)
+	conn.Allow("alice", "room1")
+	conn.Allow("alice", "room1")
+	conn.Allow("alice", "room1")
+	if conn.Exceeded() {
+		t.Fatal("exceeded after strikes of an old window")
+	}
+	conn.Allow("alice", "room1")
+	if !conn.Exceeded() {
+		t.Error("not exceeded after three strikes in the window")
+	}
+}
+
+func TestNilLimiterAllowsEverything(t *testing.T) {
+	var l *Limiter
+	conn := l.NewConn()
+	for i := 0; i < 100; i++ {
+		if err := conn.Allow("alice", "room1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conn.Exceeded() {
+		t.Error("nil limiter exceeded")
+	}
+}
+
+func TestKeyedSweepsFullBuckets(t *testing.T) {
+	l, clk := newTestLimiter(Limits{PerRoom: Rate{PerSecond: 1, Burst: 1}})
+	for _, room := range []string{"a", "b", "c"} {
+		l.NewConn().Allow("", room)
+	}
+	clk.t = clk.t.Add(2 * sweepInterval)
+	l.NewConn().Allow("", "d")
+	if n := len(l.rooms.buckets); n != 1 {
+		t.Errorf("%d buckets after sweep, want 1", n)
+	}
+}
@@ -0,0 +1,228 @@
+package signalr
+
+import (
+	"errors"
+	"time"
+
+	"elearning-5/internal/broker"
+	"elearning-5/internal/metrics"
+	"elearning-5/internal/policy"
+	"elearning-5/internal/presence"
+	"elearning-5/internal/store"
+	"elearning-5/internal/tracing"
+	"elearning-5/pkg/logger"
+)
+
+// ChatHub provides the chat methods every SignalR client can invoke.
+type ChatHub struct{}
+
+// historyPage is the GetHistory result, named like the other hub protocol
+// fields.
+type historyPage struct {
+	Messages   []broker.Message `json:"messages"`
+	NextBefore string           `json:"nextBefore,omitempty"`
+}
+
+// JoinGroup subscribes the caller to the messages of a room. Rooms the
+// policy closes to the caller fail with an error starting with the policy
+// code, such as "not_invited: ...".
+func (ChatHub) JoinGroup(ctx *HubContext, group string) (string, error) {
+	if group == "" {
+		return "", errors.New("group is required")
+	}
+	if err := ctx.Hub.policy.Authorize(ctx.User, group, policy.Join); err != nil {
+		return "", err
+	}
+
+	if !ctx.Hub.AddToGroup(ctx.ConnectionID, group) {
+		return "", errConnectionClosed
+	}
+	return "Joined group: " + group, nil
+}
+
+// ResumeGroup joins a room again after a reconnect. The caller first
+// receives the messages after sequence number lastSeq, the last one it got.
+// When too much was missed it stays out of the room and has to reload the
+// history with GetHistory before resuming from the newest message.
+func (ChatHub) ResumeGroup(ctx *HubContext, group string, lastSeq uint64) (string, error) {
+	if group == "" {
+		return "", errors.New("group is required")
+	}
+	if err := ctx.Hub.policy.Authorize(ctx.User, group, policy.Join); err != nil {
+		return "", err
+	}
+
+	err := ctx.Hub.ResumeGroup(ctx.ConnectionID, group, lastSeq)
+	if err != nil && !errors.Is(err, store.ErrGapTooLarge) && !errors.Is(err, errConnectionClosed) {
+		ctx.Logger().Error("Resuming group failed", logger.RoomKey, group, "err", err)
+		return "", errors.New("history is unavailable")
+	}
+	if err != nil {
+		return "", err
+	}
+	return "Resumed group: " + group, nil
+}
+
+// LeaveGroup unsubscribes the caller from a room.
+func (ChatHub) LeaveGroup(ctx *HubContext, group string) string {
+	ctx.Hub.RemoveFromGroup(ctx.ConnectionID, group)
+	return "Left group: " + group
+}
+
+// GetGroupMembers lists the connection IDs in a room. Like the room's
+// history, they are only listed to callers the policy lets join it.
+func (ChatHub) GetGroupMembers(ctx *HubContext, group string) ([]string, error) {
+	if group == "" {
+		return nil, errors.New("group is required")
+	}
+	if err := ctx.Hub.policy.Authorize(ctx.User, group, policy.Join); err != nil {
+		return nil, err
+	}
+	return ctx.Hub.GroupMembers(group), nil
+}
+
+// GetHistory returns the newest messages of a room, or those older than the
+// before cursor. The nextBefore of the result is the cursor of the previous
+// page.
+func (ChatHub) GetHistory(ctx *HubContext, room, before string, limit int) (historyPage, error) {
+	if room == "" {
+		return historyPage{}, errors.New("room is required")
+	}
+	if err := ctx.Hub.policy.Authorize(ctx.User, room, policy.Join); err != nil {
+		return historyPage{}, err
+	}
+
+	page, err := store.History(ctx.Hub.store, room, before, limit)
+	if errors.Is(err, store.ErrNotFound) {
+		return historyPage{}, errors.New("unknown cursor " + before)
+	}
+	if err != nil {
+		ctx.Logger().Error("Loading history failed", logger.RoomKey, room, "err", err)
+		return historyPage{}, errors.New("history is unavailable")
+	}
+	return historyPage{Messages: page.Messages, NextBefore: page.NextBefore}, nil
+}
+
+// SendMessage publishes a chat message to a room on every protocol. The user
+// argument is ignored for an authenticated caller, whose token names them.
+// The caller does not have to be in the room's group: like the gRPC
+// SendMessage, who may post where is decided by the policy alone.
+func (ChatHub) SendMessage(ctx *HubContext, user, message, room string) error {
+	if ctx.User != "" {
+		user = ctx.User
+	}
+	if user == "" || message == "" {
+		return errors.New("user and message are required")
+	}
+	_, span := tracing.Child(ctx.Context(), tracing.AuthorizeSpan, tracing.UserKey.String(user), tracing.RoomKey.String(room))
+	err := ctx.Hub.policy.Authorize(user, room, policy.Send)
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	if err := ctx.allow(user, room); err != nil {
+		return err
+	}
+	ctx.Hub.Identify(ctx.ConnectionID, user)
+	ctx.presence.Identify(user)
+
+	chatMsg := broker.Message{
+		ID:        generateMessageID(),
+		User:      user,
+		Message:   message,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Room:      room,
+		Type:      "message",
+	}
+	if err := ctx.Hub.Publish(ctx.Context(), chatMsg); err != nil {
+		ctx.Logger().Error("Publishing message failed", logger.RoomKey, room, "err", err)
+		return errors.New("message could not be delivered")
+	}
+	ctx.presence.Typing(room, false)
+	ctx.Logger().Debug("Message published", logger.RoomKey, room, "id", chatMsg.ID, logger.Body(message))
+	return nil
+}
+
+// SendDirectMessage sends a private message to every connection of the user
+// to, on every protocol, and to the other connections of the sender. Both
+// receive it through ReceiveDirectMessage; it is kept in the history of
+// their conversation room, which only they may read. The user argument is
+// ignored for an authenticated caller.
+func (ChatHub) SendDirectMessage(ctx *HubContext, user, to, message string) error {
+	if ctx.User != "" {
+		user = ctx.User
+	}
+	if user == "" || message == "" {
+		return errors.New("user and message are required")
+	}
+	if to == "" || to == user {
+		return errors.New("a direct message needs a recipient other than the sender")
+	}
+	room := policy.DirectRoom(user, to)
+	if err := ctx.allow(user, room); err != nil {
+		return err
+	}
+	ctx.Hub.Identify(ctx.ConnectionID, user)
+	ctx.presence.Identify(user)
+
+	chatMsg := broker.Message{
+		ID:        generateMessageID(),
+		User:      user,
+		Message:   message,
+		Timestamp: time.Now().Format(time.RFC3339),
+		Room:      room,
+		Type:      "direct",
+		To:        to,
+	}
+	if err := ctx.Hub.Publish(ctx.Context(), chatMsg); err != nil {
+		ctx.Logger().Error("Publishing direct message failed", "to", to, "err", err)
+		return errors.New("message could not be delivered")
+	}
+	ctx.Logger().Debug("Direct message published", "to", to, "id", chatMsg.ID, logger.Body(message))
+	return nil
+}
+
+// SendTyping starts or stops the caller's typing indicator in a room it
+// joined. Clients repeat typing = true while the user types; the others in
+// the room receive ReceiveTyping when it starts and when it stops.
+func (ChatHub) SendTyping(ctx *HubContext, room string, typing bool) error {
+	if !contains(ctx.Hub.Groups(ctx.ConnectionID), room) {
+		return errors.New("join room " + room + " before typing in it")
+	}
+	if err := ctx.allow(ctx.presence.User(), room); err != nil {
+		return err
+	}
+	ctx.presence.Typing(room, typing)
+	return nil
+}
+
+// SetPresence sets the status of the calling connection, online or away.
+// The rooms of the caller receive ReceivePresence when the status of the
+// user changes.
+func (ChatHub) SetPresence(ctx *HubContext, status string) error {
+	return ctx.presence.SetStatus(presence.Status(status))
+}
+
+// GetRoomMembers returns the users in a room on every protocol with their
+// presence.
+func (ChatHub) GetRoomMembers(ctx *HubContext, room string) ([]presence.Member, error) {
+	if room == "" {
+		return nil, errors.New("room is required")
+	}
+	if err := ctx.Hub.policy.Authorize(ctx.User, room, policy.Join); err != nil {
+		return nil, err
+	}
+	return ctx.Hub.presence.Members(room), nil
+}
+
+// allow takes a rate limit token for an invocation of user in room, and
+// disconnects a caller that keeps exceeding its limits.
+func (c *HubContext) allow(user, room string) error {
+	err := c.limit.Allow(user, room)
+	if err != nil && c.limit.Exceeded() {
+		c.Logger().Warn("Rate limit exceeded, disconnecting", logger.RoomKey, room)
+		c.Hub.metrics.Evicted(metrics.SignalR, metrics.RateLimited)
+		c.Hub.Disconnect(c.ConnectionID, "rate limit exceeded")
+	}
+	return err
+}
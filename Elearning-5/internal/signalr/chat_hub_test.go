@@ -0,0 +1,311 @@
+package signalr
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"elearning-5/internal/broker"
+	"elearning-5/internal/metrics"
+	"elearning-5/internal/policy"
+	"elearning-5/internal/presence"
+	"elearning-5/internal/ratelimit"
+	"elearning-5/internal/store"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestGetHistoryPaginates(t *testing.T) {
+	s, conn := newStreamTestServer(t)
+	for i := 0; i < 3; i++ {
+		err := s.hub.Publish(context.Background(), broker.Message{ID: fmt.Sprintf("m%d", i), User: "alice", Message: "hi", Room: "room1", Type: "message"})
+		if err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+
+	handle(t, s, conn, `{"type":1,"invocationId":"1","target":"GetHistory","arguments":["room1","",2]}`)
+	page := next(t, conn)["result"].(map[string]interface{})
+	if msgs := page["messages"].([]interface{}); len(msgs) != 2 || msgs[0].(map[string]interface{})["id"] != "m1" {
+		t.Fatalf("first page = %v, want m1 and m2", page)
+	}
+	if page["nextBefore"] != "m1" {
+		t.Fatalf("nextBefore = %v, want m1", page["nextBefore"])
+	}
+
+	handle(t, s, conn, `{"type":1,"invocationId":"2","target":"GetHistory","arguments":["room1","m1",2]}`)
+	page = next(t, conn)["result"].(map[string]interface{})
+	if msgs := page["messages"].([]interface{}); len(msgs) != 1 || msgs[0].(map[string]interface{})["id"] != "m0" {
+		t.Fatalf("second page = %v, want m0", page)
+	}
+	if _, ok := page["nextBefore"]; ok {
+		t.Errorf("last page has nextBefore %v", page["nextBefore"])
+	}
+
+	handle(t, s, conn, `{"type":1,"invocationId":"3","target":"GetHistory","arguments":["room1","missing",2]}`)
+	if msg := next(t, conn); msg["error"] == nil {
+		t.Errorf("unknown cursor completion = %v, want error", msg)
+	}
+}
+
+func TestResumeGroupSendsMissedMessagesOnce(t *testing.T) {
+	s, conn := newStreamTestServer(t)
+	for i := 0; i < 3; i++ {
+		err := s.hub.Publish(context.Background(), broker.Message{ID: fmt.Sprintf("m%d", i), User: "alice", Message: "hi", Room: "room1", Type: "message"})
+		if err != nil {
+			t.Fatalf("Publish: %v", err)
+		}
+	}
+
+	handle(t, s, conn, `{"type":1,"invocationId":"1","target":"ResumeGroup","arguments":["room1",1]}`)
+	for _, want := range []float64{2, 3} {
+		msg := next(t, conn)
+		args, _ := msg["arguments"].([]interface{})
+		if msg["target"] != "ReceiveMessage" || len(args) != 1 || args[0].(map[string]interface{})["seq"] != want {
+			t.Fatalf("message = %v, want ReceiveMessage with seq %v", msg, want)
+		}
+	}
+	if msg := next(t, conn); msg["type"] != float64(CompletionMessageType) || msg["error"] != nil {
+		t.Fatalf("completion = %v, want success", msg)
+	}
+
+	// The resumed messages may still be on their way from the broker
+	s.hub.deliver(broker.Message{ID: "m2", Room: "room1", Type: "message", Seq: 3})
+	s.hub.deliver(broker.Message{ID: "m3", Room: "room1", Type: "message", Seq: 4})
+	msg := next(t, conn)
+	if args := msg["arguments"].([]interface{}); args[0].(map[string]interface{})["id"] != "m3" {
+		t.Fatalf("live message = %v, want m3 only", msg)
+	}
+
+	handle(t, s, conn, `{"type":1,"invocationId":"2","target":"ResumeGroup","arguments":["room2",10]}`)
+	if msg := next(t, conn); msg["error"] != "gap too large, reload" {
+		t.Fatalf("completion = %v, want gap error", msg)
+	}
+	if groups := s.hub.Groups(conn.ID); len(groups) != 1 || groups[0] != "room1" {
+		t.Errorf("groups = %v, want only room1", groups)
+	}
+}
+
+func TestSendMessageActsAsAuthenticatedUser(t *testing.T) {
+	s, conn := newStreamTestServer(t)
+	conn.User = "alice"
+
+	handle(t, s, conn, `{"type":1,"invocationId":"1","target":"SendMessage","arguments":["mallory","hi","room1"]}`)
+	if msg := next(t, conn); msg["error"] != nil {
+		t.Fatalf("completion = %v, want success", msg)
+	}
+
+	msgs, err := s.hub.store.Range(store.Query{Room: "room1"})
+	if err != nil || len(msgs) != 1 || msgs[0].User != "alice" {
+		t.Fatalf("stored messages = %v, %v, want one from alice", msgs, err)
+	}
+}
+
+func TestJoinGroupFollowsRoomPolicy(t *testing.T) {
+	s, conn := newStreamTestServer(t)
+	s.hub.policy = policy.New()
+	s.hub.policy.SetRoom(policy.Room{Name: "staff", Kind: policy.Private, Members: map[string]policy.Role{"alice": policy.Member}})
+
+	conn.User = "bob"
+	handle(t, s, conn, `{"type":1,"invocationId":"1","target":"JoinGroup","arguments":["staff"]}`)
+	if msg := next(t, conn); !strings.HasPrefix(fmt.Sprint(msg["error"]), "not_invited:") {
+		t.Fatalf("completion = %v, want not_invited error", msg)
+	}
+	if groups := s.hub.Groups(conn.ID); len(groups) != 0 {
+		t.Errorf("groups = %v, want none", groups)
+	}
+
+	conn.User = "alice"
+	handle(t, s, conn, `{"type":1,"invocationId":"2","target":"JoinGroup","arguments":["staff"]}`)
+	if msg := next(t, conn); msg["error"] != nil {
+		t.Fatalf("completion = %v, want success", msg)
+	}
+}
+
+func TestGetGroupMembersFollowsRoomPolicy(t *testing.T) {
+	s, conn := newStreamTestServer(t)
+	s.hub.policy = policy.New()
+	s.hub.policy.SetRoom(policy.Room{Name: "staff", Kind: policy.Private, Members: map[string]policy.Role{"alice": policy.Member}})
+	s.hub.AddToGroup(conn.ID, "staff")
+
+	conn.User = "bob"
+	handle(t, s, conn, `{"type":1,"invocationId":"1","target":"GetGroupMembers","arguments":["staff"]}`)
+	if msg := next(t, conn); !strings.HasPrefix(fmt.Sprint(msg["error"]), "not_invited:") || msg["result"] != nil {
+		t.Fatalf("completion = %v, want not_invited error", msg)
+	}
+
+	conn.User = "alice"
+	handle(t, s, conn, `{"type":1,"invocationId":"2","target":"GetGroupMembers","arguments":["staff"]}`)
+	if msg := next(t, conn); fmt.Sprint(msg["result"]) != "["+conn.ID+"]" {
+		t.Fatalf("completion = %v, want the connection of alice", msg)
+	}
+}
+
+func TestSendMessageIsRateLimited(t *testing.T) {
+	s, conn := newStreamTestServer(t)
+	conn.limit = ratelimit.New(ratelimit.Limits{
+		PerConnection: ratelimit.Rate{PerSecond: 0.01, Burst: 1},
+		Strikes:       2,
+	}).NewConn()
+
+	handle(t, s, conn, `{"type":1,"invocationId":"1","target":"SendMessage","arguments":["alice","one","room1"]}`)
+	if msg := next(t, conn); msg["error"] != nil {
+		t.Fatalf("completion = %v, want success", msg)
+	}
+	handle(t, s, conn, `{"type":1,"invocationId":"2","target":"SendMessage","arguments":["alice","two","room1"]}`)
+	if msg := next(t, conn); !strings.HasPrefix(fmt.Sprint(msg["error"]), ratelimit.Code+":") {
+		t.Fatalf("completion = %v, want rate_limited error", msg)
+	}
+
+	// The second strike disconnects the connection
+	handle(t, s, conn, `{"type":1,"invocationId":"3","target":"SendMessage","arguments":["alice","three","room1"]}`)
+	if _, open := <-conn.Send; open {
+		t.Fatal("send queue is still open, want the connection removed")
+	}
+	if conn.closeCode != websocket.ClosePolicyViolation || conn.closeReason != "rate limit exceeded" {
+		t.Errorf("close = %d %q, want a policy violation for the rate limit", conn.closeCode, conn.closeReason)
+	}
+}
+
+func TestTypingAndRoomMembers(t *testing.T) {
+	b := broker.NewMemoryBroker()
+	tracker := presence.New(b, presence.Options{})
+	s := NewSignalRServer(b, store.NewMemoryStore(0), Options{Presence: tracker})
+	sub, err := b.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := map[string]*Connection{}
+	for _, user := range []string{"alice", "bob"} {
+		conn := NewConnection(user + "-conn")
+		conn.User = user
+		conn.presence = tracker.Connect(metrics.SignalR)
+		conn.presence.Identify(user)
+		s.hub.AddConnection(conn)
+		conns[user] = conn
+
+		handle(t, s, conn, `{"type":1,"invocationId":"1","target":"JoinGroup","arguments":["room1"]}`)
+		if msg := next(t, conn); msg["error"] != nil {
+			t.Fatalf("JoinGroup: %v", msg["error"])
+		}
+	}
+	alice, bob := conns["alice"], conns["bob"]
+
+	handle(t, s, alice, `{"type":1,"invocationId":"2","target":"SendTyping","arguments":["room1",true]}`)
+	if msg := next(t, alice); msg["error"] != nil {
+		t.Fatalf("SendTyping: %v", msg["error"])
+	}
+	// The presence of alice and bob in room1 was published first
+	for published := false; !published; {
+		select {
+		case msg := <-sub.Messages():
+			if msg.Type == presence.TypingType {
+				s.hub.deliver(msg)
+				published = true
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("typing was not published")
+		}
+	}
+	msg := next(t, bob)
+	args, _ := msg["arguments"].([]interface{})
+	if msg["target"] != "ReceiveTyping" || len(args) != 1 ||
+		args[0].(map[string]interface{})["user"] != "alice" || args[0].(map[string]interface{})["message"] != presence.TypingStarted {
+		t.Fatalf("bob received %v, want alice typing", msg)
+	}
+
+	handle(t, s, bob, `{"type":1,"invocationId":"3","target":"GetRoomMembers","arguments":["room1"]}`)
+	members, _ := next(t, bob)["result"].([]interface{})
+	if len(members) != 2 {
+		t.Fatalf("members = %v, want alice and bob", members)
+	}
+	first := members[0].(map[string]interface{})
+	if first["user"] != "alice" || first["status"] != "online" || first["typing"] != true {
+		t.Errorf("first member = %v, want alice online and typing", first)
+	}
+	if len(alice.Send) != 0 {
+		t.Errorf("alice was sent %d messages about her own typing", len(alice.Send))
+	}
+
+	handle(t, s, bob, `{"type":1,"invocationId":"4","target":"SendTyping","arguments":["room2",true]}`)
+	if msg := next(t, bob); msg["error"] == nil {
+		t.Errorf("typing in a room not joined = %v, want an error", msg)
+	}
+	handle(t, s, bob, `{"type":1,"invocationId":"5","target":"SetPresence","arguments":["busy"]}`)
+	if msg := next(t, bob); msg["error"] == nil {
+		t.Errorf("SetPresence(busy) = %v, want an error", msg)
+	}
+}
+
+func TestSendDirectMessageReachesEveryConnectionOfTheUser(t *testing.T) {
+	b := broker.NewMemoryBroker()
+	s := NewSignalRServer(b, store.NewMemoryStore(0), Options{})
+	sub, err := b.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publish := func() {
+		t.Helper()
+		select {
+		case msg := <-sub.Messages():
+			s.hub.deliver(msg)
+		case <-time.After(2 * time.Second):
+			t.Fatal("nothing was published")
+		}
+	}
+
+	conns := map[string]*Connection{}
+	for _, user := range []string{"alice", "bob", "carol", ""} {
+		conn := NewConnection(user + "-conn")
+		conn.User = user
+		s.hub.AddConnection(conn)
+		s.hub.AddToGroup(conn.ID, "room1")
+		conns[user] = conn
+	}
+	alice, bob, carol, phone := conns["alice"], conns["bob"], conns["carol"], conns[""]
+
+	// An unauthenticated connection receives the direct messages of the
+	// user it sends as
+	handle(t, s, phone, `{"type":1,"invocationId":"1","target":"SendMessage","arguments":["bob","hi","room1"]}`)
+	if msg := next(t, phone); msg["error"] != nil {
+		t.Fatalf("SendMessage: %v", msg["error"])
+	}
+	publish()
+	for _, conn := range []*Connection{alice, bob, carol, phone} {
+		next(t, conn) // the room message
+	}
+
+	handle(t, s, alice, `{"type":1,"invocationId":"1","target":"SendDirectMessage","arguments":["mallory","bob","see me after class"]}`)
+	if msg := next(t, alice); msg["error"] != nil {
+		t.Fatalf("SendDirectMessage: %v", msg["error"])
+	}
+	publish()
+	for name, conn := range map[string]*Connection{"alice": alice, "bob": bob, "bob's phone": phone} {
+		msg := next(t, conn)
+		args, _ := msg["arguments"].([]interface{})
+		if msg["target"] != "ReceiveDirectMessage" || len(args) != 1 ||
+			args[0].(map[string]interface{})["user"] != "alice" || args[0].(map[string]interface{})["to"] != "bob" {
+			t.Errorf("%s received %v, want alice's direct message", name, msg)
+		}
+	}
+	if len(carol.Send) != 0 {
+		t.Errorf("carol was sent %d messages, want none", len(carol.Send))
+	}
+
+	msgs, err := s.hub.store.Range(store.Query{Room: policy.DirectRoom("alice", "bob")})
+	if err != nil || len(msgs) != 1 || msgs[0].Type != "direct" {
+		t.Fatalf("stored conversation = %v, %v, want the direct message", msgs, err)
+	}
+	handle(t, s, carol, fmt.Sprintf(`{"type":1,"invocationId":"2","target":"GetHistory","arguments":[%q,"",0]}`, msgs[0].Room))
+	if msg := next(t, carol); !strings.HasPrefix(fmt.Sprint(msg["error"]), "not_invited:") {
+		t.Errorf("carol reading the conversation = %v, want not_invited error", msg)
+	}
+
+	handle(t, s, bob, `{"type":1,"invocationId":"2","target":"SendDirectMessage","arguments":["","bob","note to self"]}`)
+	if msg := next(t, bob); msg["error"] == nil {
+		t.Errorf("direct message to oneself = %v, want an error", msg)
+	}
+}
@@ -0,0 +1,271 @@
+package signalr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+
+	"elearning-5/internal/metrics"
+	"elearning-5/internal/presence"
+	"elearning-5/internal/ratelimit"
+	"elearning-5/pkg/logger"
+)
+
+// HubContext identifies the caller of a hub method. Hub methods receive it
+// when their first parameter is a *HubContext.
+type HubContext struct {
+	ConnectionID string
+	// User is the authenticated caller, empty when authentication is
+	// disabled.
+	User string
+	Hub  *Hub
+
+	limit    *ratelimit.Conn
+	presence *presence.Conn
+	log      *slog.Logger
+
+	ctx context.Context
+}
+
+// Logger returns the logger of the calling connection.
+func (c *HubContext) Logger() *slog.Logger {
+	if c.log == nil {
+		return slog.Default().With(logger.ProtocolKey, metrics.SignalR, logger.ConnKey, c.ConnectionID)
+	}
+	return c.log
+}
+
+// Context is canceled when the client cancels a streaming invocation or
+// disconnects. Streaming hub methods must stop producing once it is done.
+func (c *HubContext) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+var (
+	hubContextType = reflect.TypeOf((*HubContext)(nil))
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// hubMethod is an exported method of a registered hub that clients can
+// invoke by name.
+type hubMethod struct {
+	name         string
+	fn           reflect.Value
+	hasCtx       bool
+	params       []reflect.Type // excluding the *HubContext
+	streamParams int            // channel parameters fed by client streams
+	hasResult    bool
+	hasError     bool
+	streaming    bool // the result is a channel streamed to the caller
+}
+
+// dispatcher maps invocation targets onto hub methods. Targets are matched
+// case-insensitively like in ASP.NET Core SignalR.
+type dispatcher struct {
+	methods map[string]*hubMethod
+	mutex   sync.RWMutex
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{methods: make(map[string]*hubMethod)}
+}
+
+// register adds every exported method of hub. Methods may take a *HubContext
+// first and may return nothing, a result, an error, or a result and an error.
+// A channel result is streamed to the caller item by item, and channel
+// parameters receive the items of client upload streams.
+func (d *dispatcher) register(hub interface{}) error {
+	v := reflect.ValueOf(hub)
+	t := v.Type()
+	if t.NumMethod() == 0 {
+		return fmt.Errorf("signalr: hub %s has no exported methods", t)
+	}
+
+	methods := make([]*hubMethod, 0, t.NumMethod())
+	for i := 0; i < t.NumMethod(); i++ {
+		m, err := newHubMethod(t.Method(i).Name, v.Method(i))
+		if err != nil {
+			return fmt.Errorf("signalr: hub %s: %w", t, err)
+		}
+		methods = append(methods, m)
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, m := range methods {
+		if _, exists := d.methods[strings.ToLower(m.name)]; exists {
+			return fmt.Errorf("signalr: hub method %s is already registered", m.name)
+		}
+	}
+	for _, m := range methods {
+		d.methods[strings.ToLower(m.name)] = m
+	}
+	return nil
+}
+
+func newHubMethod(name string, fn reflect.Value) (*hubMethod, error) {
+	t := fn.Type()
+	m := &hubMethod{name: name, fn: fn}
+
+	for i := 0; i < t.NumIn(); i++ {
+		in := t.In(i)
+		if in == hubContextType {
+			if i != 0 {
+				return nil, fmt.Errorf("method %s: *HubContext must be the first parameter", name)
+			}
+			m.hasCtx = true
+			continue
+		}
+		if in.Kind() == reflect.Chan {
+			if in.ChanDir()&reflect.RecvDir == 0 {
+				return nil, fmt.Errorf("method %s: stream parameters must be receivable channels", name)
+			}
+			m.streamParams++
+		}
+		m.params = append(m.params, in)
+	}
+
+	switch t.NumOut() {
+	case 0:
+	case 1:
+		if t.Out(0) == errorType {
+			m.hasError = true
+		} else {
+			m.hasResult = true
+		}
+	case 2:
+		if t.Out(1) != errorType {
+			return nil, fmt.Errorf("method %s: second result must be an error", name)
+		}
+		m.hasResult = true
+		m.hasError = true
+	default:
+		return nil, fmt.Errorf("method %s: too many results", name)
+	}
+
+	if m.hasResult && t.Out(0).Kind() == reflect.Chan {
+		if t.Out(0).ChanDir()&reflect.RecvDir == 0 {
+			return nil, fmt.Errorf("method %s: streamed results must be receivable channels", name)
+		}
+		m.streaming = true
+	}
+	return m, nil
+}
+
+func (d *dispatcher) lookup(target string) (*hubMethod, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	m, ok := d.methods[strings.ToLower(target)]
+	return m, ok
+}
+
+// call is a hub method invocation whose arguments have been bound.
+type call struct {
+	method  *hubMethod
+	in      []reflect.Value
+	uploads map[string]reflect.Value // stream ID -> channel passed to the method
+}
+
+// prepare resolves the target and decodes args into its parameters. Channel
+// parameters are created for the client streams named by streamIDs. The kind
+// of invocation must match the method: streaming methods need a stream
+// invocation and the other way round.
+func (d *dispatcher) prepare(ctx *HubContext, target string, args []json.RawMessage, streamIDs []string, streamInvocation bool) (*call, error) {
+	m, ok := d.lookup(target)
+	if !ok {
+		return nil, fmt.Errorf("unknown hub method '%s'", target)
+	}
+	if m.streaming && !streamInvocation {
+		return nil, fmt.Errorf("the client attempted to invoke the streaming '%s' method with a non-streaming invocation", m.name)
+	}
+	if !m.streaming && streamInvocation {
+		return nil, fmt.Errorf("the client attempted to invoke the non-streaming '%s' method with a streaming invocation", m.name)
+	}
+
+	in, uploads, err := m.bind(ctx, args, streamIDs)
+	if err != nil {
+		return nil, err
+	}
+	return &call{method: m, in: in, uploads: uploads}, nil
+}
+
+// invoke calls a non-streaming hub method without client streams.
+func (d *dispatcher) invoke(ctx *HubContext, target string, args []json.RawMessage) (interface{}, error) {
+	c, err := d.prepare(ctx, target, args, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return c.run()
+}
+
+// run calls the hub method. Panics are reported as errors.
+func (c *call) run() (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			slog.Error("SignalR hub method panicked", "method", c.method.name, "panic", r)
+			result, err = nil, fmt.Errorf("an unexpected error occurred invoking '%s' on the server", c.method.name)
+		}
+	}()
+
+	return c.method.results(c.method.fn.Call(c.in))
+}
+
+// bind converts invocation arguments into call arguments. Arguments fill the
+// non-channel parameters in order and stream IDs fill the channel ones.
+func (m *hubMethod) bind(ctx *HubContext, args []json.RawMessage, streamIDs []string) ([]reflect.Value, map[string]reflect.Value, error) {
+	if len(streamIDs) != m.streamParams {
+		return nil, nil, fmt.Errorf("invocation provides %d stream(s) but target expects %d", len(streamIDs), m.streamParams)
+	}
+	if want := len(m.params) - m.streamParams; len(args) != want {
+		return nil, nil, fmt.Errorf("invocation provides %d argument(s) but target expects %d", len(args), want)
+	}
+
+	in := make([]reflect.Value, 0, len(m.params)+1)
+	if m.hasCtx {
+		in = append(in, reflect.ValueOf(ctx))
+	}
+
+	var uploads map[string]reflect.Value
+	next := 0
+	for _, param := range m.params {
+		if param.Kind() == reflect.Chan {
+			ch := reflect.MakeChan(reflect.ChanOf(reflect.BothDir, param.Elem()), uploadBuffer)
+			if uploads == nil {
+				uploads = make(map[string]reflect.Value)
+			}
+			uploads[streamIDs[0]] = ch
+			streamIDs = streamIDs[1:]
+			in = append(in, ch)
+			continue
+		}
+
+		arg := reflect.New(param)
+		if err := json.Unmarshal(args[next], arg.Interface()); err != nil {
+			return nil, nil, fmt.Errorf("argument %d of '%s' must be %s: %v", next, m.name, param, err)
+		}
+		in = append(in, arg.Elem())
+		next++
+	}
+	return in, uploads, nil
+}
+
+func (m *hubMethod) results(out []reflect.Value) (interface{}, error) {
+	var result interface{}
+	if m.hasResult {
+		result = out[0].Interface()
+	}
+	if m.hasError {
+		if errVal := out[len(out)-1]; !errVal.IsNil() {
+			return nil, errVal.Interface().(error)
+		}
+	}
+	return result, nil
+}
@@ -1,22 +1,60 @@
 package signalr
 
 import (
-	"encoding/json"
-	"log"
+	"context"
+	"log/slog"
+	"sort"
 	"sync"
+	"time"
+
+	"elearning-5/internal/broker"
+	"elearning-5/internal/metrics"
+	"elearning-5/internal/policy"
+	"elearning-5/internal/presence"
+	"elearning-5/internal/ratelimit"
+	"elearning-5/internal/store"
+	"elearning-5/internal/tracing"
+	"elearning-5/pkg/logger"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
 )
 
-type SignalRMessage struct {
-	Type         int           `json:"type"`
-	Target       string        `json:"target"`
-	Arguments    []interface{} `json:"arguments"`
-	InvocationId string        `json:"invocationId,omitempty"`
+// Connection is a SignalR client. Send is only written to while holding the
+// hub lock and is closed by the hub when the connection is removed.
+type Connection struct {
+	ID   string
+	Send chan []byte
+	// User is the subject of the connection's token, empty when
+	// authentication is disabled.
+	User string
+	// name is who direct messages for the connection are for: User, or
+	// the user an unauthenticated caller first sent as. Guarded by the hub
+	// lock.
+	name string
+
+	groups      map[string]bool   // guarded by the hub lock
+	resumed     map[string]uint64 // group -> last seq sent by ResumeGroup, guarded by the hub lock
+	streams     *connStreams
+	limit       *ratelimit.Conn
+	presence    *presence.Conn
+	release     func()        // frees the slot under the connection caps
+	closeCode   int           // close frame code written after Send is closed
+	closeReason string        // Close message error, empty when the server shuts down
+	done        chan struct{} // closed when the write pump returns
+	log         *slog.Logger  // carries the connection's attributes
 }
 
-type Connection struct {
-	ID     string
-	Send   chan []byte
-	Groups map[string]bool
+func NewConnection(id string) *Connection {
+	return &Connection{
+		ID:      id,
+		Send:    make(chan []byte, 256),
+		groups:  make(map[string]bool),
+		resumed: make(map[string]uint64),
+		streams: newConnStreams(),
+		done:    make(chan struct{}),
+		log:     slog.Default().With(logger.ProtocolKey, metrics.SignalR, logger.ConnKey, id),
+	}
 }
 
 type Hub struct {
@@ -24,129 +62,543 @@ type Hub struct {
 	groups      map[string]map[string]bool
 	mutex       sync.RWMutex
 	broadcast   chan []byte
+	broker      broker.Broker
+	store       store.MessageStore
+	policy      *policy.Policy // checked by the ChatHub methods, nil allows everything
+	metrics     *metrics.Metrics
+	presence    *presence.Tracker // nil tracks nothing
+
+	seqMutex  sync.Mutex
+	delivered map[string]uint64 // room -> highest seq deliver took on, guarded by seqMutex
+
+	quit     chan struct{} // closed by Shutdown
+	done     chan struct{} // closed when Run returns
+	stopOnce sync.Once
+	closed   []*Connection // connections closed by shutdown, set before done
 }
 
-func NewHub() *Hub {
+func NewHub(b broker.Broker, st store.MessageStore) *Hub {
 	return &Hub{
 		connections: make(map[string]*Connection),
 		groups:      make(map[string]map[string]bool),
 		broadcast:   make(chan []byte, 1024),
+		broker:      b,
+		store:       st,
+		delivered:   make(map[string]uint64),
+		quit:        make(chan struct{}),
+		done:        make(chan struct{}),
 	}
 }
 
 func (h *Hub) Run() {
+	defer close(h.done)
+
+	sub, err := h.broker.Subscribe()
+	if err != nil {
+		slog.Error("SignalR hub cannot subscribe to broker", "err", err)
+		return
+	}
+	defer sub.Unsubscribe()
+
 	for {
 		select {
+		case msg, ok := <-sub.Messages():
+			if !ok {
+				slog.Warn("SignalR hub broker subscription closed")
+				h.closeConnections(0)
+				return
+			}
+			h.deliver(msg)
+
+		case <-h.quit:
+			h.drain(sub)
+			h.closeConnections(websocket.CloseGoingAway)
+			slog.Info("SignalR hub stopped")
+			return
+
 		case message := <-h.broadcast:
 			h.mutex.RLock()
+			slow := make([]string, 0)
 			for _, conn := range h.connections {
-				select {
-				case conn.Send <- message:
-				default:
-					close(conn.Send)
-					delete(h.connections, conn.ID)
+				if !h.trySend(conn, message) {
+					slow = append(slow, conn.ID)
 				}
 			}
 			h.mutex.RUnlock()
+
+			h.removeSlow(slow)
+		}
+	}
+}
+
+// Shutdown stops Run after it has delivered everything already received from
+// the broker and waits until every connection has flushed its send queue and
+// written a close frame, or until ctx expires.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.stopOnce.Do(func() { close(h.quit) })
+
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for _, conn := range h.closed {
+		select {
+		case <-conn.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// deliver forwards a broker message to the SignalR group of its room,
+// skipping connections that already got it from ResumeGroup.
+func (h *Hub) deliver(msg broker.Message) {
+	defer h.metrics.Fanout(metrics.SignalR, time.Now())
+
+	data, err := encodeMessage(receiveMessage(msg))
+	if err != nil {
+		slog.Error("Encoding SignalR group message failed", "err", err)
+		return
+	}
+
+	ctx := tracing.Extract(context.Background(), msg.TraceParent)
+	if msg.Type == "direct" {
+		h.sendToUsers(ctx, data, msg.User, msg.To)
+		return
+	}
+	if msg.Seq > 0 {
+		// Recorded before the group is looked up, for ResumeGroup
+		h.seqMutex.Lock()
+		if msg.Seq > h.delivered[msg.Room] {
+			h.delivered[msg.Room] = msg.Seq
+		}
+		h.seqMutex.Unlock()
+	}
+	// Chat rooms map onto SignalR groups of the same name
+	h.sendToGroup(ctx, msg.Room, data, func(conn *Connection) bool {
+		if msg.Type == presence.TypingType {
+			return conn.presence.User() == msg.User
+		}
+		return msg.Seq > 0 && msg.Seq <= conn.resumed[msg.Room]
+	})
+}
+
+// receiveMessage is the invocation that hands a chat message to a client.
+// Direct messages, typing indicators and presence changes go to targets of
+// their own so that clients do not show them as room messages.
+func receiveMessage(msg broker.Message) SignalRMessage {
+	target := "ReceiveMessage"
+	switch msg.Type {
+	case "direct":
+		target = "ReceiveDirectMessage"
+	case presence.TypingType:
+		target = "ReceiveTyping"
+	case presence.PresenceType:
+		target = "ReceivePresence"
+	}
+	return SignalRMessage{
+		Type:      InvocationMessageType,
+		Target:    target,
+		Arguments: []interface{}{msg},
+	}
+}
+
+// drain delivers broker messages that arrived before shutdown started.
+func (h *Hub) drain(sub broker.Subscription) {
+	for {
+		select {
+		case msg, ok := <-sub.Messages():
+			if !ok {
+				return
+			}
+			h.deliver(msg)
+		default:
+			return
 		}
 	}
 }
 
+// closeConnections removes every connection. Each write pump flushes its
+// queue before sending a close frame with the given code.
+func (h *Hub) closeConnections(code int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for id, conn := range h.connections {
+		conn.closeCode = code
+		close(conn.Send)
+		delete(h.connections, id)
+		h.closed = append(h.closed, conn)
+		h.metrics.Disconnected(metrics.SignalR)
+		for group := range conn.groups {
+			h.metrics.Left(metrics.SignalR, group)
+		}
+	}
+	h.groups = make(map[string]map[string]bool)
+}
+
+// Publish stores a message sent by a SignalR client and hands it to the
+// broker, which delivers it to every protocol including this hub. ctx
+// carries the span of the invocation.
+func (h *Hub) Publish(ctx context.Context, msg broker.Message) error {
+	msg.Source = "signalr"
+	attrs := []attribute.KeyValue{tracing.RoomKey.String(msg.Room), tracing.MessageKey.String(msg.ID)}
+	if store.Persisted(msg) {
+		_, span := tracing.Child(ctx, tracing.PersistSpan, attrs...)
+		seq, err := h.store.Append(msg)
+		tracing.End(span, err)
+		if err != nil {
+			return err
+		}
+		msg.Seq = seq
+	}
+
+	ctx, span := tracing.Child(ctx, tracing.PublishSpan, attrs...)
+	msg.TraceParent = tracing.Inject(ctx)
+	err := h.broker.Publish(msg)
+	tracing.End(span, err)
+	return err
+}
+
 func (h *Hub) AddConnection(conn *Connection) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 	h.connections[conn.ID] = conn
-	log.Printf("SignalR connection established: %s (Total: %d)", conn.ID, len(h.connections))
+	conn.name = conn.User
+	h.metrics.Connected(metrics.SignalR)
+	conn.log.Info("SignalR connection established", "connections", len(h.connections))
 }
 
 func (h *Hub) RemoveConnection(connID string) {
+	h.closeConnection(connID, 0, "")
+}
+
+// Disconnect sends a connection a Close message with reason, which tells the
+// client not to reconnect, and removes it.
+func (h *Hub) Disconnect(connID, reason string) {
+	h.closeConnection(connID, websocket.ClosePolicyViolation, reason)
+}
+
+func (h *Hub) closeConnection(connID string, code int, reason string) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
-	if conn, exists := h.connections[connID]; exists {
-		close(conn.Send)
-		delete(h.connections, connID)
+	conn, exists := h.connections[connID]
+	if !exists {
+		return
+	}
 
-		// Remove from all groups
-		for group := range h.groups {
-			delete(h.groups[group], connID)
-		}
+	conn.closeCode, conn.closeReason = code, reason
+	close(conn.Send)
+	delete(h.connections, connID)
+	h.metrics.Disconnected(metrics.SignalR)
+
+	// Remove from all groups
+	for group := range conn.groups {
+		h.leaveGroup(conn, group)
 	}
 
-	log.Printf("SignalR connection closed: %s (Total: %d)", connID, len(h.connections))
+	conn.log.Info("SignalR connection closed", "connections", len(h.connections))
+}
+
+// ConnectionCount returns the number of open connections.
+func (h *Hub) ConnectionCount() int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.connections)
 }
 
 func (h *Hub) SendToConnection(connID string, message interface{}) {
+	data, err := encodeMessage(message)
+	if err != nil {
+		slog.Error("Encoding SignalR message failed", "err", err)
+		return
+	}
+
+	// Send under the read lock so the channel cannot be closed meanwhile
 	h.mutex.RLock()
 	conn, exists := h.connections[connID]
+	sent := exists && h.trySend(conn, data)
 	h.mutex.RUnlock()
 
-	if exists {
-		data, err := json.Marshal(message)
-		if err != nil {
-			log.Printf("Error marshaling message: %v", err)
-			return
-		}
+	if exists && !sent {
+		h.removeSlow([]string{connID})
+	}
+}
 
-		select {
-		case conn.Send <- data:
-		default:
-			h.RemoveConnection(connID)
-		}
+// SendToUser sends a message to every connection of a user, as named by
+// their token or by Identify.
+func (h *Hub) SendToUser(user string, message interface{}) {
+	data, err := encodeMessage(message)
+	if err != nil {
+		slog.Error("Encoding SignalR user message failed", "err", err)
+		return
+	}
+
+	h.sendToUsers(context.Background(), data, user)
+}
+
+// Identify names the user of an unauthenticated connection, which then
+// receives the direct messages for that user. A connection keeps the first
+// name it is given.
+func (h *Hub) Identify(connID, user string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if conn, exists := h.connections[connID]; exists && conn.name == "" {
+		conn.name = user
 	}
 }
 
 func (h *Hub) Broadcast(message interface{}) {
-	data, err := json.Marshal(message)
+	data, err := encodeMessage(message)
 	if err != nil {
-		log.Printf("Error marshaling broadcast message: %v", err)
+		slog.Error("Encoding SignalR broadcast failed", "err", err)
 		return
 	}
 
 	h.broadcast <- data
 }
 
+// SendToGroup sends a message to every connection in a group.
 func (h *Hub) SendToGroup(group string, message interface{}) {
+	h.SendToGroupExcept(group, message)
+}
+
+// SendToGroupExcept sends a message to every connection in a group except
+// the excluded ones, typically the caller. Connections whose send queue is
+// full are removed once the group has been walked.
+func (h *Hub) SendToGroupExcept(group string, message interface{}, excluded ...string) {
+	data, err := encodeMessage(message)
+	if err != nil {
+		slog.Error("Encoding SignalR group message failed", "err", err)
+		return
+	}
+
+	h.sendToGroup(context.Background(), group, data, func(conn *Connection) bool {
+		return contains(excluded, conn.ID)
+	})
+}
+
+// sendToGroup queues data for every connection in a group unless skip
+// returns true for it. skip is called with the read lock held. Each
+// connection gets a delivery span when ctx carries the trace of data.
+func (h *Hub) sendToGroup(ctx context.Context, group string, data []byte, skip func(conn *Connection) bool) {
 	h.mutex.RLock()
-	defer h.mutex.RUnlock()
+	slow := make([]string, 0)
+	for connID := range h.groups[group] {
+		conn, exists := h.connections[connID]
+		if !exists || skip(conn) {
+			continue
+		}
+		_, span := tracing.Child(ctx, tracing.DeliverSpan, tracing.ProtocolKey.String(metrics.SignalR),
+			tracing.RecipientKey.String(connID), tracing.QueueDepthKey.Int(len(conn.Send)))
+		if !h.trySend(conn, data) {
+			tracing.End(span, tracing.ErrQueueFull)
+			slow = append(slow, connID)
+			continue
+		}
+		span.End()
+	}
+	h.mutex.RUnlock()
 
-	if connections, exists := h.groups[group]; exists {
-		data, err := json.Marshal(message)
-		if err != nil {
-			log.Printf("Error marshaling group message: %v", err)
-			return
+	// RemoveConnection takes the write lock, so it must run after RUnlock
+	h.removeSlow(slow)
+}
+
+// sendToUsers queues data for every connection of the given users, with a
+// delivery span each like sendToGroup.
+func (h *Hub) sendToUsers(ctx context.Context, data []byte, users ...string) {
+	h.mutex.RLock()
+	slow := make([]string, 0)
+	for connID, conn := range h.connections {
+		if conn.name == "" || !contains(users, conn.name) {
+			continue
+		}
+		_, span := tracing.Child(ctx, tracing.DeliverSpan, tracing.ProtocolKey.String(metrics.SignalR),
+			tracing.RecipientKey.String(connID), tracing.QueueDepthKey.Int(len(conn.Send)))
+		if !h.trySend(conn, data) {
+			tracing.End(span, tracing.ErrQueueFull)
+			slow = append(slow, connID)
+			continue
 		}
+		span.End()
+	}
+	h.mutex.RUnlock()
 
-		for connID := range connections {
-			if conn, exists := h.connections[connID]; exists {
-				select {
-				case conn.Send <- data:
-				default:
-					h.RemoveConnection(connID)
-				}
-			}
+	h.removeSlow(slow)
+}
+
+// AddToGroup adds a connection to a group. It returns false if the
+// connection does not exist.
+func (h *Hub) AddToGroup(connID, group string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	conn, exists := h.connections[connID]
+	if !exists {
+		return false
+	}
+
+	h.joinGroup(conn, group)
+	return true
+}
+
+// ResumeGroup adds a connection to a group after queueing the messages of
+// the group after sequence number lastSeq. The store is read without the hub
+// lock; the messages deliver took on meanwhile, before the connection was in
+// the group, are read again before it joins. deliver skips the live messages
+// the connection got this way. It fails with store.ErrGapTooLarge, without
+// joining, when the missed messages cannot all be sent.
+func (h *Hub) ResumeGroup(connID, group string, lastSeq uint64) error {
+	for {
+		msgs, err := store.Resume(h.store, group, lastSeq)
+		if err != nil {
+			return err
+		}
+		joined := false
+		if lastSeq, joined, err = h.replay(connID, group, msgs, lastSeq); err != nil || joined {
+			return err
 		}
 	}
 }
 
-func (h *Hub) AddToGroup(connID, group string) {
+// replay queues msgs, read after lastSeq, for a connection and adds it to the
+// group unless deliver has taken on later messages of the group than it got.
+// It returns the seq of the last message the connection got.
+func (h *Hub) replay(connID, group string, msgs []broker.Message, lastSeq uint64) (uint64, bool, error) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
-	if h.groups[group] == nil {
-		h.groups[group] = make(map[string]bool)
+	conn, exists := h.connections[connID]
+	if !exists {
+		return lastSeq, false, errConnectionClosed
+	}
+	for _, msg := range msgs {
+		data, err := encodeMessage(receiveMessage(msg))
+		if err != nil {
+			return lastSeq, false, err
+		}
+		// MaxResume stays below the queue size, so this only fails for a
+		// connection that is already falling behind
+		if !h.trySend(conn, data) {
+			return lastSeq, false, store.ErrGapTooLarge
+		}
+		lastSeq = msg.Seq
+	}
+
+	// deliver records a seq before it takes the read lock, so any message
+	// it missed the connection with is counted here
+	h.seqMutex.Lock()
+	missed := h.delivered[group] > lastSeq
+	h.seqMutex.Unlock()
+	if missed {
+		return lastSeq, false, nil
 	}
-	h.groups[group][connID] = true
+	h.joinGroup(conn, group)
+	conn.resumed[group] = lastSeq
+	return lastSeq, true, nil
 }
 
 func (h *Hub) RemoveFromGroup(connID, group string) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
+	if conn, exists := h.connections[connID]; exists {
+		h.leaveGroup(conn, group)
+	}
+}
+
+// GroupMembers returns the IDs of the connections in a group, sorted.
+func (h *Hub) GroupMembers(group string) []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	members := make([]string, 0, len(h.groups[group]))
+	for connID := range h.groups[group] {
+		members = append(members, connID)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Groups returns the groups a connection belongs to, sorted.
+func (h *Hub) Groups(connID string) []string {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	conn, exists := h.connections[connID]
+	if !exists {
+		return nil
+	}
+
+	groups := make([]string, 0, len(conn.groups))
+	for group := range conn.groups {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// joinGroup must be called with the write lock held.
+func (h *Hub) joinGroup(conn *Connection, group string) {
+	if !conn.groups[group] {
+		h.metrics.Joined(metrics.SignalR, group)
+	}
+	conn.presence.Join(group)
+	if h.groups[group] == nil {
+		h.groups[group] = make(map[string]bool)
+	}
+	h.groups[group][conn.ID] = true
+	conn.groups[group] = true
+}
+
+// leaveGroup must be called with the write lock held.
+func (h *Hub) leaveGroup(conn *Connection, group string) {
+	if conn.groups[group] {
+		h.metrics.Left(metrics.SignalR, group)
+	}
+	delete(conn.groups, group)
+	delete(conn.resumed, group)
+	conn.presence.Leave(group)
 	if connections, exists := h.groups[group]; exists {
-		delete(connections, connID)
+		delete(connections, conn.ID)
 		if len(connections) == 0 {
 			delete(h.groups, group)
 		}
 	}
 }
+
+// removeSlow drops connections that could not keep up with their send
+// queue. It must be called without holding the hub lock.
+func (h *Hub) removeSlow(connIDs []string) {
+	for _, connID := range connIDs {
+		slog.Warn("SignalR connection is too slow, disconnecting", logger.ProtocolKey, metrics.SignalR, logger.ConnKey, connID)
+		h.metrics.Evicted(metrics.SignalR, metrics.SlowConsumer)
+		h.RemoveConnection(connID)
+	}
+}
+
+// trySend queues data without blocking. It must be called with the hub lock
+// held so that the channel cannot be closed concurrently.
+func (h *Hub) trySend(conn *Connection, data []byte) bool {
+	h.metrics.QueueDepth(metrics.SignalR, len(conn.Send))
+	select {
+	case conn.Send <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
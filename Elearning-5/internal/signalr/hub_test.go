@@ -0,0 +1,347 @@
+package signalr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"elearning-5/internal/broker"
+	"elearning-5/internal/store"
+
+	"github.com/gorilla/websocket"
+)
+
+func newTestHub(t *testing.T, ids ...string) *Hub {
+	t.Helper()
+	h := NewHub(broker.NewMemoryBroker(), store.NewMemoryStore(0))
+	for _, id := range ids {
+		h.AddConnection(NewConnection(id))
+	}
+	return h
+}
+
+// received drains whatever is queued for a connection without blocking.
+func received(h *Hub, id string) int {
+	h.mutex.RLock()
+	conn := h.connections[id]
+	h.mutex.RUnlock()
+	if conn == nil {
+		return 0
+	}
+
+	n := 0
+	for {
+		select {
+		case _, ok := <-conn.Send:
+			if !ok {
+				return n
+			}
+			n++
+		default:
+			return n
+		}
+	}
+}
+
+func TestSendToGroupReachesOnlyMembers(t *testing.T) {
+	h := newTestHub(t, "a", "b", "c")
+	h.AddToGroup("a", "room1")
+	h.AddToGroup("b", "room1")
+	h.AddToGroup("c", "room2")
+
+	h.SendToGroup("room1", SignalRMessage{Type: PingMessageType})
+
+	for id, want := range map[string]int{"a": 1, "b": 1, "c": 0} {
+		if got := received(h, id); got != want {
+			t.Errorf("connection %s received %d messages, want %d", id, got, want)
+		}
+	}
+}
+
+func TestSendToGroupExceptSkipsCaller(t *testing.T) {
+	h := newTestHub(t, "a", "b")
+	h.AddToGroup("a", "room1")
+	h.AddToGroup("b", "room1")
+
+	h.SendToGroupExcept("room1", SignalRMessage{Type: PingMessageType}, "a")
+
+	if got := received(h, "a"); got != 0 {
+		t.Errorf("caller received %d messages, want 0", got)
+	}
+	if got := received(h, "b"); got != 1 {
+		t.Errorf("other member received %d messages, want 1", got)
+	}
+}
+
+func TestGroupMembership(t *testing.T) {
+	h := newTestHub(t, "a", "b")
+
+	if h.AddToGroup("missing", "room1") {
+		t.Error("AddToGroup succeeded for an unknown connection")
+	}
+
+	h.AddToGroup("b", "room1")
+	h.AddToGroup("a", "room1")
+	h.AddToGroup("a", "room2")
+
+	if got, want := h.GroupMembers("room1"), []string{"a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GroupMembers(room1) = %v, want %v", got, want)
+	}
+	if got, want := h.Groups("a"), []string{"room1", "room2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Groups(a) = %v, want %v", got, want)
+	}
+
+	h.RemoveFromGroup("b", "room1")
+	if got, want := h.GroupMembers("room1"), []string{"a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after leave GroupMembers(room1) = %v, want %v", got, want)
+	}
+
+	h.RemoveConnection("a")
+	if got := h.GroupMembers("room1"); len(got) != 0 {
+		t.Errorf("after disconnect GroupMembers(room1) = %v, want none", got)
+	}
+	if _, exists := h.groups["room2"]; exists {
+		t.Error("empty group room2 was not deleted")
+	}
+}
+
+func TestChatHubJoinAndLeaveGroup(t *testing.T) {
+	h := newTestHub(t, "a")
+	d := newDispatcher()
+	if err := d.register(ChatHub{}); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &HubContext{ConnectionID: "a", Hub: h}
+	arg, _ := json.Marshal("room1")
+
+	if _, err := d.invoke(ctx, "JoinGroup", []json.RawMessage{arg}); err != nil {
+		t.Fatalf("JoinGroup: %v", err)
+	}
+	h.SendToGroup("room1", SignalRMessage{Type: PingMessageType})
+	if got := received(h, "a"); got != 1 {
+		t.Errorf("joined connection received %d messages, want 1", got)
+	}
+
+	if _, err := d.invoke(ctx, "LeaveGroup", []json.RawMessage{arg}); err != nil {
+		t.Fatalf("LeaveGroup: %v", err)
+	}
+	h.SendToGroup("room1", SignalRMessage{Type: PingMessageType})
+	if got := received(h, "a"); got != 0 {
+		t.Errorf("departed connection received %d messages, want 0", got)
+	}
+}
+
+func TestSlowConsumerRemovedWithoutDeadlock(t *testing.T) {
+	h := newTestHub(t, "slow", "fast")
+	h.AddToGroup("slow", "room1")
+	h.AddToGroup("fast", "room1")
+
+	h.mutex.RLock()
+	slow := h.connections["slow"]
+	h.mutex.RUnlock()
+	for i := 0; i < cap(slow.Send); i++ {
+		slow.Send <- nil
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.SendToGroup("room1", SignalRMessage{Type: PingMessageType})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("SendToGroup deadlocked while removing a slow consumer")
+	}
+
+	if got, want := h.GroupMembers("room1"), []string{"fast"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GroupMembers(room1) = %v, want %v", got, want)
+	}
+	if got := received(h, "fast"); got != 1 {
+		t.Errorf("fast consumer received %d messages, want 1", got)
+	}
+}
+
+func TestConcurrentGroupOperations(t *testing.T) {
+	h := NewHub(broker.NewMemoryBroker(), store.NewMemoryStore(0))
+
+	const workers = 16
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			id := fmt.Sprintf("conn-%d", w)
+			group := fmt.Sprintf("room-%d", w%3)
+
+			h.AddConnection(NewConnection(id))
+			for i := 0; i < 200; i++ {
+				h.AddToGroup(id, group)
+				h.SendToGroup(group, SignalRMessage{Type: PingMessageType})
+				h.SendToGroupExcept(group, SignalRMessage{Type: PingMessageType}, id)
+				h.GroupMembers(group)
+				h.Groups(id)
+				received(h, id)
+				h.RemoveFromGroup(id, group)
+			}
+			h.RemoveConnection(id)
+		}(w)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("concurrent group operations deadlocked")
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	if len(h.connections) != 0 || len(h.groups) != 0 {
+		t.Errorf("hub not empty after all connections left: %d connections, %d groups", len(h.connections), len(h.groups))
+	}
+}
+
+func TestHandshakeAndRecordFraming(t *testing.T) {
+	_, addr := newTestSignalRServer(t, Options{})
+
+	// Records that follow the handshake in its frame are handled once the
+	// connection is registered
+	conn := dialSignalR(t, addr, "{\"protocol\":\"json\",\"version\":1}\x1e"+
+		`{"type":1,"invocationId":"1","target":"JoinGroup","arguments":["room1"]}`+"\x1e")
+	if response := readRecord(t, conn); len(response) != 0 {
+		t.Fatalf("handshake response = %v, want an empty object", response)
+	}
+	if msg := readRecord(t, conn); msg["type"] != float64(CompletionMessageType) || msg["result"] != "Joined group: room1" {
+		t.Fatalf("received %v, want the JoinGroup completion", msg)
+	}
+
+	// One frame may carry several records
+	frame := `{"type":1,"invocationId":"2","target":"LeaveGroup","arguments":["room1"]}` + "\x1e" +
+		`{"type":6}` + "\x1e" +
+		`{"type":1,"invocationId":"3","target":"JoinGroup","arguments":["room2"]}` + "\x1e"
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Left group: room1", "Joined group: room2"} {
+		if msg := readRecord(t, conn); msg["result"] != want {
+			t.Errorf("received %v, want result %q", msg, want)
+		}
+	}
+}
+
+func TestRejectedHandshake(t *testing.T) {
+	s, addr := newTestSignalRServer(t, Options{})
+
+	for _, handshake := range []string{
+		"{\"protocol\":\"messagepack\",\"version\":1}\x1e",
+		"{\"protocol\":\"json\",\"version\":2}\x1e",
+		"not json\x1e",
+	} {
+		conn := dialSignalR(t, addr, handshake)
+		response := readRecord(t, conn)
+		if response["error"] == nil || response["error"] == "" {
+			t.Errorf("handshake %q answered with %v, want an error", handshake, response)
+		}
+		if _, _, err := conn.ReadMessage(); err == nil {
+			t.Errorf("handshake %q: connection is still open", handshake)
+		}
+	}
+	if n := s.hub.ConnectionCount(); n != 0 {
+		t.Errorf("%d connections registered, want none", n)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	_, addr := newTestSignalRServer(t, Options{})
+	base := "http://" + addr + "/signalr"
+
+	res, err := http.Post(base+"/negotiate?negotiateVersion=1", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var negotiated negotiateResponse
+	if err := json.NewDecoder(res.Body).Decode(&negotiated); err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK || negotiated.NegotiateVersion != 1 ||
+		negotiated.ConnectionToken == "" || negotiated.ConnectionID == "" || negotiated.ConnectionToken == negotiated.ConnectionID {
+		t.Fatalf("negotiate = %d %+v, want version 1 with a token and a connection ID", res.StatusCode, negotiated)
+	}
+	want := []availableTransport{{Transport: "WebSockets", TransferFormats: []string{"Text"}}}
+	if !reflect.DeepEqual(negotiated.AvailableTransports, want) {
+		t.Errorf("transports = %+v, want %+v", negotiated.AvailableTransports, want)
+	}
+
+	// The token connects once
+	url := "ws://" + addr + "/signalr?id=" + negotiated.ConnectionToken
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("connect with the token: %v", err)
+	}
+	conn.Close()
+	if _, res, err := websocket.DefaultDialer.Dial(url, nil); err == nil || res.StatusCode != http.StatusNotFound {
+		t.Errorf("second connection with the token: %v, want 404", err)
+	}
+
+	res, err = http.Get(base + "/negotiate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET negotiate = %d, want 405", res.StatusCode)
+	}
+}
+
+type faultyHub struct{}
+
+func (faultyHub) Explode() string { panic("boom") }
+
+func TestBadInvocationsCompleteWithErrors(t *testing.T) {
+	s, addr := newTestSignalRServer(t, Options{})
+	if err := s.RegisterHub(faultyHub{}); err != nil {
+		t.Fatal(err)
+	}
+	conn := connectSignalR(t, addr)
+
+	for _, tt := range []struct {
+		record, want string
+	}{
+		{`{"type":1,"invocationId":"1","target":"JoinGroup","arguments":[]}`, "invocation provides 0 argument(s) but target expects 1"},
+		{`{"type":1,"invocationId":"2","target":"JoinGroup","arguments":["room1","room2"]}`, "invocation provides 2 argument(s) but target expects 1"},
+		{`{"type":1,"invocationId":"3","target":"JoinGroup","arguments":[42]}`, "argument 0 of 'JoinGroup' must be string"},
+		{`{"type":1,"invocationId":"4","target":"GetHistory","arguments":["room1","","ten"]}`, "argument 2 of 'GetHistory' must be int"},
+		{`{"type":1,"invocationId":"5","target":"NoSuchMethod","arguments":[]}`, "unknown hub method 'NoSuchMethod'"},
+		{`{"type":1,"invocationId":"6","target":"Explode","arguments":[]}`, "an unexpected error occurred invoking 'Explode' on the server"},
+	} {
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(tt.record+"\x1e")); err != nil {
+			t.Fatal(err)
+		}
+		msg := readRecord(t, conn)
+		errText, _ := msg["error"].(string)
+		if msg["type"] != float64(CompletionMessageType) || !strings.HasPrefix(errText, tt.want) {
+			t.Errorf("%s: received %v, want a completion with error %q", tt.record, msg, tt.want)
+		}
+	}
+
+	// The connection survives all of them
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(`{"type":1,"invocationId":"7","target":"JoinGroup","arguments":["room1"]}`+"\x1e")); err != nil {
+		t.Fatal(err)
+	}
+	if msg := readRecord(t, conn); msg["result"] != "Joined group: room1" {
+		t.Errorf("received %v, want the JoinGroup completion", msg)
+	}
+}
@@ -0,0 +1,122 @@
+package signalr
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Message types of the SignalR hub protocol.
+const (
+	InvocationMessageType       = 1
+	StreamItemMessageType       = 2
+	CompletionMessageType       = 3
+	StreamInvocationMessageType = 4
+	CancelInvocationMessageType = 5
+	PingMessageType             = 6
+	CloseMessageType            = 7
+)
+
+// RecordSeparator terminates every message of the JSON hub protocol.
+const RecordSeparator = 0x1e
+
+// SignalRMessage is a hub protocol message sent to clients. Only the fields
+// relevant to its Type are set.
+type SignalRMessage struct {
+	Type           int           `json:"type"`
+	InvocationId   string        `json:"invocationId,omitempty"`
+	Target         string        `json:"target,omitempty"`
+	Arguments      []interface{} `json:"arguments,omitempty"`
+	StreamIds      []string      `json:"streamIds,omitempty"`
+	Item           interface{}   `json:"item,omitempty"`
+	Result         interface{}   `json:"result,omitempty"`
+	Error          string        `json:"error,omitempty"`
+	AllowReconnect bool          `json:"allowReconnect,omitempty"`
+}
+
+// MarshalJSON always writes arguments for invocations; clients reject
+// invocations without them even when there are none.
+func (m SignalRMessage) MarshalJSON() ([]byte, error) {
+	type message SignalRMessage
+	if m.Type != InvocationMessageType && m.Type != StreamInvocationMessageType {
+		return json.Marshal(message(m))
+	}
+
+	args := m.Arguments
+	if args == nil {
+		args = []interface{}{}
+	}
+	return json.Marshal(struct {
+		message
+		Arguments []interface{} `json:"arguments"`
+	}{message(m), args})
+}
+
+// incomingMessage is a hub protocol message received from a client. Payloads
+// stay raw until the hub method they are meant for is known.
+type incomingMessage struct {
+	Type         int               `json:"type"`
+	InvocationId string            `json:"invocationId"`
+	Target       string            `json:"target"`
+	Arguments    []json.RawMessage `json:"arguments"`
+	StreamIds    []string          `json:"streamIds"`
+	Item         json.RawMessage   `json:"item"`
+	Result       json.RawMessage   `json:"result"`
+	Error        string            `json:"error"`
+	// Headers of invocations may carry a traceparent.
+	Headers map[string]string `json:"headers"`
+}
+
+type handshakeRequest struct {
+	Protocol string `json:"protocol"`
+	Version  int    `json:"version"`
+}
+
+type handshakeResponse struct {
+	Error string `json:"error,omitempty"`
+}
+
+// encodeMessage marshals v as one record of the JSON hub protocol.
+func encodeMessage(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return append(data, RecordSeparator), nil
+}
+
+// splitRecords splits a WebSocket frame into hub protocol records. A frame
+// without any separator is treated as a single record so that clients which
+// predate the framing keep working.
+func splitRecords(frame []byte) [][]byte {
+	if bytes.IndexByte(frame, RecordSeparator) < 0 {
+		if len(bytes.TrimSpace(frame)) == 0 {
+			return nil
+		}
+		return [][]byte{frame}
+	}
+
+	var records [][]byte
+	for _, record := range bytes.Split(frame, []byte{RecordSeparator}) {
+		if len(bytes.TrimSpace(record)) > 0 {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// parseHandshake validates the first record a client sends.
+func parseHandshake(record []byte) error {
+	var req handshakeRequest
+	if err := json.Unmarshal(record, &req); err != nil {
+		return errors.New("invalid handshake request")
+	}
+	if req.Protocol != "json" {
+		return fmt.Errorf("the protocol '%s' is not supported", req.Protocol)
+	}
+	if req.Version != 1 {
+		return fmt.Errorf("the server does not support version %d of the '%s' protocol", req.Version, req.Protocol)
+	}
+	return nil
+}
@@ -1,149 +1,494 @@
 package signalr
 
 import (
+	"context"
+	crand "crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
+	"elearning-5/internal/auth"
+	"elearning-5/internal/broker"
+	"elearning-5/internal/certs"
+	"elearning-5/internal/connlimit"
+	"elearning-5/internal/metrics"
+	"elearning-5/internal/origin"
+	"elearning-5/internal/policy"
+	"elearning-5/internal/presence"
+	"elearning-5/internal/ratelimit"
+	"elearning-5/internal/store"
+	"elearning-5/pkg/logger"
+	"elearning-5/pkg/middleware"
+
 	"github.com/gorilla/websocket"
 	"github.com/rs/cors"
 )
 
+const (
+	handshakeTimeout  = 15 * time.Second
+	keepAliveInterval = 15 * time.Second
+	clientTimeout     = 60 * time.Second
+	negotiateTimeout  = time.Minute
+)
+
+var pingMessage, _ = encodeMessage(SignalRMessage{Type: PingMessageType})
+
+// Options configures a SignalRServer. Zero values select the defaults.
+type Options struct {
+	// Auth verifies the token of negotiate requests and connections. Hub
+	// methods trust the user names clients pass when it is nil or has no
+	// keys.
+	Auth *auth.Verifier
+	// Policy decides who may join and post in each room; nil allows
+	// everything.
+	Policy *policy.Policy
+	// Limiter throttles SendMessage per connection, user and room; nil does
+	// not limit.
+	Limiter *ratelimit.Limiter
+	// Connections caps the open connections in total and per remote IP;
+	// nil does not cap.
+	Connections *connlimit.Limiter
+	// TLS serves wss:// and https:// with its current certificate; nil
+	// serves plain ws:// and http://.
+	TLS *certs.Reloader
+	// Origins lists the browser origins allowed by CORS and on /signalr
+	// upgrades; nil allows every origin.
+	Origins *origin.Allowlist
+	// Metrics records the server's activity and is served at /metrics;
+	// nil records nothing.
+	Metrics *metrics.Metrics
+	// Presence tracks the users of the connections, relays their typing
+	// indicators and answers GetRoomMembers; nil tracks nothing.
+	Presence *presence.Tracker
+}
+
 type SignalRServer struct {
-	hub      *Hub
-	upgrader websocket.Upgrader
+	hub        *Hub
+	options    Options
+	upgrader   websocket.Upgrader
+	mu         sync.RWMutex
+	httpServer *http.Server
+
+	negotiations map[string]negotiation // connection token -> pending connection
+	negotiateMu  sync.Mutex
+	dispatcher   *dispatcher
 }
 
-func NewSignalRServer() *SignalRServer {
-	return &SignalRServer{
-		hub: NewHub(),
+type negotiation struct {
+	connID  string
+	expires time.Time
+}
+
+type availableTransport struct {
+	Transport       string   `json:"transport"`
+	TransferFormats []string `json:"transferFormats"`
+}
+
+type negotiateResponse struct {
+	ConnectionToken     string               `json:"connectionToken,omitempty"`
+	ConnectionID        string               `json:"connectionId"`
+	NegotiateVersion    int                  `json:"negotiateVersion"`
+	AvailableTransports []availableTransport `json:"availableTransports"`
+}
+
+func NewSignalRServer(b broker.Broker, st store.MessageStore, opts Options) *SignalRServer {
+	s := &SignalRServer{
+		hub:     NewHub(b, st),
+		options: opts,
 		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool { return true },
+			CheckOrigin: opts.Origins.CheckOrigin,
 		},
+		negotiations: make(map[string]negotiation),
+		dispatcher:   newDispatcher(),
+	}
+	s.hub.policy = opts.Policy
+	s.hub.metrics = opts.Metrics
+	s.hub.presence = opts.Presence
+	if err := s.RegisterHub(ChatHub{}); err != nil {
+		panic(err)
 	}
+	return s
+}
+
+// RegisterHub makes the exported methods of hub invocable by clients. A
+// method may take a *HubContext as its first parameter; its other parameters
+// are decoded from the invocation arguments. It may return a result, an
+// error, or both, which are sent back as the invocation's completion.
+func (s *SignalRServer) RegisterHub(hub interface{}) error {
+	return s.dispatcher.register(hub)
 }
 
 func (s *SignalRServer) Start(port string) error {
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("SignalR server starting", "port", port, "metrics", s.options.Metrics != nil)
+	return s.Serve(lis)
+}
+
+// Serve runs the hub and serves the SignalR endpoints on lis until Shutdown
+// is called.
+func (s *SignalRServer) Serve(lis net.Listener) error {
 	go s.hub.Run()
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/signalr", s.handleSignalR)
+	authFailed := s.options.Metrics.AuthFailures(metrics.SignalR)
+	mux.Handle("/signalr", middleware.RequireAuth(s.options.Auth, authFailed, http.HandlerFunc(s.handleSignalR)))
+	mux.Handle("/signalr/negotiate", middleware.RequireAuth(s.options.Auth, authFailed, http.HandlerFunc(s.handleNegotiate)))
 	mux.HandleFunc("/signalr/health", s.healthCheck)
+	mux.HandleFunc("/signalr/stats", s.handleStats)
+	if s.options.Metrics != nil {
+		mux.Handle("/metrics", s.options.Metrics.Handler())
+	}
+
+	// The official clients send credentials and X-SignalR-User-Agent with
+	// negotiate, which the default CORS policy rejects
+	handler := s.options.Origins.CORS(cors.Options{
+		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
+		AllowedHeaders:   []string{"*"},
+		AllowCredentials: true,
+	}).Handler(mux)
+
+	s.mu.Lock()
+	s.httpServer = &http.Server{Handler: handler}
+	if s.options.TLS != nil {
+		s.httpServer.TLSConfig = s.options.TLS.ServerConfig()
+	}
+	httpServer := s.httpServer
+	s.mu.Unlock()
+
+	var err error
+	if httpServer.TLSConfig != nil {
+		// The certificate comes from TLSConfig.GetCertificate
+		err = httpServer.ServeTLS(lis, "", "")
+	} else {
+		err = httpServer.Serve(lis)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
 
-	handler := cors.Default().Handler(mux)
+// Shutdown stops accepting connections, flushes every connection's send
+// queue, closes the connections with a going-away close frame and stops the
+// hub. It gives up when ctx expires.
+func (s *SignalRServer) Shutdown(ctx context.Context) error {
+	s.mu.RLock()
+	httpServer := s.httpServer
+	s.mu.RUnlock()
 
-	log.Printf("🚀 SignalR-like server listening on :%s", port)
-	return http.ListenAndServe(":"+port, handler)
+	if httpServer != nil {
+		if err := httpServer.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	return s.hub.Shutdown(ctx)
 }
 
 func (s *SignalRServer) handleSignalR(w http.ResponseWriter, r *http.Request) {
+	// The caps are checked first so that a refused client keeps its
+	// connection token for a retry
+	release, err := s.options.Connections.Acquire(connlimit.Host(r.RemoteAddr))
+	if err != nil {
+		slog.Warn("SignalR connection refused", logger.RemoteKey, r.RemoteAddr, "err", err)
+		connlimit.Reject(w, err)
+		return
+	}
+
+	// Clients that negotiated connect with their connection token, clients
+	// that skip negotiation get a fresh connection ID
+	connID := generateConnectionID()
+	if token := r.URL.Query().Get("id"); token != "" {
+		id, ok := s.claimNegotiation(token)
+		if !ok {
+			release()
+			http.Error(w, "No Connection with that ID", http.StatusNotFound)
+			return
+		}
+		connID = id
+	}
+
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("SignalR WebSocket upgrade failed: %v", err)
+		release()
+		slog.Warn("SignalR WebSocket upgrade failed", logger.RemoteKey, r.RemoteAddr, "err", err)
 		return
 	}
 
-	connection := &Connection{
-		ID:     generateConnectionID(),
-		Send:   make(chan []byte, 256),
-		Groups: make(map[string]bool),
+	pending, err := s.handshake(conn)
+	if err != nil {
+		release()
+		slog.Warn("SignalR handshake failed", logger.ConnKey, connID, logger.RemoteKey, r.RemoteAddr, "err", err)
+		conn.Close()
+		return
 	}
 
+	connection := NewConnection(connID)
+	connection.release = release
+	connection.User, _ = auth.UserFrom(r.Context())
+	connection.log = logger.Conn(metrics.SignalR, connID, r.RemoteAddr)
+	if connection.User != "" {
+		connection.log = connection.log.With(logger.UserKey, connection.User)
+	}
+	connection.limit = s.options.Limiter.NewConn()
+	connection.presence = s.options.Presence.Connect(metrics.SignalR)
+	connection.presence.Identify(connection.User)
 	s.hub.AddConnection(connection)
 
 	// Start goroutines for this connection
 	go s.writePump(conn, connection)
-	go s.readPump(conn, connection)
+	go s.readPump(conn, connection, pending)
+}
+
+// handshake reads the client's handshake request and answers it. Records
+// that arrived in the same frame after the handshake are returned so that
+// they can be processed once the connection is registered.
+func (s *SignalRServer) handshake(conn *websocket.Conn) ([][]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	_, frame, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	records := splitRecords(frame)
+	if len(records) == 0 {
+		err = errors.New("empty handshake request")
+	} else {
+		err = parseHandshake(records[0])
+	}
+
+	response := handshakeResponse{}
+	if err != nil {
+		response.Error = err.Error()
+	}
+	data, _ := encodeMessage(response)
+
+	conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if werr := conn.WriteMessage(websocket.TextMessage, data); werr != nil {
+		return nil, werr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return records[1:], nil
 }
 
 func (s *SignalRServer) writePump(conn *websocket.Conn, connection *Connection) {
+	ticker := time.NewTicker(keepAliveInterval)
 	defer func() {
+		ticker.Stop()
 		conn.Close()
 		s.hub.RemoveConnection(connection.ID)
+		close(connection.done)
 	}()
 
 	for {
 		select {
 		case message, ok := <-connection.Send:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if !ok {
-				conn.WriteMessage(websocket.CloseMessage, []byte{})
+				// Hub closed the channel after everything queued was written
+				closeMsg := []byte{}
+				if connection.closeCode != 0 {
+					closing := SignalRMessage{
+						Type:           CloseMessageType,
+						Error:          "Server is shutting down",
+						AllowReconnect: true,
+					}
+					text := "server shutting down"
+					if connection.closeReason != "" {
+						closing = SignalRMessage{Type: CloseMessageType, Error: connection.closeReason}
+						text = connection.closeReason
+					}
+					data, _ := encodeMessage(closing)
+					conn.WriteMessage(websocket.TextMessage, data)
+					closeMsg = websocket.FormatCloseMessage(connection.closeCode, text)
+				}
+				conn.WriteMessage(websocket.CloseMessage, closeMsg)
 				return
 			}
 
-			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if err := conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
+			s.hub.metrics.Sent(metrics.SignalR, len(message))
+
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := conn.WriteMessage(websocket.TextMessage, pingMessage); err != nil {
+				return
+			}
 		}
 	}
 }
 
-func (s *SignalRServer) readPump(conn *websocket.Conn, connection *Connection) {
+func (s *SignalRServer) readPump(conn *websocket.Conn, connection *Connection, pending [][]byte) {
 	defer func() {
+		connection.streams.close()
 		conn.Close()
 		s.hub.RemoveConnection(connection.ID)
+		connection.presence.Close()
+		if connection.release != nil {
+			connection.release()
+		}
 	}()
 
+	for _, record := range pending {
+		if !s.handleRecord(connection, record) {
+			return
+		}
+	}
+
 	conn.SetReadLimit(512 * 1024)
-	conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+	conn.SetReadDeadline(time.Now().Add(clientTimeout))
 	conn.SetPongHandler(func(string) error {
-		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		conn.SetReadDeadline(time.Now().Add(clientTimeout))
 		return nil
 	})
 
 	for {
-		_, message, err := conn.ReadMessage()
+		_, frame, err := conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("SignalR read error: %v", err)
+				connection.log.Warn("SignalR read failed", "err", err)
 			}
 			break
 		}
 
-		var signalrMsg SignalRMessage
-		if err := json.Unmarshal(message, &signalrMsg); err != nil {
-			log.Printf("Invalid SignalR message: %v", err)
-			continue
+		// Any message, including pings, proves the client is alive
+		conn.SetReadDeadline(time.Now().Add(clientTimeout))
+
+		for _, record := range splitRecords(frame) {
+			if !s.handleRecord(connection, record) {
+				return
+			}
 		}
+	}
+}
 
-		s.handleSignalRMessage(connection, signalrMsg)
+// handleRecord decodes and handles one hub protocol record. It returns false
+// when the client closed the connection.
+func (s *SignalRServer) handleRecord(conn *Connection, record []byte) bool {
+	var msg incomingMessage
+	if err := json.Unmarshal(record, &msg); err != nil {
+		conn.log.Warn("Invalid SignalR message", "err", err)
+		return true
 	}
+	if msg.Type != PingMessageType {
+		s.hub.metrics.Received(metrics.SignalR, len(record))
+	}
+	// Pings are the heartbeat of idle clients
+	conn.presence.Heartbeat()
+
+	return s.handleSignalRMessage(conn, msg)
 }
 
-func (s *SignalRServer) handleSignalRMessage(conn *Connection, msg SignalRMessage) {
+func (s *SignalRServer) handleSignalRMessage(conn *Connection, msg incomingMessage) bool {
 	switch msg.Type {
-	case 1: // Invocation
-		if msg.Target == "JoinGroup" && len(msg.Arguments) > 0 {
-			group := msg.Arguments[0].(string)
-			conn.Groups[group] = true
-
-			response := map[string]interface{}{
-				"type":   3,
-				"result": "Joined group: " + group,
-			}
-			data, _ := json.Marshal(response)
-			conn.Send <- data
+	case InvocationMessageType, StreamInvocationMessageType:
+		s.invoke(conn, msg)
+
+	case StreamItemMessageType:
+		conn.streams.sendItem(msg.InvocationId, msg.Item)
+
+	case CompletionMessageType:
+		// Clients complete their upload streams with a Completion
+		if msg.Error != "" {
+			conn.log.Warn("SignalR client stream failed", "invocation", msg.InvocationId, "err", msg.Error)
 		}
+		conn.streams.completeUpload(msg.InvocationId)
+
+	case CancelInvocationMessageType:
+		conn.streams.cancelInvocation(msg.InvocationId)
+
+	case PingMessageType:
+		// Keep-alive only, the read deadline was already extended
 
-	case 2: // StreamItem
-		// Handle stream items
-	case 3: // Completion
-		// Handle completion
-	case 4: // StreamInvocation
-		// Handle stream invocation
-	case 5: // CancelInvocation
-		// Handle cancellation
-	case 6: // Ping
-		// Respond to ping
-		response := map[string]interface{}{
-			"type": 6,
+	case CloseMessageType:
+		return false
+
+	default:
+		// Unknown message types are ignored for forward compatibility
+	}
+	return true
+}
+
+func (s *SignalRServer) sendCompletion(connID, invocationID string, result interface{}, err error) {
+	completion := SignalRMessage{
+		Type:         CompletionMessageType,
+		InvocationId: invocationID,
+		Result:       result,
+	}
+	if err != nil {
+		completion.Result = nil
+		completion.Error = err.Error()
+	}
+	s.hub.SendToConnection(connID, completion)
+}
+
+func (s *SignalRServer) handleNegotiate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	version, _ := strconv.Atoi(r.URL.Query().Get("negotiateVersion"))
+
+	response := negotiateResponse{
+		ConnectionID: generateConnectionID(),
+		AvailableTransports: []availableTransport{
+			{Transport: "WebSockets", TransferFormats: []string{"Text"}},
+		},
+	}
+
+	// Version 0 clients connect with the connection ID itself
+	token := response.ConnectionID
+	if version >= 1 {
+		token = generateConnectionToken()
+		response.NegotiateVersion = 1
+		response.ConnectionToken = token
+	}
+
+	s.negotiateMu.Lock()
+	now := time.Now()
+	for t, n := range s.negotiations {
+		if now.After(n.expires) {
+			delete(s.negotiations, t)
 		}
-		data, _ := json.Marshal(response)
-		conn.Send <- data
 	}
+	s.negotiations[token] = negotiation{connID: response.ConnectionID, expires: now.Add(negotiateTimeout)}
+	s.negotiateMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// claimNegotiation resolves a connection token handed out by negotiate. Each
+// token can be used once.
+func (s *SignalRServer) claimNegotiation(token string) (string, bool) {
+	s.negotiateMu.Lock()
+	defer s.negotiateMu.Unlock()
+
+	n, ok := s.negotiations[token]
+	if !ok {
+		return "", false
+	}
+	delete(s.negotiations, token)
+	if time.Now().After(n.expires) {
+		return "", false
+	}
+	return n.connID, true
 }
 
 func (s *SignalRServer) healthCheck(w http.ResponseWriter, r *http.Request) {
@@ -155,6 +500,25 @@ func (s *SignalRServer) healthCheck(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func (s *SignalRServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"active_connections": s.hub.ConnectionCount(),
+		"connection_limit":   s.options.Connections.Stats(),
+		"timestamp":          time.Now().Format(time.RFC3339),
+	})
+}
+
 func generateConnectionID() string {
 	return fmt.Sprintf("conn_%d_%d", time.Now().UnixNano(), rand.Int63())
 }
+
+func generateConnectionToken() string {
+	b := make([]byte, 16)
+	crand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func generateMessageID() string {
+	return fmt.Sprintf("msg_%d_%d", time.Now().UnixNano(), rand.Int63())
+}
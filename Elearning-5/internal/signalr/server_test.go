@@ -0,0 +1,142 @@
+package signalr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"elearning-5/internal/broker"
+	"elearning-5/internal/connlimit"
+	"elearning-5/internal/store"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestSignalRServer serves a SignalRServer on a local port and returns it
+// with its address.
+func newTestSignalRServer(t *testing.T, opts Options) (*SignalRServer, string) {
+	t.Helper()
+
+	b := broker.NewMemoryBroker()
+	s := NewSignalRServer(b, store.NewMemoryStore(0), opts)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+		b.Close()
+	})
+	return s, lis.Addr().String()
+}
+
+// dialSignalR opens /signalr and sends handshake as the first frame.
+func dialSignalR(t *testing.T, addr, handshake string) *websocket.Conn {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/signalr", nil)
+	if err != nil {
+		t.Fatalf("dial /signalr: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(handshake)); err != nil {
+		t.Fatalf("send handshake: %v", err)
+	}
+	return conn
+}
+
+// connectSignalR opens /signalr and completes a JSON protocol handshake.
+func connectSignalR(t *testing.T, addr string) *websocket.Conn {
+	t.Helper()
+
+	conn := dialSignalR(t, addr, "{\"protocol\":\"json\",\"version\":1}\x1e")
+	if response := readRecord(t, conn); len(response) != 0 {
+		t.Fatalf("handshake response = %v, want an empty object", response)
+	}
+	return conn
+}
+
+// readRecord reads the next hub protocol record, skipping pings. Every
+// record must end with the record separator.
+func readRecord(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		_, frame, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v", err)
+		}
+		if len(frame) == 0 || frame[len(frame)-1] != RecordSeparator {
+			t.Fatalf("frame %q does not end with the record separator", frame)
+		}
+		var msg map[string]interface{}
+		if err := json.Unmarshal(bytes.TrimSuffix(frame, []byte{RecordSeparator}), &msg); err != nil {
+			t.Fatalf("decode %q: %v", frame, err)
+		}
+		if msg["type"] != float64(PingMessageType) {
+			return msg
+		}
+	}
+}
+
+func TestConnectionsOverTheCapAreRefused(t *testing.T) {
+	caps := connlimit.New(connlimit.Limits{Max: 1})
+	s := NewSignalRServer(broker.NewMemoryBroker(), store.NewMemoryStore(0), Options{Connections: caps})
+	if _, err := caps.Acquire("10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	s.handleNegotiate(w, httptest.NewRequest("POST", "/signalr/negotiate?negotiateVersion=1", nil))
+	var negotiated negotiateResponse
+	if err := json.NewDecoder(w.Body).Decode(&negotiated); err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	s.handleSignalR(w, httptest.NewRequest("GET", "/signalr?id="+negotiated.ConnectionToken, nil))
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "10" {
+		t.Errorf("response = %d with Retry-After %q, want 503 with Retry-After 10", w.Code, w.Header().Get("Retry-After"))
+	}
+	if got := caps.Stats(); got.Active != 1 || got.Rejected != 1 {
+		t.Errorf("caps = %+v, want the refused connection counted as rejected only", got)
+	}
+	if _, ok := s.claimNegotiation(negotiated.ConnectionToken); !ok {
+		t.Error("refused connection used up its connection token")
+	}
+}
+
+func TestShutdownSendsCloseMessage(t *testing.T) {
+	s, addr := newTestSignalRServer(t, Options{})
+	conn := connectSignalR(t, addr)
+	for deadline := time.Now().Add(2 * time.Second); s.hub.ConnectionCount() == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("connection was not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	msg := readRecord(t, conn)
+	if msg["type"] != float64(CloseMessageType) || msg["allowReconnect"] != true {
+		t.Errorf("received %v, want a Close message that allows reconnecting", msg)
+	}
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("connection ended with %v, want a going-away close frame", err)
+	}
+}
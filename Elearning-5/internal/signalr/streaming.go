@@ -0,0 +1,263 @@
+package signalr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"reflect"
+	"sync"
+	"time"
+
+	"elearning-5/internal/metrics"
+	"elearning-5/internal/tracing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// uploadBuffer is the number of client stream items queued for a hub method
+// before the connection's read loop waits for it.
+const uploadBuffer = 16
+
+var errConnectionClosed = errors.New("connection is closed")
+
+// uploadStream is a client-to-server stream feeding a hub method parameter.
+type uploadStream struct {
+	ch   reflect.Value // chan T handed to the hub method
+	elem reflect.Type
+	ctx  context.Context // done once the hub method has returned
+}
+
+// connStreams tracks the streams that are open on one connection. Upload
+// channels are only sent to and closed by the connection's read loop.
+type connStreams struct {
+	mutex   sync.Mutex
+	uploads map[string]*uploadStream      // by stream ID
+	cancels map[string]context.CancelFunc // streaming invocations by invocation ID
+
+	ctx    context.Context // canceled when the connection closes
+	cancel context.CancelFunc
+}
+
+func newConnStreams() *connStreams {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &connStreams{
+		uploads: make(map[string]*uploadStream),
+		cancels: make(map[string]context.CancelFunc),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+func (cs *connStreams) addUploads(ctx context.Context, uploads map[string]reflect.Value) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	for id, ch := range uploads {
+		cs.uploads[id] = &uploadStream{ch: ch, elem: ch.Type().Elem(), ctx: ctx}
+	}
+}
+
+// sendItem decodes a StreamItem and hands it to the hub method reading the
+// stream, waiting while the method's buffer is full.
+func (cs *connStreams) sendItem(streamID string, item json.RawMessage) {
+	cs.mutex.Lock()
+	up, ok := cs.uploads[streamID]
+	cs.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	value := reflect.New(up.elem)
+	if err := json.Unmarshal(item, value.Interface()); err != nil {
+		slog.Warn("Invalid SignalR stream item", "stream", streamID, "err", err)
+		return
+	}
+
+	reflect.Select([]reflect.SelectCase{
+		{Dir: reflect.SelectSend, Chan: up.ch, Send: value.Elem()},
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(up.ctx.Done())},
+	})
+}
+
+// completeUpload ends a client stream by closing its channel.
+func (cs *connStreams) completeUpload(streamID string) {
+	cs.mutex.Lock()
+	up, ok := cs.uploads[streamID]
+	delete(cs.uploads, streamID)
+	cs.mutex.Unlock()
+
+	if ok {
+		up.ch.Close()
+	}
+}
+
+// addInvocation returns the context of a new invocation that CancelInvocation
+// can stop by its ID, and the function that releases it once it has finished.
+func (cs *connStreams) addInvocation(invocationID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(cs.ctx)
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if invocationID != "" {
+		cs.cancels[invocationID] = cancel
+	}
+	return ctx, func() {
+		cs.cancelInvocation(invocationID)
+		cancel()
+	}
+}
+
+// cancelInvocation stops a streaming invocation.
+func (cs *connStreams) cancelInvocation(invocationID string) {
+	cs.mutex.Lock()
+	cancel, ok := cs.cancels[invocationID]
+	delete(cs.cancels, invocationID)
+	cs.mutex.Unlock()
+
+	if ok {
+		cancel()
+	}
+}
+
+// close cancels every invocation and ends every client stream. It must be
+// called from the connection's read loop.
+func (cs *connStreams) close() {
+	cs.cancel()
+
+	cs.mutex.Lock()
+	uploads := cs.uploads
+	cs.uploads = make(map[string]*uploadStream)
+	cs.cancels = make(map[string]context.CancelFunc)
+	cs.mutex.Unlock()
+
+	for _, up := range uploads {
+		up.ch.Close()
+	}
+}
+
+// invoke runs an Invocation or StreamInvocation. Methods that stream results
+// or read client streams run on their own goroutine so that the read loop
+// can keep routing stream items and cancellations.
+func (s *SignalRServer) invoke(conn *Connection, msg incomingMessage) {
+	streamInvocation := msg.Type == StreamInvocationMessageType
+	ctx := &HubContext{
+		ConnectionID: conn.ID,
+		User:         conn.User,
+		Hub:          s.hub,
+		limit:        conn.limit,
+		presence:     conn.presence,
+		log:          conn.log,
+		ctx:          conn.streams.ctx,
+	}
+	release := func() {}
+	if streamInvocation || len(msg.StreamIds) > 0 {
+		ctx.ctx, release = conn.streams.addInvocation(msg.InvocationId)
+	}
+	var span trace.Span
+	ctx.ctx, span = tracing.Start(tracing.Extract(ctx.ctx, msg.Headers[tracing.Header]), tracing.ReceiveSpan,
+		tracing.ProtocolKey.String(metrics.SignalR), tracing.MethodKey.String(msg.Target), tracing.UserKey.String(conn.User))
+
+	c, err := s.dispatcher.prepare(ctx, msg.Target, msg.Arguments, msg.StreamIds, streamInvocation)
+	if err != nil {
+		tracing.End(span, err)
+		release()
+		if msg.InvocationId != "" {
+			s.sendCompletion(conn.ID, msg.InvocationId, nil, err)
+		}
+		return
+	}
+
+	if !streamInvocation && len(c.uploads) == 0 {
+		result, err := c.run()
+		tracing.End(span, err)
+		// Invocations without an ID are fire-and-forget
+		if msg.InvocationId != "" {
+			s.sendCompletion(conn.ID, msg.InvocationId, result, err)
+		}
+		return
+	}
+
+	conn.streams.addUploads(ctx.ctx, c.uploads)
+
+	go func() {
+		defer release()
+
+		result, err := c.run()
+		tracing.End(span, err)
+		if streamInvocation && err == nil {
+			s.streamResults(ctx.Context(), conn.ID, msg.InvocationId, reflect.ValueOf(result))
+			return
+		}
+		if msg.InvocationId != "" {
+			s.sendCompletion(conn.ID, msg.InvocationId, result, err)
+		}
+	}()
+}
+
+// streamResults sends every item of a hub method's result channel as a
+// StreamItem, followed by a Completion once the channel is closed. Nothing
+// more is sent after the invocation is canceled.
+func (s *SignalRServer) streamResults(ctx context.Context, connID, invocationID string, ch reflect.Value) {
+	if !ch.IsValid() || ch.IsNil() {
+		s.sendCompletion(connID, invocationID, nil, nil)
+		return
+	}
+
+	cases := []reflect.SelectCase{
+		{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+		{Dir: reflect.SelectRecv, Chan: ch},
+	}
+	for {
+		chosen, item, ok := reflect.Select(cases)
+		// A canceled producer usually closes its channel too, and select
+		// picks among ready cases at random
+		if chosen == 0 || ctx.Err() != nil {
+			return
+		}
+		if !ok {
+			s.sendCompletion(connID, invocationID, nil, nil)
+			return
+		}
+
+		err := s.hub.sendToConnectionWait(ctx, connID, SignalRMessage{
+			Type:         StreamItemMessageType,
+			InvocationId: invocationID,
+			Item:         item.Interface(),
+		})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sendToConnectionWait queues a message like SendToConnection, but waits
+// while the connection's send queue is full instead of dropping the
+// connection, so that streams are paced by the client.
+func (h *Hub) sendToConnectionWait(ctx context.Context, connID string, message interface{}) error {
+	data, err := encodeMessage(message)
+	if err != nil {
+		return err
+	}
+
+	for {
+		h.mutex.RLock()
+		conn, exists := h.connections[connID]
+		sent := exists && h.trySend(conn, data)
+		h.mutex.RUnlock()
+
+		if sent {
+			return nil
+		}
+		if !exists {
+			return errConnectionClosed
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package signalr
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"elearning-5/internal/broker"
+	"elearning-5/internal/store"
+)
+
+type streamHub struct{}
+
+func (streamHub) Count(ctx *HubContext, n int) <-chan int {
+	ch := make(chan int)
+	go func() {
+		defer close(ch)
+		for i := 0; i < n; i++ {
+			select {
+			case ch <- i:
+			case <-ctx.Context().Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func (streamHub) Sum(numbers <-chan int) int {
+	total := 0
+	for n := range numbers {
+		total += n
+	}
+	return total
+}
+
+func newStreamTestServer(t *testing.T) (*SignalRServer, *Connection) {
+	t.Helper()
+	s := NewSignalRServer(broker.NewMemoryBroker(), store.NewMemoryStore(0), Options{})
+	if err := s.RegisterHub(streamHub{}); err != nil {
+		t.Fatal(err)
+	}
+	conn := NewConnection("conn")
+	s.hub.AddConnection(conn)
+	t.Cleanup(conn.streams.close)
+	return s, conn
+}
+
+func handle(t *testing.T, s *SignalRServer, conn *Connection, record string) {
+	t.Helper()
+	var msg incomingMessage
+	if err := json.Unmarshal([]byte(record), &msg); err != nil {
+		t.Fatal(err)
+	}
+	s.handleSignalRMessage(conn, msg)
+}
+
+// next waits for the next message queued for conn.
+func next(t *testing.T, conn *Connection) map[string]interface{} {
+	t.Helper()
+	select {
+	case data := <-conn.Send:
+		var msg map[string]interface{}
+		if err := json.Unmarshal(bytes.TrimSuffix(data, []byte{RecordSeparator}), &msg); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+func TestStreamInvocationSendsItemsThenCompletion(t *testing.T) {
+	s, conn := newStreamTestServer(t)
+	handle(t, s, conn, `{"type":4,"invocationId":"7","target":"Count","arguments":[3]}`)
+
+	for i := 0; i < 3; i++ {
+		msg := next(t, conn)
+		if msg["type"] != float64(StreamItemMessageType) || msg["invocationId"] != "7" || msg["item"] != float64(i) {
+			t.Fatalf("message %d = %v, want stream item %d", i, msg, i)
+		}
+	}
+	if msg := next(t, conn); msg["type"] != float64(CompletionMessageType) || msg["error"] != nil {
+		t.Fatalf("final message = %v, want completion", msg)
+	}
+}
+
+func TestStreamingMethodRequiresStreamInvocation(t *testing.T) {
+	s, conn := newStreamTestServer(t)
+	handle(t, s, conn, `{"type":1,"invocationId":"1","target":"Count","arguments":[3]}`)
+
+	if msg := next(t, conn); msg["type"] != float64(CompletionMessageType) || msg["error"] == nil {
+		t.Fatalf("message = %v, want error completion", msg)
+	}
+}
+
+func TestClientStreamFeedsChannelParameter(t *testing.T) {
+	s, conn := newStreamTestServer(t)
+	handle(t, s, conn, `{"type":1,"invocationId":"1","target":"Sum","arguments":[],"streamIds":["s1"]}`)
+	for _, item := range []string{"1", "2", "3"} {
+		handle(t, s, conn, `{"type":2,"invocationId":"s1","item":`+item+`}`)
+	}
+	handle(t, s, conn, `{"type":3,"invocationId":"s1"}`)
+
+	msg := next(t, conn)
+	if msg["type"] != float64(CompletionMessageType) || msg["invocationId"] != "1" || msg["result"] != float64(6) {
+		t.Fatalf("message = %v, want completion with result 6", msg)
+	}
+}
+
+func TestCancelInvocationStopsStream(t *testing.T) {
+	s, conn := newStreamTestServer(t)
+	handle(t, s, conn, `{"type":4,"invocationId":"9","target":"Count","arguments":[1000000]}`)
+
+	// Let the stream fill the send queue, then cancel it
+	next(t, conn)
+	handle(t, s, conn, `{"type":5,"invocationId":"9"}`)
+
+	// Items already queued may still arrive, but the stream must go quiet
+	// without ever completing
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case data := <-conn.Send:
+			var msg map[string]interface{}
+			json.Unmarshal(bytes.TrimSuffix(data, []byte{RecordSeparator}), &msg)
+			if msg["type"] == float64(CompletionMessageType) {
+				t.Fatalf("canceled stream sent a completion: %v", msg)
+			}
+		case <-time.After(200 * time.Millisecond):
+			return
+		case <-deadline:
+			t.Fatal("stream kept sending items after it was canceled")
+		}
+	}
+}
@@ -0,0 +1,253 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"elearning-5/internal/broker"
+)
+
+// logFileName is the append-only log inside a DiskStore directory.
+const logFileName = "messages.log"
+
+// DiskStore keeps every message in an append-only log of JSON records, one
+// per line. Deletions append a tombstone. An in-memory index of record
+// offsets per room is rebuilt from the log on open, so ranges read only the
+// records they return.
+//
+// A DiskStore directory must not be shared between processes.
+type DiskStore struct {
+	file   *os.File
+	size   int64                  // offset where the next record is written
+	rooms  map[string][]diskEntry // room -> index, oldest first
+	seqs   map[string]uint64      // room -> last assigned sequence number
+	mutex  sync.RWMutex
+	closed bool
+}
+
+type diskEntry struct {
+	id     string
+	seq    uint64
+	time   time.Time
+	offset int64
+	length int
+}
+
+type diskRecord struct {
+	Op      string          `json:"op"` // append or delete
+	Message *broker.Message `json:"message,omitempty"`
+	Room    string          `json:"room,omitempty"`
+	ID      string          `json:"id,omitempty"`
+}
+
+// OpenDiskStore opens or creates the log in dir and indexes it. A record
+// torn by a crash at the end of the log is discarded.
+func OpenDiskStore(dir string) (*DiskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &DiskStore{
+		file:  file,
+		rooms: make(map[string][]diskEntry),
+		seqs:  make(map[string]uint64),
+	}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replays the log into the index.
+func (s *DiskStore) load() error {
+	reader := bufio.NewReader(io.NewSectionReader(s.file, 0, 1<<62))
+	var offset int64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(line) > 0 {
+				slog.Warn("Discarding torn record of message log", "offset", offset)
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var record diskRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return fmt.Errorf("corrupt record at offset %d of message log: %w", offset, err)
+		}
+		s.apply(record, offset, len(line))
+		offset += int64(len(line))
+	}
+
+	s.size = offset
+	return s.file.Truncate(offset)
+}
+
+// apply updates the index with a record written at offset.
+func (s *DiskStore) apply(record diskRecord, offset int64, length int) {
+	switch record.Op {
+	case "append":
+		if record.Message == nil {
+			return
+		}
+		msg := *record.Message
+		if msg.Seq == 0 {
+			// Logged before messages were numbered
+			msg.Seq = s.seqs[msg.Room] + 1
+		}
+		s.seqs[msg.Room] = msg.Seq
+		s.rooms[msg.Room] = append(s.rooms[msg.Room], diskEntry{
+			id:     msg.ID,
+			seq:    msg.Seq,
+			time:   messageTime(msg),
+			offset: offset,
+			length: length,
+		})
+
+	case "delete":
+		entries := s.rooms[record.Room]
+		for i, e := range entries {
+			if e.id == record.ID {
+				s.rooms[record.Room] = append(entries[:i:i], entries[i+1:]...)
+				break
+			}
+		}
+		if len(s.rooms[record.Room]) == 0 {
+			delete(s.rooms, record.Room)
+		}
+	}
+}
+
+// write appends a record to the log and returns its offset and length.
+// It must be called with the write lock held.
+func (s *DiskStore) write(record diskRecord) (int64, int, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return 0, 0, err
+	}
+	data = append(data, '\n')
+
+	offset := s.size
+	if _, err := s.file.WriteAt(data, offset); err != nil {
+		return 0, 0, err
+	}
+	s.size += int64(len(data))
+	return offset, len(data), nil
+}
+
+func (s *DiskStore) Append(msg broker.Message) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return 0, ErrClosed
+	}
+
+	msg.Seq = s.seqs[msg.Room] + 1
+	record := diskRecord{Op: "append", Message: &msg}
+	offset, length, err := s.write(record)
+	if err != nil {
+		return 0, err
+	}
+	s.apply(record, offset, length)
+	return msg.Seq, nil
+}
+
+func (s *DiskStore) Range(q Query) ([]broker.Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	// The log keeps every message, so nothing is ever evicted
+	if err := checkAfterSeq(q, 0, s.seqs[q.Room]); err != nil {
+		return nil, err
+	}
+
+	entries := s.rooms[q.Room]
+	lo, hi, err := selectRange(len(entries), func(i int) key {
+		return key{id: entries[i].id, seq: entries[i].seq, time: entries[i].time}
+	}, q)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs := make([]broker.Message, 0, hi-lo)
+	for _, e := range entries[lo:hi] {
+		data := make([]byte, e.length)
+		if _, err := s.file.ReadAt(data, e.offset); err != nil {
+			return nil, err
+		}
+		var record diskRecord
+		if err := json.Unmarshal(data, &record); err != nil || record.Message == nil {
+			return nil, fmt.Errorf("corrupt record at offset %d of message log", e.offset)
+		}
+		record.Message.Seq = e.seq
+		msgs = append(msgs, *record.Message)
+	}
+	return msgs, nil
+}
+
+func (s *DiskStore) Delete(room, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	found := false
+	for _, e := range s.rooms[room] {
+		if e.id == id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return ErrNotFound
+	}
+
+	record := diskRecord{Op: "delete", Room: room, ID: id}
+	offset, length, err := s.write(record)
+	if err != nil {
+		return err
+	}
+	s.apply(record, offset, length)
+	return nil
+}
+
+// Close flushes the log to disk and closes it.
+func (s *DiskStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
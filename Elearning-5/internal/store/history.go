@@ -0,0 +1,85 @@
+package store
+
+import (
+	"errors"
+
+	"elearning-5/internal/broker"
+)
+
+// MaxResume is the largest number of missed messages sent to a resuming
+// client; it stays below the send queue sizes of the protocols. A longer gap
+// has to be reloaded through the history APIs.
+const MaxResume = 200
+
+// ErrGapTooLarge is returned by Resume when the missed messages cannot all
+// be sent, because there are too many or they are no longer stored.
+var ErrGapTooLarge = errors.New("gap too large, reload")
+
+const (
+	// DefaultPageSize is the number of messages replayed on join and
+	// returned per history page when the client does not ask for a size.
+	DefaultPageSize = 50
+	// MaxPageSize caps the size clients can ask for.
+	MaxPageSize = 200
+)
+
+// Page is one page of a room's history, oldest message first.
+type Page struct {
+	Messages []broker.Message `json:"messages"`
+	// NextBefore is the cursor for the page of older messages, empty when
+	// this page reaches the start of the history.
+	NextBefore string `json:"next_before,omitempty"`
+}
+
+// History returns up to limit messages of room older than the message with
+// ID before, or the newest ones when before is empty.
+func History(s MessageStore, room, before string, limit int) (Page, error) {
+	limit = pageSize(limit)
+
+	// Ask for one more to learn whether an older page exists
+	msgs, err := s.Range(Query{Room: room, Before: before, Limit: limit + 1, Latest: true})
+	if err != nil {
+		return Page{}, err
+	}
+
+	page := Page{Messages: msgs}
+	if len(msgs) > limit {
+		page.Messages = msgs[1:]
+		page.NextBefore = page.Messages[0].ID
+	}
+	return page, nil
+}
+
+// Replay returns what a client joining room sees before live traffic:
+// every message after the one with ID since, or the last limit messages
+// when since is empty or no longer in the store.
+func Replay(s MessageStore, room, since string, limit int) ([]broker.Message, error) {
+	if since != "" {
+		msgs, err := s.Range(Query{Room: room, After: since})
+		if !errors.Is(err, ErrNotFound) {
+			return msgs, err
+		}
+	}
+	return s.Range(Query{Room: room, Limit: pageSize(limit), Latest: true})
+}
+
+// Resume returns the messages of room after sequence number lastSeq, the
+// last one the client received.
+func Resume(s MessageStore, room string, lastSeq uint64) ([]broker.Message, error) {
+	msgs, err := s.Range(Query{Room: room, AfterSeq: lastSeq, Limit: MaxResume + 1})
+	if errors.Is(err, ErrNotFound) || len(msgs) > MaxResume {
+		return nil, ErrGapTooLarge
+	}
+	return msgs, err
+}
+
+func pageSize(limit int) int {
+	switch {
+	case limit <= 0:
+		return DefaultPageSize
+	case limit > MaxPageSize:
+		return MaxPageSize
+	default:
+		return limit
+	}
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHistoryPages(t *testing.T) {
+	s := NewMemoryStore(0)
+	for i := 0; i < 5; i++ {
+		s.Append(message("room1", i))
+	}
+
+	var got [][]string
+	before := ""
+	for {
+		page, err := History(s, "room1", before, 2)
+		if err != nil {
+			t.Fatalf("History: %v", err)
+		}
+		got = append(got, ids(page.Messages))
+		if page.NextBefore == "" {
+			break
+		}
+		before = page.NextBefore
+	}
+
+	want := [][]string{{"room1-3", "room1-4"}, {"room1-1", "room1-2"}, {"room1-0"}}
+	if len(got) != len(want) {
+		t.Fatalf("pages = %v, want %v", got, want)
+	}
+	for i := range want {
+		if !equal(got[i], want[i]) {
+			t.Errorf("page %d = %v, want %v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	s := NewMemoryStore(0)
+	for i := 0; i < 5; i++ {
+		s.Append(message("room1", i))
+	}
+
+	tests := []struct {
+		name  string
+		since string
+		limit int
+		want  []string
+	}{
+		{"last messages", "", 2, []string{"room1-3", "room1-4"}},
+		{"since ID", "room1-1", 2, []string{"room1-2", "room1-3", "room1-4"}},
+		{"unknown ID", "missing", 1, []string{"room1-4"}},
+	}
+	for _, tt := range tests {
+		msgs, err := Replay(s, "room1", tt.since, tt.limit)
+		if err != nil {
+			t.Errorf("%s: Replay: %v", tt.name, err)
+			continue
+		}
+		if got := ids(msgs); !equal(got, tt.want) {
+			t.Errorf("%s: Replay = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	s := NewMemoryStore(MaxResume + 2)
+	for i := 0; i < 5; i++ {
+		s.Append(message("room1", i))
+	}
+
+	msgs, err := Resume(s, "room1", 3)
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if got, want := ids(msgs), []string{"room1-3", "room1-4"}; !equal(got, want) {
+		t.Errorf("Resume = %v, want %v", got, want)
+	}
+	if msgs[0].Seq != 4 {
+		t.Errorf("resumed message has sequence number %d, want 4", msgs[0].Seq)
+	}
+
+	if _, err := Resume(s, "room1", 99); !errors.Is(err, ErrGapTooLarge) {
+		t.Errorf("Resume from the future error = %v, want ErrGapTooLarge", err)
+	}
+
+	for i := 5; i < MaxResume+2; i++ {
+		s.Append(message("room1", i))
+	}
+	if _, err := Resume(s, "room1", 1); !errors.Is(err, ErrGapTooLarge) {
+		t.Errorf("Resume of %d messages error = %v, want ErrGapTooLarge", MaxResume+1, err)
+	}
+}
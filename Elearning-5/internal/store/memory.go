@@ -0,0 +1,151 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"elearning-5/internal/broker"
+)
+
+// DefaultCapacity is the number of messages a MemoryStore keeps per room
+// when created with a capacity of zero or less.
+const DefaultCapacity = 1000
+
+// MemoryStore keeps the last messages of every room in a ring buffer. The
+// history is lost when the process exits.
+type MemoryStore struct {
+	rooms    map[string]*ring
+	capacity int
+	mutex    sync.RWMutex
+	closed   bool
+}
+
+type memoryEntry struct {
+	msg  broker.Message
+	time time.Time
+}
+
+// ring holds the newest entries of a room, oldest first from start.
+type ring struct {
+	entries []memoryEntry // grows up to capacity, then wraps
+	start   int
+	lastSeq uint64 // sequence number of the last appended message
+	evicted uint64 // sequence number of the last message pushed out
+}
+
+func NewMemoryStore(capacity int) *MemoryStore {
+	if capacity <= 0 {
+		capacity = DefaultCapacity
+	}
+	return &MemoryStore{
+		rooms:    make(map[string]*ring),
+		capacity: capacity,
+	}
+}
+
+func (s *MemoryStore) Append(msg broker.Message) (uint64, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return 0, ErrClosed
+	}
+
+	r := s.rooms[msg.Room]
+	if r == nil {
+		r = &ring{}
+		s.rooms[msg.Room] = r
+	}
+	r.lastSeq++
+	msg.Seq = r.lastSeq
+	r.push(memoryEntry{msg: msg, time: messageTime(msg)}, s.capacity)
+	return msg.Seq, nil
+}
+
+func (s *MemoryStore) Range(q Query) ([]broker.Message, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	r := s.rooms[q.Room]
+	if r == nil {
+		r = &ring{}
+	}
+	if err := checkAfterSeq(q, r.evicted, r.lastSeq); err != nil {
+		return nil, err
+	}
+
+	lo, hi, err := selectRange(len(r.entries), r.key, q)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]broker.Message, 0, hi-lo)
+	for i := lo; i < hi; i++ {
+		msgs = append(msgs, r.at(i).msg)
+	}
+	return msgs, nil
+}
+
+func (s *MemoryStore) Delete(room, id string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	r := s.rooms[room]
+	if r == nil {
+		return ErrNotFound
+	}
+	i := indexOf(len(r.entries), r.key, id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	r.remove(i)
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	s.rooms = nil
+	return nil
+}
+
+func (r *ring) at(i int) memoryEntry {
+	return r.entries[(r.start+i)%len(r.entries)]
+}
+
+func (r *ring) key(i int) key {
+	e := r.at(i)
+	return key{id: e.msg.ID, seq: e.msg.Seq, time: e.time}
+}
+
+// push appends e, overwriting the oldest entry once capacity is reached.
+func (r *ring) push(e memoryEntry, capacity int) {
+	if len(r.entries) < capacity {
+		r.entries = append(r.entries, e)
+		return
+	}
+	r.evicted = r.entries[r.start].msg.Seq
+	r.entries[r.start] = e
+	r.start = (r.start + 1) % len(r.entries)
+}
+
+// remove deletes the i-th oldest entry and unwraps the ring.
+func (r *ring) remove(i int) {
+	entries := make([]memoryEntry, 0, len(r.entries))
+	for j := 0; j < len(r.entries); j++ {
+		if j != i {
+			entries = append(entries, r.at(j))
+		}
+	}
+	r.entries = entries
+	r.start = 0
+}
@@ -0,0 +1,153 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"elearning-5/internal/broker"
+)
+
+var (
+	// ErrNotFound is returned for a message ID that is not in the store,
+	// either as the target of Delete or as a Query cursor.
+	ErrNotFound = errors.New("store: message not found")
+	// ErrClosed is returned by every method once Close has been called.
+	ErrClosed = errors.New("store: closed")
+)
+
+// Query selects messages of one room. The bounds are combined; zero values
+// leave that side open.
+type Query struct {
+	Room string
+
+	// After and Before are exclusive message ID bounds.
+	After  string
+	Before string
+
+	// AfterSeq is an exclusive sequence number bound. Range fails with
+	// ErrNotFound when messages after it are no longer stored.
+	AfterSeq uint64
+
+	// Since is an inclusive and Until an exclusive timestamp bound.
+	Since time.Time
+	Until time.Time
+
+	// Limit caps the number of messages returned, zero means no limit. The
+	// earliest matching messages are kept unless Latest is set.
+	Limit  int
+	Latest bool
+}
+
+// MessageStore keeps the history of every room. Messages of a room are kept
+// in the order they were appended and returned oldest first.
+//
+// Append assigns each message the next sequence number of its room, starting
+// at 1. Sequence numbers are never reused, even after Delete.
+type MessageStore interface {
+	Append(msg broker.Message) (uint64, error)
+	Range(q Query) ([]broker.Message, error)
+	Delete(room, id string) error
+	Close() error
+}
+
+// Open returns the store selected by driver: "memory" keeps the last
+// capacity messages of each room, "disk" keeps everything in an append-only
+// log in dir.
+func Open(driver, dir string, capacity int) (MessageStore, error) {
+	switch driver {
+	case "memory":
+		return NewMemoryStore(capacity), nil
+	case "disk":
+		return OpenDiskStore(dir)
+	default:
+		return nil, fmt.Errorf("unknown store driver %q (want memory or disk)", driver)
+	}
+}
+
+// Persisted reports whether msg belongs in the history. Join and leave
+// notifications are not kept; direct messages are kept in the conversation
+// room of their users.
+func Persisted(msg broker.Message) bool {
+	return msg.Type == "message" || msg.Type == "direct"
+}
+
+// messageTime parses a message timestamp. Messages without a valid
+// timestamp are treated as appended now.
+func messageTime(msg broker.Message) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, msg.Timestamp); err == nil {
+		return t
+	}
+	return time.Now()
+}
+
+// key identifies the i-th oldest message of a room for selectRange.
+type key struct {
+	id   string
+	seq  uint64
+	time time.Time
+}
+
+// selectRange applies q to the n messages of a room, where at returns the
+// key of the i-th oldest one. It returns the half-open index range of the
+// selected messages.
+func selectRange(n int, at func(i int) key, q Query) (lo, hi int, err error) {
+	lo, hi = 0, n
+
+	if q.After != "" {
+		i := indexOf(n, at, q.After)
+		if i < 0 {
+			return 0, 0, ErrNotFound
+		}
+		lo = i + 1
+	}
+	if q.Before != "" {
+		i := indexOf(n, at, q.Before)
+		if i < 0 {
+			return 0, 0, ErrNotFound
+		}
+		hi = i
+	}
+	if q.AfterSeq > 0 {
+		// Sequence numbers increase with the index
+		lo += sort.Search(hi-lo, func(i int) bool { return at(lo+i).seq > q.AfterSeq })
+	}
+	for lo < hi && !q.Since.IsZero() && at(lo).time.Before(q.Since) {
+		lo++
+	}
+	for lo < hi && !q.Until.IsZero() && !at(hi-1).time.Before(q.Until) {
+		hi--
+	}
+
+	if lo > hi {
+		lo = hi
+	}
+	if q.Limit > 0 && hi-lo > q.Limit {
+		if q.Latest {
+			lo = hi - q.Limit
+		} else {
+			hi = lo + q.Limit
+		}
+	}
+	return lo, hi, nil
+}
+
+// checkAfterSeq reports ErrNotFound when q.AfterSeq cannot be resumed from:
+// messages after it were evicted, or it was never assigned in the room.
+func checkAfterSeq(q Query, evicted, last uint64) error {
+	if q.AfterSeq > 0 && (q.AfterSeq < evicted || q.AfterSeq > last) {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func indexOf(n int, at func(i int) key, id string) int {
+	// Cursors usually point at recent messages, so search from the end
+	for i := n - 1; i >= 0; i-- {
+		if at(i).id == id {
+			return i
+		}
+	}
+	return -1
+}
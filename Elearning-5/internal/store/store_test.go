@@ -0,0 +1,211 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"elearning-5/internal/broker"
+)
+
+var base = time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// message returns the i-th message of room, one second after the previous.
+func message(room string, i int) broker.Message {
+	return broker.Message{
+		ID:        fmt.Sprintf("%s-%d", room, i),
+		User:      "alice",
+		Message:   fmt.Sprintf("hello %d", i),
+		Timestamp: base.Add(time.Duration(i) * time.Second).Format(time.RFC3339),
+		Room:      room,
+		Type:      "message",
+	}
+}
+
+func ids(msgs []broker.Message) []string {
+	out := make([]string, len(msgs))
+	for i, msg := range msgs {
+		out[i] = msg.ID
+	}
+	return out
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// testStore runs the behaviour every MessageStore shares.
+func testStore(t *testing.T, s MessageStore) {
+	t.Helper()
+
+	for i := 0; i < 5; i++ {
+		if _, err := s.Append(message("room1", i)); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if _, err := s.Append(message("room2", 0)); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		q    Query
+		want []string
+	}{
+		{"whole room", Query{Room: "room1"}, []string{"room1-0", "room1-1", "room1-2", "room1-3", "room1-4"}},
+		{"other room", Query{Room: "room2"}, []string{"room2-0"}},
+		{"unknown room", Query{Room: "room3"}, []string{}},
+		{"after ID", Query{Room: "room1", After: "room1-2"}, []string{"room1-3", "room1-4"}},
+		{"before ID", Query{Room: "room1", Before: "room1-2"}, []string{"room1-0", "room1-1"}},
+		{"earliest", Query{Room: "room1", Limit: 2}, []string{"room1-0", "room1-1"}},
+		{"latest", Query{Room: "room1", Limit: 2, Latest: true}, []string{"room1-3", "room1-4"}},
+		{"latest before ID", Query{Room: "room1", Before: "room1-3", Limit: 2, Latest: true}, []string{"room1-1", "room1-2"}},
+		{"time range", Query{Room: "room1", Since: base.Add(time.Second), Until: base.Add(3 * time.Second)}, []string{"room1-1", "room1-2"}},
+		{"after sequence number", Query{Room: "room1", AfterSeq: 3}, []string{"room1-3", "room1-4"}},
+		{"after last sequence number", Query{Room: "room1", AfterSeq: 5}, []string{}},
+	}
+	for _, tt := range tests {
+		msgs, err := s.Range(tt.q)
+		if err != nil {
+			t.Errorf("%s: Range: %v", tt.name, err)
+			continue
+		}
+		if got := ids(msgs); !equal(got, tt.want) {
+			t.Errorf("%s: Range = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := s.Range(Query{Room: "room1", After: "missing"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Range after unknown ID error = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Range(Query{Room: "room1", AfterSeq: 6}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Range after unassigned sequence number error = %v, want ErrNotFound", err)
+	}
+	if seq, _ := s.Append(message("room3", 0)); seq != 1 {
+		t.Errorf("first sequence number of a room = %d, want 1", seq)
+	}
+
+	if err := s.Delete("room1", "room1-1"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	// Sequence numbers survive deletes and are not reused
+	if seq, err := s.Append(message("room1", 5)); err != nil || seq != 6 {
+		t.Errorf("Append after Delete = %d, %v, want sequence number 6", seq, err)
+	}
+	s.Delete("room1", "room1-5")
+	if err := s.Delete("room1", "room1-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("second Delete error = %v, want ErrNotFound", err)
+	}
+	msgs, _ := s.Range(Query{Room: "room1"})
+	if got, want := ids(msgs), []string{"room1-0", "room1-2", "room1-3", "room1-4"}; !equal(got, want) {
+		t.Errorf("Range after Delete = %v, want %v", got, want)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore(10))
+}
+
+func TestMemoryStoreKeepsLatestMessages(t *testing.T) {
+	s := NewMemoryStore(3)
+	for i := 0; i < 5; i++ {
+		s.Append(message("room1", i))
+	}
+
+	msgs, err := s.Range(Query{Room: "room1"})
+	if err != nil {
+		t.Fatalf("Range: %v", err)
+	}
+	if got, want := ids(msgs), []string{"room1-2", "room1-3", "room1-4"}; !equal(got, want) {
+		t.Errorf("Range = %v, want %v", got, want)
+	}
+
+	// Evicted messages are unknown cursors
+	if _, err := s.Range(Query{Room: "room1", After: "room1-0"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Range after evicted ID error = %v, want ErrNotFound", err)
+	}
+	if _, err := s.Range(Query{Room: "room1", AfterSeq: 1}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Range after evicted sequence number error = %v, want ErrNotFound", err)
+	}
+	if msgs, err := s.Range(Query{Room: "room1", AfterSeq: 2}); err != nil || len(msgs) != 3 {
+		t.Errorf("Range after last evicted sequence number = %v, %v, want 3 messages", ids(msgs), err)
+	}
+}
+
+func TestDiskStore(t *testing.T) {
+	s, err := OpenDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	defer s.Close()
+	testStore(t, s)
+}
+
+func TestDiskStoreReopens(t *testing.T) {
+	dir := t.TempDir()
+
+	s, err := OpenDiskStore(dir)
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		s.Append(message("room1", i))
+	}
+	s.Delete("room1", "room1-0")
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// Simulate a crash in the middle of writing a record
+	f, err := os.OpenFile(filepath.Join(dir, logFileName), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"op":"append","message":{"id":"torn"`)
+	f.Close()
+
+	s, err = OpenDiskStore(dir)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer s.Close()
+
+	if seq, err := s.Append(message("room1", 3)); err != nil || seq != 4 {
+		t.Fatalf("Append after reopen = %d, %v, want sequence number 4", seq, err)
+	}
+	msgs, err := s.Range(Query{Room: "room1"})
+	if err != nil {
+		t.Fatalf("Range: %v", err)
+	}
+	if got, want := ids(msgs), []string{"room1-1", "room1-2", "room1-3"}; !equal(got, want) {
+		t.Errorf("Range after reopen = %v, want %v", got, want)
+	}
+	if msgs[0].Message != "hello 1" {
+		t.Errorf("reopened message = %+v, want the original body", msgs[0])
+	}
+}
+
+func TestClosedStore(t *testing.T) {
+	disk, err := OpenDiskStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenDiskStore: %v", err)
+	}
+	for _, s := range []MessageStore{NewMemoryStore(1), disk} {
+		s.Close()
+		if _, err := s.Append(message("room1", 0)); !errors.Is(err, ErrClosed) {
+			t.Errorf("%T.Append after Close error = %v, want ErrClosed", s, err)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+// Package tracing follows a chat message with OpenTelemetry spans from the
+// connection it arrived on, through authorization, the store and the
+// broker, to every recipient on every protocol.
+//
+// Trace context travels as a W3C traceparent: in gRPC metadata, in the
+// traceparent field of WebSocket messages, in the headers of SignalR
+// invocations, and on broker messages between the hubs.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// Header is the name of the field, metadata key and invocation header that
+// carries trace context.
+const Header = "traceparent"
+
+// Span names, one per step of a message.
+const (
+	ReceiveSpan   = "chat.receive"
+	AuthorizeSpan = "chat.authorize"
+	PersistSpan   = "chat.persist"
+	PublishSpan   = "chat.publish"
+	DeliverSpan   = "chat.deliver"
+)
+
+// Span attributes.
+const (
+	ProtocolKey   = attribute.Key("chat.protocol")
+	UserKey       = attribute.Key("chat.user")
+	RoomKey       = attribute.Key("chat.room")
+	MessageKey    = attribute.Key("chat.message_id")
+	MethodKey     = attribute.Key("chat.method")
+	RecipientKey  = attribute.Key("chat.recipient")
+	QueueDepthKey = attribute.Key("chat.queue_depth")
+)
+
+// Exporters.
+const (
+	None   = "none"
+	Stdout = "stdout"
+	OTLP   = "otlp"
+)
+
+const instrumentation = "elearning-5/chat"
+
+// ErrQueueFull fails the delivery span of a recipient whose send queue is
+// full.
+var ErrQueueFull = errors.New("send queue is full")
+
+// propagator reads and writes traceparent whether or not spans are
+// exported, so that a message keeps the trace of its sender either way.
+var propagator = propagation.TraceContext{}
+
+var kinds = map[string]trace.SpanKind{
+	ReceiveSpan: trace.SpanKindServer,
+	PublishSpan: trace.SpanKindProducer,
+	DeliverSpan: trace.SpanKindConsumer,
+}
+
+// Config selects where spans go.
+type Config struct {
+	// Exporter is none, stdout or otlp. The OTLP exporter sends over gRPC
+	// and is configured by the standard OTEL_EXPORTER_OTLP_* variables.
+	Exporter string
+	// ServiceName names the process in traces unless OTEL_SERVICE_NAME
+	// is set.
+	ServiceName string
+}
+
+// Setup installs a global tracer provider exporting to cfg.Exporter and
+// returns the function flushing it at shutdown. With no exporter nothing is
+// recorded, but trace context is still passed along.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagator)
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(cfg.Exporter) {
+	case "", None:
+		return func(context.Context) error { return nil }, nil
+	case Stdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case OTLP:
+		exporter, err = otlptracegrpc.New(ctx)
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q (want none, stdout or otlp)", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create %s trace exporter: %w", cfg.Exporter, err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(cfg.ServiceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Start starts a step of a message as a child of the span in ctx, or as the
+// root of a new trace when there is none.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentation).Start(ctx, name,
+		trace.WithSpanKind(kinds[name]),
+		trace.WithAttributes(attrs...))
+}
+
+// Child starts a step like Start, but only under a span: messages the
+// servers make up themselves, such as presence notices, are not traced.
+func Child(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return Start(ctx, name, attrs...)
+}
+
+// End ends span, marking it failed when err is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Extract returns ctx with the remote span of a traceparent as its parent.
+// ctx is returned as is when traceparent is empty or invalid.
+func Extract(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	return propagator.Extract(ctx, propagation.MapCarrier{Header: traceparent})
+}
+
+// Inject returns the traceparent of the span in ctx, empty if there is
+// none.
+func Inject(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get(Header)
+}
+
+// FromIncomingContext returns ctx with the span named by the incoming gRPC
+// metadata as its parent.
+func FromIncomingContext(ctx context.Context) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return propagator.Extract(ctx, metadataCarrier(md))
+}
+
+// NewOutgoingContext adds the span in ctx to the outgoing gRPC metadata, for
+// clients.
+func NewOutgoingContext(ctx context.Context) context.Context {
+	if traceparent := Inject(ctx); traceparent != "" {
+		return metadata.AppendToOutgoingContext(ctx, Header, traceparent)
+	}
+	return ctx
+}
+
+// metadataCarrier adapts gRPC metadata, whose keys are lower case, to the
+// propagator.
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,113 @@
+package tracing
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	traceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	traceparent = "00-" + traceID + "-00f067aa0ba902b7-01"
+)
+
+func record(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(trace.NewNoopTracerProvider()) })
+	return recorder
+}
+
+func TestSpansContinueTraceparent(t *testing.T) {
+	recorder := record(t)
+
+	ctx, receive := Start(Extract(context.Background(), traceparent), ReceiveSpan, ProtocolKey.String("websocket"))
+	pubCtx, publish := Child(ctx, PublishSpan)
+	carried := Inject(pubCtx)
+	End(publish, nil)
+	End(receive, nil)
+
+	if !strings.Contains(carried, traceID) || carried == traceparent {
+		t.Errorf("Inject = %q, want a child of %s", carried, traceparent)
+	}
+	_, deliver := Child(Extract(context.Background(), carried), DeliverSpan)
+	End(deliver, ErrQueueFull)
+
+	spans := recorder.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("recorded %d spans, want 3", len(spans))
+	}
+	for _, span := range spans {
+		if got := span.SpanContext().TraceID().String(); got != traceID {
+			t.Errorf("span %s is in trace %s, want %s", span.Name(), got, traceID)
+		}
+	}
+	if spans[0].Name() != PublishSpan || spans[0].SpanKind() != trace.SpanKindProducer {
+		t.Errorf("first span = %s of kind %s, want producer %s", spans[0].Name(), spans[0].SpanKind(), PublishSpan)
+	}
+	if spans[2].Parent().SpanID() != spans[0].SpanContext().SpanID() {
+		t.Error("delivery is not a child of the publish")
+	}
+	if spans[2].Status().Code != codes.Error {
+		t.Errorf("failed delivery has status %v", spans[2].Status())
+	}
+}
+
+func TestChildNeedsATrace(t *testing.T) {
+	recorder := record(t)
+
+	ctx, span := Child(context.Background(), PersistSpan)
+	End(span, nil)
+	if span.IsRecording() || Inject(ctx) != "" {
+		t.Error("Child without a parent started a trace")
+	}
+	if got := Inject(Extract(context.Background(), "garbage")); got != "" {
+		t.Errorf("invalid traceparent was continued as %q", got)
+	}
+	if n := len(recorder.Ended()); n != 0 {
+		t.Errorf("recorded %d spans, want none", n)
+	}
+}
+
+func TestGRPCMetadataCarriesTrace(t *testing.T) {
+	ctx := NewOutgoingContext(Extract(context.Background(), traceparent))
+	md, _ := metadata.FromOutgoingContext(ctx)
+	if got := md.Get(Header); len(got) != 1 || got[0] != traceparent {
+		t.Fatalf("outgoing %s = %v, want %s", Header, got, traceparent)
+	}
+
+	incoming := FromIncomingContext(metadata.NewIncomingContext(context.Background(), md))
+	if got := Inject(incoming); got != traceparent {
+		t.Errorf("incoming trace = %q, want %q", got, traceparent)
+	}
+	if got := Inject(FromIncomingContext(context.Background())); got != "" {
+		t.Errorf("trace without metadata = %q", got)
+	}
+}
+
+func TestSetup(t *testing.T) {
+	t.Cleanup(func() { otel.SetTracerProvider(trace.NewNoopTracerProvider()) })
+
+	for _, exporter := range []string{"", None, Stdout} {
+		shutdown, err := Setup(context.Background(), Config{Exporter: exporter, ServiceName: "test"})
+		if err != nil {
+			t.Fatalf("Setup(%q): %v", exporter, err)
+		}
+		if err := shutdown(context.Background()); err != nil {
+			t.Errorf("shutdown of %q: %v", exporter, err)
+		}
+	}
+
+	_, err := Setup(context.Background(), Config{Exporter: "zipkin"})
+	if err == nil || !strings.Contains(err.Error(), "zipkin") {
+		t.Errorf("Setup(zipkin) = %v, want an unknown exporter error", err)
+	}
+}
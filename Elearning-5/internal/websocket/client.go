@@ -1,27 +1,75 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
 	"time"
 
+	"elearning-5/internal/metrics"
+	"elearning-5/internal/policy"
+	"elearning-5/internal/presence"
+	"elearning-5/internal/ratelimit"
+	"elearning-5/internal/tracing"
+	"elearning-5/pkg/logger"
+
 	"github.com/gorilla/websocket"
 )
 
 type Client struct {
+	id     string
 	hub    *Hub
 	conn   *websocket.Conn
 	send   chan Message
-	userID string
-	room   string
+	userID string // token subject, or the user named by the first message; set under hub.mutex
+	room   string // set by the hub once the policy let the client in
+	joined bool   // the client is in room
+	limit  *ratelimit.Conn
+	// presence counts the client for its user once it is named
+	presence *presence.Conn
+	// release frees the client's slot under the connection caps once
+	// ReadPump returns
+	release func()
+
+	// closeCode and closeReason are set by the hub before it closes send;
+	// a zero code sends an empty close frame.
+	closeCode   int
+	closeReason string
+	done        chan struct{} // closed when WritePump returns
+
+	// replayed holds the IDs of history messages sent on join that the
+	// broker may still deliver live. Only the hub's Run goroutine uses it.
+	replayed map[string]bool
+
+	// log carries the connection's attributes; ReadPump adds the user and
+	// room while the other goroutines read it.
+	log atomic.Pointer[slog.Logger]
 }
 
 func NewClient(conn *websocket.Conn, hub *Hub) *Client {
-	return &Client{
-		hub:  hub,
-		conn: conn,
-		send: make(chan Message, 256),
+	c := &Client{
+		id:       generateClientID(),
+		hub:      hub,
+		conn:     conn,
+		send:     make(chan Message, 256),
+		done:     make(chan struct{}),
+		replayed: make(map[string]bool),
 	}
+	c.log.Store(logger.Conn(metrics.WebSocket, c.id, conn.RemoteAddr().String()))
+	return c
+}
+
+// logger returns the logger of the connection.
+func (c *Client) logger() *slog.Logger {
+	return c.log.Load()
+}
+
+// with adds attributes to the logger of the connection.
+func (c *Client) with(args ...any) {
+	c.log.Store(c.logger().With(args...))
 }
 
 func (c *Client) WritePump() {
@@ -29,6 +77,7 @@ func (c *Client) WritePump() {
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		close(c.done)
 	}()
 
 	for {
@@ -36,22 +85,29 @@ func (c *Client) WritePump() {
 		case message, ok := <-c.send:
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 			if !ok {
-				// Hub closed the channel
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				// Hub closed the channel after everything queued was written
+				closeMsg := []byte{}
+				if c.closeCode != 0 {
+					reason := c.closeReason
+					if reason == "" {
+						reason = "server shutting down"
+					}
+					closeMsg = websocket.FormatCloseMessage(c.closeCode, reason)
+				}
+				c.conn.WriteMessage(websocket.CloseMessage, closeMsg)
 				return
 			}
 
-			w, err := c.conn.NextWriter(websocket.TextMessage)
+			data, err := json.Marshal(message)
 			if err != nil {
-				return
+				c.logger().Error("Encoding message failed", "id", message.ID, "err", err)
+				continue
 			}
-
-			json.NewEncoder(w).Encode(message)
-
-			// Close writer to flush message
-			if err := w.Close(); err != nil {
+			data = append(data, '\n')
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
 				return
 			}
+			c.hub.metrics.Sent(metrics.WebSocket, len(data))
 
 		case <-ticker.C:
 			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
@@ -64,42 +120,214 @@ func (c *Client) WritePump() {
 
 func (c *Client) ReadPump() {
 	defer func() {
-		c.hub.unregister <- c
+		select {
+		case c.hub.unregister <- c:
+		case <-c.hub.done:
+		}
 		c.conn.Close()
+		c.presence.Close()
+		if c.release != nil {
+			c.release()
+		}
 	}()
 
 	c.conn.SetReadLimit(512 * 1024) // 512KB
 	c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.conn.SetPongHandler(func(string) error {
 		c.conn.SetReadDeadline(time.Now().Add(60 * time.Second))
+		c.presence.Heartbeat()
 		return nil
 	})
 
 	for {
-		var msg Message
-		err := c.conn.ReadJSON(&msg)
+		_, data, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("WebSocket read error: %v", err)
+				c.logger().Warn("WebSocket read failed", "err", err)
 			}
 			break
 		}
+		c.hub.metrics.Received(metrics.WebSocket, len(data))
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			c.logger().Warn("Invalid WebSocket message", "err", err)
+			break
+		}
+		if !c.receive(msg) {
+			return
+		}
+	}
+}
+
+// receive hands a message of the client to the hub, joining the room it
+// names first if the client is in none. Direct messages go to the
+// conversation room of the client and their recipient instead, and typing
+// and presence messages to the presence tracker. It returns false once the
+// connection is done.
+func (c *Client) receive(msg Message) bool {
+	ctx, span := tracing.Start(tracing.Extract(context.Background(), msg.TraceParent), tracing.ReceiveSpan,
+		tracing.ProtocolKey.String(metrics.WebSocket), tracing.UserKey.String(c.userID))
+	var err error
+	defer func() { tracing.End(span, err) }()
+	msg.TraceParent = ""
+	c.presence.Heartbeat()
 
-		// Set user info from first message
-		if c.userID == "" && msg.User != "" {
-			c.userID = msg.User
-			c.room = msg.Room
-			log.Printf("User %s joined room %s", c.userID, c.room)
+	room := c.room
+	switch {
+	case msg.Type == "direct":
+		room = policy.DirectRoom(c.userID, msg.To)
+	case !c.joined:
+		room = msg.Room
+	}
+	if err = c.limit.Allow(c.userID, room); err != nil {
+		c.hub.sendError(c, room, err)
+		if c.limit.Exceeded() {
+			c.logger().Warn("Rate limit exceeded, disconnecting")
+			c.hub.metrics.Evicted(metrics.WebSocket, metrics.RateLimited)
+			c.hub.disconnect(c, websocket.ClosePolicyViolation, "rate limit exceeded")
+			// Let WritePump flush the error before the connection closes
+			<-c.done
+			return false
 		}
+		return true
+	}
+
+	if !clientType(msg.Type) {
+		err = fmt.Errorf("clients cannot send %q messages", msg.Type)
+		c.hub.sendError(c, room, err)
+		return true
+	}
 
-		// Add timestamp if not present
-		if msg.Timestamp == "" {
-			msg.Timestamp = time.Now().Format(time.RFC3339)
+	entered := false
+	if msg.Type == "direct" {
+		if err = checkDirect(c.userID, msg.To); err != nil {
+			c.hub.sendError(c, room, err)
+			return true
 		}
+	} else if !c.joined && (c.userID != "" || msg.User != "") {
+		// Set user info from first message. An authenticated client
+		// cannot name itself.
+		if c.userID == "" {
+			c.identify(msg.User)
+		}
+		joined, ok := c.join(msg)
+		if !ok {
+			return false
+		}
+		if !joined {
+			// The hub told the client why; it may try another room
+			return true
+		}
+		c.joined, entered = true, true
+		c.presence.Join(c.room)
+		c.with(logger.RoomKey, c.room)
+		c.logger().Info("Joined room")
+	}
 
-		// Broadcast message to hub
-		c.hub.broadcast <- msg
+	// The hub checks that the poster may post the message to its room
+	poster := c
+	switch msg.Type {
+	case "join":
+		if !entered {
+			err = errors.New("already in room " + c.room)
+			c.hub.sendError(c, c.room, err)
+			return true
+		}
+		// A join is announced in the server's words and is no post, so
+		// members who may not post are announced too
+		msg = Message{Message: c.userID + " joined the chat", Type: "join"}
+		poster = nil
+	case presence.TypingType:
+		c.presence.Typing(c.room, msg.Message != presence.TypingStopped)
+		return true
+	case presence.PresenceType:
+		if err = c.presence.SetStatus(presence.Status(msg.Message)); err != nil {
+			c.hub.sendError(c, c.room, err)
+		}
+		return true
+	case "", "message":
+		c.presence.Typing(c.room, false)
+	}
+	// Clients post to the room they joined only
+	msg.User, msg.Room = c.userID, c.room
+	if msg.Type == "direct" {
+		msg.Room = room
+	} else {
+		msg.To = ""
 	}
+	msg.LastSeq, msg.Since, msg.Limit = 0, "", 0
+	span.SetAttributes(tracing.UserKey.String(msg.User), tracing.RoomKey.String(msg.Room))
+
+	// Add timestamp if not present
+	if msg.Timestamp == "" {
+		msg.Timestamp = time.Now().Format(time.RFC3339)
+	}
+
+	// Broadcast message to hub
+	select {
+	case c.hub.broadcast <- inbound{ctx: ctx, client: poster, message: msg}:
+		return true
+	case <-c.hub.done:
+		return false
+	}
+}
+
+// clientType reports whether clients may send messages of type msgType.
+// The other types, such as system, leave or reload, only come from servers.
+func clientType(msgType string) bool {
+	switch msgType {
+	case "", "message", "join", "direct", presence.TypingType, presence.PresenceType:
+		return true
+	}
+	return false
+}
+
+// checkDirect returns an error when user may not send a direct message to
+// the user to.
+func checkDirect(user, to string) error {
+	switch {
+	case user == "":
+		return errors.New("join a room before sending direct messages")
+	case to == "" || to == user:
+		return errors.New("a direct message needs a recipient other than the sender")
+	}
+	return nil
+}
+
+// join asks the hub to put the client in the room of msg. For a join
+// message the room's history is sent before the join reaches anyone. ok is
+// false if the hub stopped.
+func (c *Client) join(msg Message) (joined, ok bool) {
+	req := joinRequest{
+		client:  c,
+		room:    msg.Room,
+		replay:  msg.Type == "join",
+		lastSeq: msg.LastSeq,
+		since:   msg.Since,
+		limit:   msg.Limit,
+		joined:  make(chan bool, 1),
+	}
+	select {
+	case c.hub.join <- req:
+	case <-c.hub.done:
+		return false, false
+	}
+	select {
+	case joined = <-req.joined:
+		return joined, true
+	case <-c.hub.done:
+		return false, false
+	}
+}
+
+// identify names a client that did not authenticate.
+func (c *Client) identify(user string) {
+	c.hub.mutex.Lock()
+	c.userID = user
+	c.hub.mutex.Unlock()
+
+	c.with(logger.UserKey, user)
+	c.presence.Identify(user)
 }
 
 func (c *Client) GetUserID() string {
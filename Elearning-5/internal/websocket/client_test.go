@@ -0,0 +1,41 @@
+package websocket
+
+import (
+	"errors"
+	"testing"
+
+	"elearning-5/internal/ratelimit"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestRateLimitedClientIsWarnedThenDisconnected(t *testing.T) {
+	limiter := ratelimit.New(ratelimit.Limits{
+		PerConnection: ratelimit.Rate{PerSecond: 0.01, Burst: 2},
+		Strikes:       2,
+	})
+	_, addr := newTestServer(t, Options{Limiter: limiter})
+	client := dial(t, addr, nil)
+	client.join(t, "alice", "room1")
+
+	client.send(t, Message{Type: "message", User: "alice", Room: "room1", Message: "within the burst"})
+	if msg := client.next(t); msg.Message != "within the burst" {
+		t.Fatalf("got %s %q, want the message back", msg.Type, msg.Message)
+	}
+
+	client.send(t, Message{Type: "message", User: "alice", Room: "room1", Message: "over the limit"})
+	msg := client.next(t)
+	if msg.Type != "error" || msg.Code != ratelimit.Code || msg.RetryAfter <= 0 || msg.Room != "room1" {
+		t.Fatalf("got %+v, want a rate_limited error with a retry delay", msg)
+	}
+
+	// The second strike is reported, then the connection closed
+	client.send(t, Message{Type: "message", User: "alice", Room: "room1", Message: "still over"})
+	if msg := client.next(t); msg.Type != "error" || msg.Code != ratelimit.Code {
+		t.Fatalf("got %+v, want a rate_limited error", msg)
+	}
+	var closeErr *websocket.CloseError
+	if err := client.closed(t); !errors.As(err, &closeErr) || closeErr.Code != websocket.ClosePolicyViolation {
+		t.Errorf("connection ended with %v, want a policy violation close frame", err)
+	}
+}
@@ -1,11 +1,25 @@
 package websocket
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"math/rand"
 	"sync"
 	"time"
+
+	"elearning-5/internal/broker"
+	"elearning-5/internal/metrics"
+	"elearning-5/internal/policy"
+	"elearning-5/internal/presence"
+	"elearning-5/internal/ratelimit"
+	"elearning-5/internal/store"
+	"elearning-5/internal/tracing"
+	"elearning-5/pkg/logger"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Message struct {
@@ -14,16 +28,63 @@ type Message struct {
 	Message   string `json:"message"`
 	Timestamp string `json:"timestamp"`
 	Room      string `json:"room"`
-	Type      string `json:"type"` // message, join, leave, system
+	Type      string `json:"type"`         // message, join, leave, system, reload, error, typing, presence, direct
+	To        string `json:"to,omitempty"` // recipient of a direct message
+	Seq       uint64 `json:"seq,omitempty"`
+	Code      string `json:"code,omitempty"` // why an error message was sent
+	// RetryAfter is set on rate_limited errors, in milliseconds
+	RetryAfter int64 `json:"retry_after_ms,omitempty"`
+
+	// LastSeq, Since and Limit select the history replayed on a join: the
+	// messages after sequence number LastSeq when resuming, after the ID
+	// Since, or the last Limit messages of the room.
+	LastSeq uint64 `json:"last_seq,omitempty"`
+	Since   string `json:"since,omitempty"`
+	Limit   int    `json:"limit,omitempty"`
+
+	// TraceParent is the W3C trace context of a message. Clients may set it
+	// on what they send, and receive the trace of each chat message.
+	TraceParent string `json:"traceparent,omitempty"`
+}
+
+// joinRequest asks the hub to put a client in a room. For a join message
+// the hub first sends the room's history, selected by lastSeq, since and
+// limit.
+type joinRequest struct {
+	client  *Client
+	room    string
+	replay  bool
+	lastSeq uint64
+	since   string
+	limit   int
+	joined  chan bool // receives whether the policy let the client in
+}
+
+// inbound is a message for the broker, sent by client or by the hub itself
+// when client is nil. ctx carries the span of its receipt.
+type inbound struct {
+	ctx     context.Context
+	client  *Client
+	message Message
 }
 
 type Hub struct {
 	clients    map[*Client]bool
-	broadcast  chan Message
+	broadcast  chan inbound
 	register   chan *Client
 	unregister chan *Client
+	join       chan joinRequest
 	mutex      sync.RWMutex
 	stats      *Stats
+	broker     broker.Broker
+	store      store.MessageStore
+	policy     *policy.Policy // nil allows everything
+	metrics    *metrics.Metrics
+
+	quit     chan struct{} // closed by Shutdown
+	done     chan struct{} // closed when Run returns
+	stopOnce sync.Once
+	closed   []*Client // clients disconnected by shutdown, set before done
 }
 
 type Stats struct {
@@ -32,18 +93,32 @@ type Stats struct {
 	TotalConnections  int64 `json:"total_connections"`
 }
 
-func NewHub() *Hub {
+func NewHub(b broker.Broker, st store.MessageStore) *Hub {
 	return &Hub{
 		clients:    make(map[*Client]bool),
-		broadcast:  make(chan Message, 1024),
+		broadcast:  make(chan inbound, 1024),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
+		join:       make(chan joinRequest),
 		stats:      &Stats{},
+		broker:     b,
+		store:      st,
+		quit:       make(chan struct{}),
+		done:       make(chan struct{}),
 	}
 }
 
 func (h *Hub) Run() {
-	log.Println("WebSocket Hub started running...")
+	defer close(h.done)
+
+	sub, err := h.broker.Subscribe()
+	if err != nil {
+		slog.Error("WebSocket hub cannot subscribe to broker", "err", err)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	slog.Debug("WebSocket hub running")
 
 	for {
 		select {
@@ -53,9 +128,10 @@ func (h *Hub) Run() {
 			h.stats.ActiveConnections = len(h.clients)
 			h.stats.TotalConnections++
 			h.mutex.Unlock()
+			h.metrics.Connected(metrics.WebSocket)
 
-			// Send join notification if user is identified
-			if client.userID != "" {
+			// Send join notification if user is identified and in a room
+			if client.joined {
 				joinMsg := Message{
 					ID:        generateMessageID(),
 					User:      "System",
@@ -64,22 +140,21 @@ func (h *Hub) Run() {
 					Room:      client.room,
 					Type:      "join",
 				}
-				h.broadcast <- joinMsg
+				h.broadcast <- inbound{ctx: context.Background(), message: joinMsg}
 			}
 
-			log.Printf("🔗 Client connected. Total: %d", len(h.clients))
+			client.logger().Info("Client connected", "clients", h.GetClientCount())
 
 		case client := <-h.unregister:
 			h.mutex.Lock()
 			if _, ok := h.clients[client]; ok {
-				delete(h.clients, client)
-				close(client.send)
+				h.remove(client)
 				h.stats.ActiveConnections = len(h.clients)
 			}
 			h.mutex.Unlock()
 
-			// Send leave notification if user was identified
-			if client.userID != "" {
+			// Send leave notification if user was identified and in a room
+			if client.joined {
 				leaveMsg := Message{
 					ID:        generateMessageID(),
 					User:      "System",
@@ -88,63 +163,346 @@ func (h *Hub) Run() {
 					Room:      client.room,
 					Type:      "leave",
 				}
-				h.broadcast <- leaveMsg
+				h.broadcast <- inbound{ctx: context.Background(), message: leaveMsg}
 			}
 
-			log.Printf("🔌 Client disconnected. Total: %d", len(h.clients))
+			client.logger().Info("Client disconnected", "clients", h.GetClientCount())
 
-		case message := <-h.broadcast:
-			h.stats.TotalMessages++
+		case in := <-h.broadcast:
+			h.handleInbound(in)
 
-			// Ensure message has ID and timestamp
-			if message.ID == "" {
-				message.ID = generateMessageID()
-			}
-			if message.Timestamp == "" {
-				message.Timestamp = time.Now().Format(time.RFC3339)
-			}
-			if message.Type == "" {
-				message.Type = "message"
+		case req := <-h.join:
+			h.joinRoom(req)
+
+		case message, ok := <-sub.Messages():
+			if !ok {
+				slog.Warn("WebSocket hub broker subscription closed")
+				h.closeClients(0)
+				return
 			}
+			h.deliver(fromBrokerMessage(message))
 
-			h.mutex.RLock()
-			clientsToRemove := make([]*Client, 0)
-
-			for client := range h.clients {
-				// Send to clients in the same room or all rooms if room is empty
-				shouldSend := client.room == "" || client.room == message.Room || message.Type != "message"
-
-				if shouldSend {
-					select {
-					case client.send <- message:
-						// Message sent successfully
-					default:
-						// Client is blocking, mark for removal
-						clientsToRemove = append(clientsToRemove, client)
-					}
-				}
+		case <-h.quit:
+			h.drain(sub)
+			h.closeClients(websocket.CloseGoingAway)
+			slog.Info("WebSocket hub stopped")
+			return
+		}
+	}
+}
+
+// Shutdown stops Run after it has delivered everything already queued and
+// waits until every client has written its send queue and a close frame, or
+// until ctx expires.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.stopOnce.Do(func() { close(h.quit) })
+
+	select {
+	case <-h.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	for _, client := range h.closed {
+		select {
+		case <-client.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// handleInbound publishes a message unless the room policy forbids its
+// client to post it, in which case the client gets an error message. Direct
+// messages were checked by their client, as their conversation room only
+// takes direct messages.
+func (h *Hub) handleInbound(in inbound) {
+	if in.client != nil && in.message.Type != "direct" {
+		_, span := tracing.Child(in.ctx, tracing.AuthorizeSpan,
+			tracing.UserKey.String(in.client.userID), tracing.RoomKey.String(in.message.Room))
+		err := h.policy.Authorize(in.client.userID, in.message.Room, policy.Send)
+		tracing.End(span, err)
+		if err != nil {
+			h.sendError(in.client, in.message.Room, err)
+			return
+		}
+	}
+	h.publish(in.ctx, in.message)
+}
+
+// joinRoom puts a client in a room if the policy allows it, after sending
+// the room's history for a join message. A denied client gets an error
+// message and stays out of every room.
+func (h *Hub) joinRoom(req joinRequest) {
+	if err := h.policy.Authorize(req.client.userID, req.room, policy.Join); err != nil {
+		h.sendError(req.client, req.room, err)
+		req.joined <- false
+		return
+	}
+
+	h.mutex.Lock()
+	if _, ok := h.clients[req.client]; ok {
+		req.client.room = req.room
+		h.metrics.Joined(metrics.WebSocket, req.room)
+	}
+	h.mutex.Unlock()
+	if req.replay {
+		h.replayHistory(req)
+	}
+	req.joined <- true
+}
+
+// publish stamps a message received from a local client and hands it to
+// the broker. ctx carries the span of its receipt.
+func (h *Hub) publish(ctx context.Context, message Message) {
+	h.mutex.Lock()
+	h.stats.TotalMessages++
+	h.mutex.Unlock()
+
+	// Ensure message has ID and timestamp
+	if message.ID == "" {
+		message.ID = generateMessageID()
+	}
+	if message.Timestamp == "" {
+		message.Timestamp = time.Now().Format(time.RFC3339)
+	}
+	if message.Type == "" {
+		message.Type = "message"
+	}
+
+	msg := toBrokerMessage(message)
+	attrs := []attribute.KeyValue{tracing.RoomKey.String(msg.Room), tracing.MessageKey.String(msg.ID)}
+	if store.Persisted(msg) {
+		_, span := tracing.Child(ctx, tracing.PersistSpan, attrs...)
+		seq, err := h.store.Append(msg)
+		tracing.End(span, err)
+		if err != nil {
+			slog.Error("Storing message failed", "id", message.ID, "err", err)
+			return
+		}
+		msg.Seq = seq
+	}
+
+	// Local clients receive it back through the broker subscription
+	ctx, span := tracing.Child(ctx, tracing.PublishSpan, attrs...)
+	msg.TraceParent = tracing.Inject(ctx)
+	err := h.broker.Publish(msg)
+	tracing.End(span, err)
+	if err != nil {
+		slog.Error("Publishing message failed", "id", message.ID, "err", err)
+	}
+
+	if store.Persisted(msg) {
+		slog.Debug("Message published",
+			logger.ProtocolKey, metrics.WebSocket, logger.UserKey, message.User, logger.RoomKey, message.Room,
+			"id", message.ID, logger.Body(message.Message))
+	}
+}
+
+// drain handles messages that were queued before shutdown started.
+func (h *Hub) drain(sub broker.Subscription) {
+	for {
+		select {
+		case in := <-h.broadcast:
+			h.handleInbound(in)
+		case message, ok := <-sub.Messages():
+			if !ok {
+				return
 			}
-			h.mutex.RUnlock()
-
-			// Remove problematic clients
-			if len(clientsToRemove) > 0 {
-				h.mutex.Lock()
-				for _, client := range clientsToRemove {
-					if _, ok := h.clients[client]; ok {
-						delete(h.clients, client)
-						close(client.send)
-					}
-				}
-				h.stats.ActiveConnections = len(h.clients)
-				h.mutex.Unlock()
+			h.deliver(fromBrokerMessage(message))
+		default:
+			return
+		}
+	}
+}
+
+// closeClients disconnects every client. Each WritePump flushes its queue
+// before sending a close frame with the given code.
+func (h *Hub) closeClients(code int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for client := range h.clients {
+		client.closeCode = code
+		h.remove(client)
+		h.closed = append(h.closed, client)
+	}
+	h.stats.ActiveConnections = 0
+}
+
+// disconnect removes one client. Its WritePump flushes the queue before
+// sending a close frame with code and reason.
+func (h *Hub) disconnect(client *Client, code int, reason string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	client.closeCode, client.closeReason = code, reason
+	h.remove(client)
+	h.stats.ActiveConnections = len(h.clients)
+}
+
+// remove deletes a client and closes its send queue. The caller holds the
+// write lock.
+func (h *Hub) remove(client *Client) {
+	delete(h.clients, client)
+	close(client.send)
+	h.metrics.Disconnected(metrics.WebSocket)
+	if client.room != "" {
+		h.metrics.Left(metrics.WebSocket, client.room)
+	}
+}
+
+// deliver sends a message to the local clients of its room.
+func (h *Hub) deliver(message Message) {
+	defer h.metrics.Fanout(metrics.WebSocket, time.Now())
+	ctx := tracing.Extract(context.Background(), message.TraceParent)
+
+	h.mutex.RLock()
+	clientsToRemove := make([]*Client, 0)
 
-				log.Printf("Removed %d unresponsive clients", len(clientsToRemove))
+	for client := range h.clients {
+		// Send to the clients in the message's room only; a client that
+		// has not joined one, or was refused, receives nothing
+		shouldSend := client.room != "" && client.room == message.Room
+		switch {
+		case message.Type == "direct":
+			// Only the sender and the recipient see a direct message,
+			// whether or not they are in a room
+			shouldSend = client.userID != "" &&
+				(client.userID == message.User || client.userID == message.To)
+		case presence.Ephemeral(message.Type):
+			// Presence only concerns the room, and typists do not see
+			// themselves typing
+			shouldSend = client.room == message.Room &&
+				!(message.Type == presence.TypingType && client.userID == message.User)
+		}
+
+		if client.replayed[message.ID] {
+			// Already sent as history, the broker delivered it late
+			delete(client.replayed, message.ID)
+			continue
+		}
+
+		if shouldSend {
+			depth := len(client.send)
+			h.metrics.QueueDepth(metrics.WebSocket, depth)
+			_, span := tracing.Child(ctx, tracing.DeliverSpan, tracing.ProtocolKey.String(metrics.WebSocket),
+				tracing.RecipientKey.String(client.id), tracing.QueueDepthKey.Int(depth))
+			select {
+			case client.send <- message:
+				span.End()
+			default:
+				// Client is blocking, mark for removal
+				tracing.End(span, tracing.ErrQueueFull)
+				clientsToRemove = append(clientsToRemove, client)
 			}
+		}
+	}
+	h.mutex.RUnlock()
 
-			if message.Type == "message" {
-				log.Printf("📨 Broadcast message from %s in room %s: %s", message.User, message.Room, message.Message)
+	// Remove problematic clients
+	if len(clientsToRemove) > 0 {
+		h.mutex.Lock()
+		for _, client := range clientsToRemove {
+			if _, ok := h.clients[client]; ok {
+				h.remove(client)
+				h.metrics.Evicted(metrics.WebSocket, metrics.SlowConsumer)
+				client.logger().Warn("Client is too slow, disconnecting")
 			}
 		}
+		h.stats.ActiveConnections = len(h.clients)
+		h.mutex.Unlock()
+	}
+}
+
+// replayHistory sends a client the history of its room, or a reload message
+// when the messages it missed cannot be resumed. It runs on the Run goroutine
+// so that no live message can be delivered in between; messages that are
+// both replayed and still queued in the broker are sent once.
+func (h *Hub) replayHistory(req joinRequest) {
+	client := req.client
+
+	var msgs []broker.Message
+	var err error
+	if req.lastSeq > 0 {
+		msgs, err = store.Resume(h.store, client.room, req.lastSeq)
+	} else {
+		msgs, err = store.Replay(h.store, client.room, req.since, req.limit)
+	}
+	if errors.Is(err, store.ErrGapTooLarge) {
+		msgs, err = nil, nil
+		defer h.send(client, Message{
+			ID:        generateMessageID(),
+			User:      "System",
+			Message:   store.ErrGapTooLarge.Error(),
+			Timestamp: time.Now().Format(time.RFC3339),
+			Room:      client.room,
+			Type:      "reload",
+		})
+	}
+	if err != nil {
+		client.logger().Error("Loading history failed", "err", err)
+		return
+	}
+
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	for _, msg := range msgs {
+		select {
+		case client.send <- fromBrokerMessage(msg):
+			client.replayed[msg.ID] = true
+		default:
+			client.logger().Warn("History does not fit the send queue")
+			h.metrics.Dropped(metrics.WebSocket, metrics.QueueFull)
+			return
+		}
+	}
+}
+
+// sendError tells a client that its request for room was refused. Policy
+// denials and rate limits carry their code.
+func (h *Hub) sendError(client *Client, room string, err error) {
+	msg := Message{
+		ID:        generateMessageID(),
+		User:      "System",
+		Message:   err.Error(),
+		Timestamp: time.Now().Format(time.RFC3339),
+		Room:      room,
+		Type:      "error",
+	}
+	var denied *policy.Error
+	var limited *ratelimit.Error
+	switch {
+	case errors.As(err, &denied):
+		msg.Code = string(denied.Code)
+	case errors.As(err, &limited):
+		msg.Code = ratelimit.Code
+		msg.RetryAfter = limited.RetryAfter.Milliseconds()
+	}
+	h.send(client, msg)
+}
+
+// send queues a message for one client, such as a reload or error notice.
+// It is dropped if the client is gone or its queue is full.
+func (h *Hub) send(client *Client, msg Message) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	select {
+	case client.send <- msg:
+	default:
+		h.metrics.Dropped(metrics.WebSocket, metrics.QueueFull)
 	}
 }
 
@@ -160,6 +518,41 @@ func (h *Hub) GetClientCount() int {
 	return len(h.clients)
 }
 
+func toBrokerMessage(m Message) broker.Message {
+	return broker.Message{
+		ID:        m.ID,
+		User:      m.User,
+		Message:   m.Message,
+		Timestamp: m.Timestamp,
+		Room:      m.Room,
+		Type:      m.Type,
+		To:        m.To,
+		Source:    "websocket",
+		Seq:       m.Seq,
+
+		TraceParent: m.TraceParent,
+	}
+}
+
+func fromBrokerMessage(m broker.Message) Message {
+	return Message{
+		ID:        m.ID,
+		User:      m.User,
+		Message:   m.Message,
+		Timestamp: m.Timestamp,
+		Room:      m.Room,
+		Type:      m.Type,
+		To:        m.To,
+		Seq:       m.Seq,
+
+		TraceParent: m.TraceParent,
+	}
+}
+
+func generateClientID() string {
+	return fmt.Sprintf("ws_%d_%d", time.Now().UnixNano(), rand.Int63())
+}
+
 func generateMessageID() string {
 	return fmt.Sprintf("msg_%d_%d", time.Now().UnixNano(), rand.Int63())
 }
@@ -0,0 +1,218 @@
+package websocket
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"elearning-5/internal/auth"
+	"elearning-5/internal/policy"
+	"elearning-5/internal/store"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestJoinReplaysHistory(t *testing.T) {
+	st := store.NewMemoryStore(0)
+	fill(t, st, "room1", 5)
+	_, addr := newTestServerWithStore(t, st, Options{})
+
+	for _, tt := range []struct {
+		name string
+		join Message
+		want string
+	}{
+		{"default", Message{User: "alice", Room: "room1"}, "m1 m2 m3 m4 m5"},
+		{"limit", Message{User: "alice", Room: "room1", Limit: 2}, "m4 m5"},
+		{"since", Message{User: "alice", Room: "room1", Since: "m2"}, "m3 m4 m5"},
+		{"unknown since", Message{User: "alice", Room: "room1", Since: "m9", Limit: 1}, "m5"},
+		{"empty room", Message{User: "alice", Room: "room2"}, ""},
+	} {
+		client := dial(t, addr, nil)
+		if got := ids(client.rejoin(t, tt.join)); got != tt.want {
+			t.Errorf("%s: replayed %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReconnectResumesAfterLastSeq(t *testing.T) {
+	st := store.NewMemoryStore(0)
+	fill(t, st, "room1", 3)
+	_, addr := newTestServerWithStore(t, st, Options{})
+
+	bob := dial(t, addr, nil)
+	bob.join(t, "bob", "room1")
+	alice := dial(t, addr, nil)
+	alice.join(t, "alice", "room1")
+
+	bob.send(t, Message{Type: "message", User: "bob", Room: "room1", Message: "seen"})
+	var last Message
+	for last.Message != "seen" {
+		last = alice.next(t)
+	}
+	if last.Seq != 4 {
+		t.Fatalf("seq = %d, want 4", last.Seq)
+	}
+	alice.conn.Close()
+
+	// Sent while alice is away; bob receives them once they are stored
+	for _, text := range []string{"missed 1", "missed 2"} {
+		bob.send(t, Message{Type: "message", User: "bob", Room: "room1", Message: text})
+		for bob.next(t).Message != text {
+		}
+	}
+
+	alice = dial(t, addr, nil)
+	missed := alice.rejoin(t, Message{User: "alice", Room: "room1", LastSeq: last.Seq})
+	if len(missed) != 2 || missed[0].Message != "missed 1" || missed[1].Message != "missed 2" || missed[0].Seq != 5 || missed[1].Seq != 6 {
+		t.Errorf("resumed with %+v, want the two missed messages", missed)
+	}
+}
+
+func TestResumeGapTooLargeAsksForReload(t *testing.T) {
+	st := store.NewMemoryStore(0)
+	fill(t, st, "room1", store.MaxResume+2)
+	_, addr := newTestServerWithStore(t, st, Options{})
+
+	for _, lastSeq := range []uint64{1, store.MaxResume + 10} {
+		client := dial(t, addr, nil)
+		got := client.rejoin(t, Message{User: "alice", Room: "room1", LastSeq: lastSeq})
+		if len(got) != 1 || got[0].Type != "reload" || got[0].Message != store.ErrGapTooLarge.Error() {
+			t.Errorf("resuming after %d sent %+v, want a reload message only", lastSeq, got)
+		}
+	}
+}
+
+func TestPrivateRoomReachesItsMembersOnly(t *testing.T) {
+	p := policy.New()
+	if err := p.SetRoom(policy.Room{Name: "staff", Kind: policy.Private, Members: map[string]policy.Role{"alice": policy.Member}}); err != nil {
+		t.Fatal(err)
+	}
+	_, addr := newTestServer(t, Options{Policy: p})
+
+	alice := dial(t, addr, nil)
+	alice.join(t, "alice", "staff")
+
+	refused := dial(t, addr, nil)
+	refused.send(t, Message{Type: "join", User: "eve", Room: "staff", Message: "eve joined the chat"})
+	if msg := refused.next(t); msg.Type != "error" || msg.Code != string(policy.NotInvited) {
+		t.Fatalf("refused join got %s %q, want a not_invited error", msg.Type, msg.Code)
+	}
+	roomless := dial(t, addr, nil)
+	elsewhere := dial(t, addr, nil)
+	elsewhere.join(t, "bob", "general")
+
+	alice.send(t, Message{Type: "message", User: "alice", Room: "staff", Message: "secret"})
+	if msg := alice.next(t); msg.Message != "secret" {
+		t.Fatalf("alice got %q, want her own message", msg.Message)
+	}
+	for name, client := range map[string]*testClient{"refused": refused, "roomless": roomless, "elsewhere": elsewhere} {
+		t.Run(name, client.nothing)
+	}
+}
+
+func TestMutedClientCannotPost(t *testing.T) {
+	p := policy.New()
+	if err := p.SetRoom(policy.Room{Name: "class", Kind: policy.Public, Members: map[string]policy.Role{"mallory": policy.Muted}}); err != nil {
+		t.Fatal(err)
+	}
+	_, addr := newTestServer(t, Options{Policy: p})
+
+	bob := dial(t, addr, nil)
+	bob.join(t, "bob", "class")
+	mallory := dial(t, addr, nil)
+	mallory.join(t, "mallory", "class")
+	if msg := bob.nextOf(t, "join"); msg.User != "mallory" {
+		t.Fatalf("bob got the join of %q, want mallory's", msg.User)
+	}
+
+	for _, msgType := range []string{"system", "reload", "leave", "message"} {
+		mallory.send(t, Message{Type: msgType, User: "mallory", Room: "class", Message: "everyone reload"})
+		if msg := mallory.next(t); msg.Type != "error" {
+			t.Errorf("%s message got %s %q back, want an error", msgType, msg.Type, msg.Message)
+		} else if msgType == "message" && msg.Code != string(policy.UserMuted) {
+			t.Errorf("message got error code %q, want %q", msg.Code, policy.UserMuted)
+		}
+	}
+	bob.nothing(t)
+}
+
+func TestHistoryComesBeforeLiveMessages(t *testing.T) {
+	st := store.NewMemoryStore(0)
+	fill(t, st, "room1", 3)
+	_, addr := newTestServerWithStore(t, st, Options{})
+
+	bob := dial(t, addr, nil)
+	bob.join(t, "bob", "room1")
+	bob.send(t, Message{Type: "message", User: "bob", Room: "room1", Message: "live"})
+
+	alice := dial(t, addr, nil)
+	history := alice.join(t, "alice", "room1")
+	if len(history) < 3 || ids(history[:3]) != "m1 m2 m3" {
+		t.Fatalf("replayed %q, want the stored messages first", ids(history))
+	}
+	// The live message is replayed or delivered, but once
+	live := 0
+	for _, msg := range history[3:] {
+		if msg.Message == "live" {
+			live++
+		}
+	}
+	alice.send(t, Message{Type: "message", User: "alice", Room: "room1", Message: "marker"})
+	for {
+		msg := alice.next(t)
+		if msg.Message == "marker" {
+			break
+		}
+		if msg.Message == "live" {
+			live++
+		}
+	}
+	if live != 1 {
+		t.Errorf("received the live message %d times, want once", live)
+	}
+}
+
+func TestDirectMessagesReachOnlyTheirUsers(t *testing.T) {
+	verifier, err := auth.NewVerifier(auth.Config{Secret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := newTestServer(t, Options{Auth: verifier})
+	as := func(user string) http.Header {
+		token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+			Subject:   user,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		}).SignedString([]byte("secret"))
+		return http.Header{"Authorization": {"Bearer " + token}}
+	}
+
+	carol := dial(t, addr, as("carol"))
+	carol.join(t, "carol", "room1")
+	alice := dial(t, addr, as("alice"))
+	alice.join(t, "alice", "room1")
+	if msg := carol.next(t); msg.Type != "join" || msg.User != "alice" {
+		t.Fatalf("carol got %+v, want alice's join", msg)
+	}
+	// Neither bob nor the other connection of alice joined a room
+	bob := dial(t, addr, as("bob"))
+	aliceMobile := dial(t, addr, as("alice"))
+	time.Sleep(50 * time.Millisecond) // let the hub register them
+
+	alice.send(t, Message{Type: "direct", To: "bob", Message: "see me after class"})
+	for name, client := range map[string]*testClient{"bob": bob, "alice": alice, "alice's other connection": aliceMobile} {
+		msg := client.next(t)
+		if msg.Type != "direct" || msg.User != "alice" || msg.To != "bob" || msg.Room != policy.DirectRoom("alice", "bob") {
+			t.Errorf("%s got %+v, want the direct message", name, msg)
+		}
+	}
+
+	bob.send(t, Message{Type: "direct", To: "alice", Message: "ok"})
+	for _, client := range []*testClient{alice, aliceMobile, bob} {
+		if msg := client.next(t); msg.Type != "direct" || msg.User != "bob" || msg.Message != "ok" {
+			t.Errorf("got %+v, want bob's reply", msg)
+		}
+	}
+	carol.nothing(t)
+	bob.nothing(t)
+}
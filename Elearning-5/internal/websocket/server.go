@@ -1,35 +1,111 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"elearning-5/internal/auth"
+	"elearning-5/internal/broker"
+	"elearning-5/internal/certs"
+	"elearning-5/internal/connlimit"
+	"elearning-5/internal/metrics"
+	"elearning-5/internal/origin"
+	"elearning-5/internal/policy"
+	"elearning-5/internal/presence"
+	"elearning-5/internal/ratelimit"
+	"elearning-5/internal/store"
+	"elearning-5/pkg/logger"
+	"elearning-5/pkg/middleware"
+
 	"github.com/gorilla/websocket"
 	"github.com/rs/cors"
 )
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins in development
-	},
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+// Options configures a Server. Zero values select the defaults.
+type Options struct {
+	// Auth verifies the token of /ws upgrades and /history requests.
+	// Clients name themselves in their first message when it is nil or has
+	// no keys.
+	Auth *auth.Verifier
+	// Policy decides who may join and post in each room; nil allows
+	// everything.
+	Policy *policy.Policy
+	// Limiter throttles the messages of each connection, user and room;
+	// nil does not limit.
+	Limiter *ratelimit.Limiter
+	// Connections caps the open connections in total and per remote IP;
+	// nil does not cap.
+	Connections *connlimit.Limiter
+	// TLS serves wss:// and https:// with its current certificate; nil
+	// serves plain ws:// and http://.
+	TLS *certs.Reloader
+	// Origins lists the browser origins allowed by CORS and on /ws
+	// upgrades; nil allows every origin.
+	Origins *origin.Allowlist
+	// Metrics records the server's activity and is served at /metrics;
+	// nil records nothing.
+	Metrics *metrics.Metrics
+	// Presence tracks the users of the connections, relays their typing
+	// indicators and serves /rooms/{room}/members; nil tracks nothing.
+	Presence *presence.Tracker
 }
 
 type Server struct {
-	hub *Hub
-	mu  sync.RWMutex
+	hub        *Hub
+	options    Options
+	upgrader   websocket.Upgrader
+	mu         sync.RWMutex
+	httpServer *http.Server
 }
 
-func NewServer() *Server {
-	hub := NewHub()
-	return &Server{hub: hub}
+func NewServer(b broker.Broker, st store.MessageStore, opts Options) *Server {
+	hub := NewHub(b, st)
+	hub.policy = opts.Policy
+	hub.metrics = opts.Metrics
+	return &Server{
+		hub:     hub,
+		options: opts,
+		upgrader: websocket.Upgrader{
+			CheckOrigin:     opts.Origins.CheckOrigin,
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+		},
+	}
 }
 
 func (s *Server) Start(port string) error {
+	lis, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+
+	wsScheme, httpScheme := "ws", "http"
+	if s.options.TLS != nil {
+		wsScheme, httpScheme = "wss", "https"
+	}
+	base := httpScheme + "://localhost:" + port
+	slog.Info("WebSocket server starting",
+		"port", port,
+		"endpoint", wsScheme+"://localhost:"+port+"/ws",
+		"health", base+"/health",
+		"stats", base+"/stats",
+		"history", base+"/history?room=general",
+		"members", base+"/rooms/general/members",
+		"metrics", s.options.Metrics != nil)
+	return s.Serve(lis)
+}
+
+// Serve runs the hub and serves the WebSocket and HTTP endpoints on lis
+// until Shutdown is called.
+func (s *Server) Serve(lis net.Listener) error {
 	// Start the hub in a goroutine
 	go s.hub.Run()
 
@@ -37,43 +113,100 @@ func (s *Server) Start(port string) error {
 	mux := http.NewServeMux()
 
 	// Register routes
-	mux.HandleFunc("/ws", s.handleWebSocket)
+	authFailed := s.options.Metrics.AuthFailures(metrics.WebSocket)
+	mux.Handle("/ws", middleware.RequireAuth(s.options.Auth, authFailed, http.HandlerFunc(s.handleWebSocket)))
 	mux.HandleFunc("/health", s.healthCheck)
 	mux.HandleFunc("/stats", s.handleStats)
+	mux.Handle("/history", middleware.RequireAuth(s.options.Auth, authFailed, http.HandlerFunc(s.handleHistory)))
+	mux.Handle("/rooms/", middleware.RequireAuth(s.options.Auth, authFailed, http.HandlerFunc(s.handleMembers)))
+	if s.options.Metrics != nil {
+		mux.Handle("/metrics", s.options.Metrics.Handler())
+	}
 	mux.HandleFunc("/", s.serveHome)
 
 	// CORS middleware
-	corsHandler := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
+	corsHandler := s.options.Origins.CORS(cors.Options{
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   []string{"*"},
 		AllowCredentials: true,
 		Debug:            false,
 	}).Handler(mux)
 
-	log.Printf("🚀 WebSocket server starting on :%s", port)
-	log.Printf("📡 WebSocket endpoint: ws://localhost:%s/ws", port)
-	log.Printf("❤️  Health check: http://localhost:%s/health", port)
-	log.Printf("📊 Statistics: http://localhost:%s/stats", port)
+	s.mu.Lock()
+	s.httpServer = &http.Server{Handler: corsHandler}
+	if s.options.TLS != nil {
+		s.httpServer.TLSConfig = s.options.TLS.ServerConfig()
+	}
+	httpServer := s.httpServer
+	s.mu.Unlock()
+
+	var err error
+	if httpServer.TLSConfig != nil {
+		// The certificate comes from TLSConfig.GetCertificate
+		err = httpServer.ServeTLS(lis, "", "")
+	} else {
+		err = httpServer.Serve(lis)
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops accepting connections, flushes every client's send queue,
+// closes the connections with a going-away close frame and stops the hub.
+// It gives up when ctx expires.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.RLock()
+	httpServer := s.httpServer
+	s.mu.RUnlock()
 
-	return http.ListenAndServe(":"+port, corsHandler)
+	if httpServer != nil {
+		// Upgraded connections are hijacked, so this only stops the
+		// listener and plain HTTP requests
+		if err := httpServer.Shutdown(ctx); err != nil {
+			return err
+		}
+	}
+	return s.hub.Shutdown(ctx)
 }
 
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+	release, err := s.options.Connections.Acquire(connlimit.Host(r.RemoteAddr))
 	if err != nil {
-		log.Printf("❌ WebSocket upgrade failed: %v", err)
+		slog.Warn("WebSocket connection refused", logger.RemoteKey, r.RemoteAddr, "err", err)
+		connlimit.Reject(w, err)
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		release()
+		slog.Warn("WebSocket upgrade failed", logger.RemoteKey, r.RemoteAddr, "err", err)
 		return
 	}
 
 	client := NewClient(conn, s.hub)
-	s.hub.register <- client
+	client.limit = s.options.Limiter.NewConn()
+	client.presence = s.options.Presence.Connect(metrics.WebSocket)
+	client.release = release
+	if user, ok := auth.UserFrom(r.Context()); ok {
+		client.userID = user
+		client.with(logger.UserKey, user)
+		client.presence.Identify(user)
+	}
+	select {
+	case s.hub.register <- client:
+	case <-s.hub.done:
+		conn.Close()
+		client.presence.Close()
+		release()
+		return
+	}
 
 	// Start client goroutines
 	go client.WritePump()
 	go client.ReadPump()
-
-	log.Printf("✅ New WebSocket client connected from %s", r.RemoteAddr)
 }
 
 func (s *Server) healthCheck(w http.ResponseWriter, r *http.Request) {
@@ -88,7 +221,7 @@ func (s *Server) healthCheck(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if err := json.NewEncoder(w).Encode(healthStatus); err != nil {
-		log.Printf("Error encoding health response: %v", err)
+		slog.Error("Encoding health response failed", "err", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
@@ -102,14 +235,107 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 		"active_connections": stats.ActiveConnections,
 		"total_messages":     stats.TotalMessages,
 		"total_connections":  stats.TotalConnections,
+		"connection_limit":   s.options.Connections.Stats(),
 		"timestamp":          time.Now().Format(time.RFC3339),
 	}
 
 	if err := json.NewEncoder(w).Encode(statsResponse); err != nil {
-		log.Printf("Error encoding stats response: %v", err)
+		slog.Error("Encoding stats response failed", "err", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+}
+
+// handleHistory serves the newest messages of a room, or those older than
+// the before cursor. The next_before of a response is the cursor of the
+// previous page.
+func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	room := query.Get("room")
+	if room == "" {
+		http.Error(w, "room is required", http.StatusBadRequest)
+		return
+	}
+	user, _ := auth.UserFrom(r.Context())
+	if err := s.options.Policy.Authorize(user, room, policy.Join); err != nil {
+		forbidden(w, err)
+		return
+	}
+	limit := 0
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "limit must be a number", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	page, err := store.History(s.hub.store, room, query.Get("before"), limit)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "Unknown cursor", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Loading history failed", logger.RoomKey, room, "err", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+
+	messages := make([]Message, len(page.Messages))
+	for i, msg := range page.Messages {
+		messages[i] = fromBrokerMessage(msg)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"room":        room,
+		"messages":    messages,
+		"next_before": page.NextBefore,
+	})
+}
+
+// handleMembers serves /rooms/{room}/members, the users in a room on every
+// protocol with their presence.
+func (s *Server) handleMembers(w http.ResponseWriter, r *http.Request) {
+	room, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/rooms/"), "/members")
+	if !ok || room == "" || strings.Contains(room, "/") {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, _ := auth.UserFrom(r.Context())
+	if err := s.options.Policy.Authorize(user, room, policy.Join); err != nil {
+		forbidden(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"room":    room,
+		"members": s.options.Presence.Members(room),
+	})
+}
+
+// forbidden answers a request the room policy denied with its code.
+func forbidden(w http.ResponseWriter, err error) {
+	var denied *policy.Error
+	errors.As(err, &denied)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	json.NewEncoder(w).Encode(map[string]string{
+		"code":    string(denied.Code),
+		"message": denied.Error(),
+	})
 }
 
 func (s *Server) serveHome(w http.ResponseWriter, r *http.Request) {
@@ -145,6 +371,8 @@ func (s *Server) serveHome(w http.ResponseWriter, r *http.Request) {
 				<p><strong>WebSocket URL:</strong> ws://localhost:8080/ws</p>
 				<p><strong>Health Check:</strong> <a href="/health">/health</a></p>
 				<p><strong>Statistics:</strong> <a href="/stats">/stats</a></p>
+				<p><strong>History:</strong> <a href="/history?room=general">/history?room=general</a></p>
+				<p><strong>Members:</strong> <a href="/rooms/general/members">/rooms/general/members</a></p>
 			</div>
 			<div class="status info">
 				<h3>Client Usage:</h3>
@@ -0,0 +1,374 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"elearning-5/internal/broker"
+	"elearning-5/internal/connlimit"
+	"elearning-5/internal/origin"
+	"elearning-5/internal/presence"
+	"elearning-5/internal/store"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestServer serves a Server on a local port and returns it with its
+// address.
+func newTestServer(t *testing.T, opts Options) (*Server, string) {
+	t.Helper()
+	return newTestServerWithStore(t, store.NewMemoryStore(0), opts)
+}
+
+func newTestServerWithStore(t *testing.T, st store.MessageStore, opts Options) (*Server, string) {
+	t.Helper()
+	return newTestServerOn(t, broker.NewMemoryBroker(), st, opts)
+}
+
+// newTestServerOn serves a Server on b, which it closes when the test ends.
+func newTestServerOn(t *testing.T, b broker.Broker, st store.MessageStore, opts Options) (*Server, string) {
+	t.Helper()
+
+	s := NewServer(b, st, opts)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(lis)
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		s.Shutdown(ctx)
+		b.Close()
+	})
+	return s, lis.Addr().String()
+}
+
+// testClient is a /ws connection whose messages are read in the background.
+type testClient struct {
+	conn     *websocket.Conn
+	messages chan Message
+	err      error // why reading stopped, set before messages is closed
+}
+
+func dial(t *testing.T, addr string, header http.Header) *testClient {
+	t.Helper()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", header)
+	if err != nil {
+		t.Fatalf("dial /ws: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &testClient{conn: conn, messages: make(chan Message, 256)}
+	go func() {
+		defer close(c.messages)
+		for {
+			var msg Message
+			if c.err = conn.ReadJSON(&msg); c.err != nil {
+				return
+			}
+			c.messages <- msg
+		}
+	}()
+	return c
+}
+
+func (c *testClient) send(t *testing.T, msg Message) {
+	t.Helper()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+}
+
+// join enters a room and waits for the client's own join to come back. It
+// returns what arrived before it, such as the room's history.
+func (c *testClient) join(t *testing.T, user, room string) []Message {
+	t.Helper()
+	return c.rejoin(t, Message{Type: "join", User: user, Room: room})
+}
+
+// rejoin sends a join message, which may select the history to replay, and
+// waits for it to come back like join.
+func (c *testClient) rejoin(t *testing.T, join Message) []Message {
+	t.Helper()
+	join.Type, join.Message = "join", join.User+" joined the chat"
+	c.send(t, join)
+
+	var before []Message
+	for {
+		msg := c.next(t)
+		if msg.Type == "join" && msg.User == join.User {
+			return before
+		}
+		before = append(before, msg)
+	}
+}
+
+// next waits for the next message of the client.
+func (c *testClient) next(t *testing.T) Message {
+	t.Helper()
+	select {
+	case msg, ok := <-c.messages:
+		if !ok {
+			t.Fatalf("connection closed: %v", c.err)
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return Message{}
+	}
+}
+
+// nextOf waits for the next message of type msgType, skipping others.
+func (c *testClient) nextOf(t *testing.T, msgType string) Message {
+	t.Helper()
+	for {
+		if msg := c.next(t); msg.Type == msgType {
+			return msg
+		}
+	}
+}
+
+// nothing checks that no message arrives for a while.
+func (c *testClient) nothing(t *testing.T) {
+	t.Helper()
+	select {
+	case msg, ok := <-c.messages:
+		if ok {
+			t.Fatalf("unexpected %s %q from %s in %s", msg.Type, msg.Message, msg.User, msg.Room)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// closed waits until the server closes the connection and returns why.
+func (c *testClient) closed(t *testing.T) error {
+	t.Helper()
+	deadline := time.After(2 * time.Second)
+	for {
+		select {
+		case _, ok := <-c.messages:
+			if !ok {
+				return c.err
+			}
+		case <-deadline:
+			t.Fatal("connection is still open")
+			return nil
+		}
+	}
+}
+
+// fill stores n messages in room, with the IDs m1 to mn.
+func fill(t *testing.T, st store.MessageStore, room string, n int) {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		msg := broker.Message{ID: fmt.Sprintf("m%d", i), User: "bob", Message: fmt.Sprintf("message %d", i), Room: room, Type: "message"}
+		if _, err := st.Append(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// ids lists the IDs of msgs separated by spaces.
+func ids(msgs []Message) string {
+	var s []string
+	for _, msg := range msgs {
+		s = append(s, msg.ID)
+	}
+	return strings.Join(s, " ")
+}
+
+func TestHistoryPages(t *testing.T) {
+	st := store.NewMemoryStore(0)
+	fill(t, st, "room1", 5)
+	_, addr := newTestServerWithStore(t, st, Options{})
+
+	get := func(query string) (*http.Response, error) {
+		return http.Get("http://" + addr + "/history?" + query)
+	}
+
+	before := ""
+	for _, want := range []struct{ ids, nextBefore string }{
+		{"m4 m5", "m4"},
+		{"m2 m3", "m2"},
+		{"m1", ""},
+	} {
+		resp, err := get("room=room1&limit=2&before=" + before)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var page struct {
+			Room       string    `json:"room"`
+			Messages   []Message `json:"messages"`
+			NextBefore string    `json:"next_before"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ids(page.Messages); page.Room != "room1" || got != want.ids || page.NextBefore != want.nextBefore {
+			t.Fatalf("page before %q = %s %q next %q, want %q next %q", before, page.Room, got, page.NextBefore, want.ids, want.nextBefore)
+		}
+		before = page.NextBefore
+	}
+
+	for query, want := range map[string]int{
+		"":                     http.StatusBadRequest,
+		"room=room1&limit=ten": http.StatusBadRequest,
+		"room=room1&before=m9": http.StatusNotFound,
+	} {
+		resp, err := get(query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("/history?%s status = %d, want %d", query, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestConnectionsOverTheCapAreRefused(t *testing.T) {
+	caps := connlimit.New(connlimit.Limits{Max: 10, PerIP: 1})
+	_, addr := newTestServer(t, Options{Connections: caps})
+
+	first := dial(t, addr, nil)
+	first.join(t, "alice", "room1")
+
+	_, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+	if err == nil || resp == nil {
+		t.Fatalf("second connection: %v, want a refused upgrade", err)
+	}
+	resp.Body.Close()
+	if want := strconv.Itoa(int(connlimit.RetryAfter / time.Second)); resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != want {
+		t.Errorf("refusal = %d with Retry-After %q, want 503 with %q", resp.StatusCode, resp.Header.Get("Retry-After"), want)
+	}
+
+	// Closing the first connection makes room again
+	first.conn.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", nil)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("connection after the first closed: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUpgradesFromOtherOriginsAreRefused(t *testing.T) {
+	origins, err := origin.New([]string{"https://app.example.com"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := newTestServer(t, Options{Origins: origins})
+
+	for o, want := range map[string]int{
+		"https://evil.example.com": http.StatusForbidden,
+		"http://app.example.com":   http.StatusForbidden,
+		"https://app.example.com":  http.StatusSwitchingProtocols,
+		"":                         http.StatusSwitchingProtocols, // native clients send none
+	} {
+		header := http.Header{}
+		if o != "" {
+			header.Set("Origin", o)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial("ws://"+addr+"/ws", header)
+		if conn != nil {
+			conn.Close()
+		}
+		if resp == nil {
+			t.Fatalf("origin %q: %v", o, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("origin %q: status %d, want %d", o, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestMembersAndTyping(t *testing.T) {
+	b := broker.NewMemoryBroker()
+	_, addr := newTestServerOn(t, b, store.NewMemoryStore(0), Options{Presence: presence.New(b, presence.Options{})})
+
+	members := func(path string) (int, []presence.Member) {
+		t.Helper()
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var roster struct {
+			Room    string            `json:"room"`
+			Members []presence.Member `json:"members"`
+		}
+		json.NewDecoder(resp.Body).Decode(&roster)
+		return resp.StatusCode, roster.Members
+	}
+
+	alice := dial(t, addr, nil)
+	alice.join(t, "alice", "room1")
+	bob := dial(t, addr, nil)
+	bob.join(t, "bob", "room1")
+	if msg := alice.nextOf(t, presence.PresenceType); msg.User != "bob" || msg.Message != string(presence.Online) {
+		t.Fatalf("alice got %+v, want bob online", msg)
+	}
+	if msg := alice.next(t); msg.Type != "join" || msg.User != "bob" {
+		t.Fatalf("alice got %+v, want bob's join", msg)
+	}
+
+	alice.send(t, Message{Type: presence.TypingType})
+	if msg := bob.nextOf(t, presence.TypingType); msg.User != "alice" || msg.Room != "room1" || msg.Message != presence.TypingStarted {
+		t.Fatalf("bob got %+v, want alice typing", msg)
+	}
+	want := []presence.Member{{User: "alice", Status: presence.Online, Typing: true}, {User: "bob", Status: presence.Online}}
+	if status, got := members("/rooms/room1/members"); status != http.StatusOK || fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("members = %d %v, want %v", status, got, want)
+	}
+
+	alice.send(t, Message{Type: presence.TypingType, Message: presence.TypingStopped})
+	if msg := bob.nextOf(t, presence.TypingType); msg.User != "alice" || msg.Message != presence.TypingStopped {
+		t.Fatalf("bob got %+v, want alice to stop typing", msg)
+	}
+	// Typists do not see their own indicator
+	alice.nothing(t)
+
+	if status, got := members("/rooms/room2/members"); status != http.StatusOK || len(got) != 0 {
+		t.Errorf("members of an empty room = %d %v, want none", status, got)
+	}
+	if status, _ := members("/rooms/room1/typing"); status != http.StatusNotFound {
+		t.Errorf("unknown room path status = %d, want 404", status)
+	}
+}
+
+func TestShutdownSendsCloseFrame(t *testing.T) {
+	s, addr := newTestServer(t, Options{})
+	client := dial(t, addr, nil)
+	client.join(t, "alice", "room1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown: %v", err)
+	}
+
+	var closeErr *websocket.CloseError
+	if err := client.closed(t); !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway {
+		t.Errorf("connection ended with %v, want a going-away close frame", err)
+	}
+}
@@ -0,0 +1,94 @@
+// Package logger sets up the structured log/slog logger every package writes
+// to, and names the attributes that correlate the lines of one connection.
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Attribute keys shared by every protocol.
+const (
+	ConnKey     = "conn"
+	UserKey     = "user"
+	RoomKey     = "room"
+	ProtocolKey = "protocol"
+	RemoteKey   = "remote_addr"
+	// BodyKey holds chat message text, which is redacted unless
+	// Options.Bodies is set.
+	BodyKey = "body"
+)
+
+// Options configures the logger. Zero values select text output at the info
+// level with message bodies redacted.
+type Options struct {
+	// Format is "text" or "json".
+	Format string
+	// Level is debug, info, warn or error.
+	Level string
+	// Bodies logs the text of chat messages instead of its length.
+	Bodies bool
+}
+
+// New returns a logger writing to w.
+func New(w io.Writer, opts Options) (*slog.Logger, error) {
+	var level slog.Level
+	if opts.Level != "" {
+		if err := level.UnmarshalText([]byte(opts.Level)); err != nil {
+			return nil, fmt.Errorf("unknown log level %q", opts.Level)
+		}
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	if !opts.Bodies {
+		handlerOpts.ReplaceAttr = redact
+	}
+
+	switch strings.ToLower(opts.Format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q (want text or json)", opts.Format)
+	}
+}
+
+// Setup makes a logger writing to stderr the default, which the standard
+// log package then writes through as well.
+func Setup(opts Options) error {
+	l, err := New(os.Stderr, opts)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(l)
+	return nil
+}
+
+// redact replaces message bodies by their length.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == BodyKey && a.Value.Kind() == slog.KindString {
+		return slog.String(BodyKey, fmt.Sprintf("[redacted %d bytes]", len(a.Value.String())))
+	}
+	return a
+}
+
+// Body is the attribute of a chat message's text.
+func Body(text string) slog.Attr {
+	return slog.String(BodyKey, text)
+}
+
+// Conn returns the default logger with the attributes of a new connection.
+// The user and room are added with With as they become known.
+func Conn(protocol, id, remoteAddr string) *slog.Logger {
+	return slog.Default().With(ProtocolKey, protocol, ConnKey, id, RemoteKey, remoteAddr)
+}
+
+// Fatal logs msg at the error level and exits.
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
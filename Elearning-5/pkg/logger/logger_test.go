@@ -0,0 +1,51 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestBodiesAreRedacted(t *testing.T) {
+	for bodies, want := range map[bool]string{
+		false: "[redacted 5 bytes]",
+		true:  "hello",
+	} {
+		var buf bytes.Buffer
+		l, err := New(&buf, Options{Format: "json", Bodies: bodies})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.With(ConnKey, "c1", UserKey, "alice").Info("Message published", Body("hello"))
+
+		var line map[string]interface{}
+		if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+			t.Fatalf("log line %q is not JSON: %v", buf.String(), err)
+		}
+		if line[BodyKey] != want || line[ConnKey] != "c1" || line[UserKey] != "alice" {
+			t.Errorf("Bodies %v: logged %v, want body %q", bodies, line, want)
+		}
+	}
+}
+
+func TestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := New(&buf, Options{Level: "warn"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Info("hidden")
+	l.Warn("shown")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "shown") {
+		t.Errorf("warn level logged %q", out)
+	}
+}
+
+func TestNewRejectsInvalidOptions(t *testing.T) {
+	for _, opts := range []Options{{Format: "xml"}, {Level: "loud"}} {
+		if _, err := New(&bytes.Buffer{}, opts); err == nil {
+			t.Errorf("New(%+v) succeeded", opts)
+		}
+	}
+}
@@ -1,24 +0,0 @@
-package utils
-
-import (
-	"log"
-	"os"
-)
-
-var (
-	InfoLogger  *log.Logger
-	ErrorLogger *log.Logger
-)
-
-func init() {
-	InfoLogger = log.New(os.Stdout, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
-	ErrorLogger = log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
-}
-
-func Info(format string, v ...interface{}) {
-	InfoLogger.Printf(format, v...)
-}
-
-func Error(format string, v ...interface{}) {
-	ErrorLogger.Printf(format, v...)
-}
@@ -1,3 +1,6 @@
+// SignalR JSON hub protocol record separator
+const RECORD_SEPARATOR = "\x1e";
+
 class ChatApplication {
     constructor() {
         this.ws = null;
@@ -6,6 +9,12 @@ class ChatApplication {
         this.userId = 'User1';
         this.room = 'general';
         this.isGrpcConnected = false;
+        this.lastMessageId = null; // resume point for the history replayed on join
+        this.lastSeq = 0; // seq of the last message received, for an exact resume
+        // JWT for servers with authentication enabled, e.g. index.html?access_token=...
+        this.token = new URLSearchParams(window.location.search).get('access_token');
+        // Pages served over https connect with wss:// to servers with TLS enabled
+        this.wsScheme = window.location.protocol === 'https:' ? 'wss' : 'ws';
         
         this.initializeApp();
     }
@@ -27,6 +36,11 @@ class ChatApplication {
         document.getElementById('room').value = this.room;
     }
 
+    // Browsers cannot set headers on WebSocket upgrades, so the token goes in the query
+    withToken(url) {
+        return this.token ? `${url}?access_token=${encodeURIComponent(this.token)}` : url;
+    }
+
     setupEventListeners() {
         // Auto-connect on page load for demo
         setTimeout(() => {
@@ -43,24 +57,40 @@ class ChatApplication {
 
             this.updateStatus('wsStatus', 'connecting', 'Connecting...');
             
-            this.ws = new WebSocket('ws://localhost:8080/ws');
+            this.ws = new WebSocket(this.withToken(`${this.wsScheme}://localhost:8080/ws`));
             
             this.ws.onopen = () => {
                 this.updateStatus('wsStatus', 'connected', 'Connected');
                 this.addSystemMessage('WebSocket connected successfully');
                 
-                // Send join message
+                // Send join message; the server replays the room history first
                 const joinMsg = {
                     user: this.userId,
                     message: `${this.userId} joined the chat`,
                     room: this.room,
                     type: 'join'
                 };
+                if (this.lastSeq) {
+                    joinMsg.last_seq = this.lastSeq;
+                } else if (this.lastMessageId) {
+                    joinMsg.since = this.lastMessageId;
+                }
                 this.ws.send(JSON.stringify(joinMsg));
             };
             
             this.ws.onmessage = (event) => {
                 const message = JSON.parse(event.data);
+                if (message.type === 'message' && message.id) {
+                    this.lastMessageId = message.id;
+                    if (message.seq) {
+                        this.lastSeq = message.seq;
+                    }
+                }
+                if (message.type === 'reload') {
+                    // Too much was missed to resume; start over from the latest history
+                    this.lastSeq = 0;
+                    this.lastMessageId = null;
+                }
                 this.displayMessage(message);
             };
             
@@ -85,23 +115,25 @@ class ChatApplication {
             this.updateStatus('signalrStatus', 'connecting', 'Connecting...');
             
             // SignalR-like implementation
-            this.signalr = new WebSocket('ws://localhost:8081/signalr');
+            this.signalr = new WebSocket(this.withToken(`${this.wsScheme}://localhost:8081/signalr`));
             
             this.signalr.onopen = () => {
                 this.updateStatus('signalrStatus', 'connected', 'Connected');
                 this.addSystemMessage('SignalR-like connection established');
                 
-                // Send negotiation message
-                const negotiateMsg = {
+                // Send handshake message
+                const handshakeMsg = {
                     protocol: "json",
                     version: 1
                 };
-                this.signalr.send(JSON.stringify(negotiateMsg));
+                this.sendSignalR(handshakeMsg);
             };
             
             this.signalr.onmessage = (event) => {
-                const message = JSON.parse(event.data);
-                this.handleSignalRMessage(message);
+                // Every hub protocol message ends with a record separator
+                event.data.split(RECORD_SEPARATOR)
+                    .filter(record => record.length > 0)
+                    .forEach(record => this.handleSignalRMessage(JSON.parse(record)));
             };
             
             this.signalr.onclose = () => {
@@ -132,13 +164,28 @@ class ChatApplication {
         }, 1000);
     }
 
+    sendSignalR(message) {
+        this.signalr.send(JSON.stringify(message) + RECORD_SEPARATOR);
+    }
+
     handleSignalRMessage(message) {
-        if (message.type === 1) { // Invocation
-            this.addSystemMessage(`SignalR: ${message.target} invoked`);
+        if (message.type === undefined) { // Handshake response
+            if (message.error) {
+                this.addSystemMessage('SignalR handshake failed: ' + message.error);
+                return;
+            }
+            this.sendSignalR({ type: 1, target: "JoinGroup", arguments: [this.room] });
+        } else if (message.type === 1) { // Invocation
+            if (message.target === 'ReceiveMessage' && message.arguments.length > 0) {
+                this.displayMessage(message.arguments[0]);
+            } else {
+                this.addSystemMessage(`SignalR: ${message.target} invoked`);
+            }
         } else if (message.type === 6) { // Ping
-            // Respond to ping
-            const pong = { type: 6 };
-            this.signalr.send(JSON.stringify(pong));
+            // Answer keep-alive pings so the server does not time us out
+            this.sendSignalR({ type: 6 });
+        } else if (message.type === 7) { // Close
+            this.addSystemMessage('SignalR closed by server' + (message.error ? ': ' + message.error : ''));
         }
     }
 
@@ -174,7 +221,7 @@ class ChatApplication {
                             target: "SendMessage",
                             arguments: [this.userId, message, this.room]
                         };
-                        this.signalr.send(JSON.stringify(signalrMsg));
+                        this.sendSignalR(signalrMsg);
                         this.displayMessage({...messageData, type: 'message'});
                     } else {
                         this.addSystemMessage('SignalR not connected');
@@ -269,6 +316,8 @@ class ChatApplication {
         }
         
         this.isGrpcConnected = false;
+        this.lastMessageId = null; // resume point for the history replayed on join
+        this.lastSeq = 0;
         this.updateStatus('grpcStatus', 'disconnected', 'Disconnected');
         
         this.addSystemMessage('All connections closed');